@@ -6,8 +6,10 @@ import (
 	"github.com/openmetric/graphite-client"
 	"github.com/openmetric/yamf/executor"
 	"github.com/openmetric/yamf/internal/logging"
+	"github.com/openmetric/yamf/internal/ruledb"
 	"github.com/openmetric/yamf/internal/stats"
 	"github.com/openmetric/yamf/internal/utils"
+	"github.com/openmetric/yamf/processor"
 	"github.com/openmetric/yamf/scheduler"
 	"go.uber.org/zap"
 	"os"
@@ -29,6 +31,7 @@ type Module interface {
 func main() {
 	configFile := flag.String("config", "", "Path to the `config file`.")
 	printVersion := flag.Bool("version", false, "Print version and exit.")
+	migrateRuleDB := flag.String("migrate-ruledb", "", "Copy rules from the tiedot database configured for scheduler into a bolt `file`, then exit.")
 	flag.Parse()
 
 	if *printVersion {
@@ -46,18 +49,22 @@ func main() {
 		mode = "executor"
 	case strings.HasSuffix(os.Args[0], "scheduler"):
 		mode = "scheduler"
+	case strings.HasSuffix(os.Args[0], "processor"):
+		mode = "processor"
 	}
 
 	config := &struct {
 		Mode      string            `yaml:"mode"`
 		Executor  *executor.Config  `yaml:"executor"`
 		Scheduler *scheduler.Config `yaml:"scheduler"`
+		Processor *processor.Config `yaml:"processor"`
 		Log       *logging.Config   `yaml:"log"`
 		Stats     *stats.Config     `yaml:"stats"`
 	}{
 		Mode:      mode,
 		Executor:  executor.NewConfig(),
 		Scheduler: scheduler.NewConfig(),
+		Processor: processor.NewConfig(),
 		Log:       logging.NewConfig(),
 		Stats:     stats.NewConfig(),
 	}
@@ -71,6 +78,15 @@ func main() {
 
 	logger.Infof("yamf version: %s", BuildVersion)
 
+	if *migrateRuleDB != "" {
+		counts, err := ruledb.MigrateTiedot(config.Scheduler.DBPath, config.Scheduler.DBCollection, *migrateRuleDB)
+		if err != nil {
+			logger.Fatalw("Failed to migrate rule database.", "Error", err)
+		}
+		logger.Infow("Migrated rule database.", "Rules", counts.Rules, "Revisions", counts.Revisions, "Audit Records", counts.AuditRecords, "Maintenance Windows", counts.MaintenanceWindows, "Silences", counts.Silences, "Heartbeats", counts.Heartbeats)
+		os.Exit(0)
+	}
+
 	switch config.Mode {
 	case "executor":
 		if module, err = executor.NewExecutor(config.Executor, logger); err != nil {
@@ -80,6 +96,10 @@ func main() {
 		if module, err = scheduler.NewScheduler(config.Scheduler, logger); err != nil {
 			logger.Panicw("Error initializing scheduler.", "Error", err)
 		}
+	case "processor":
+		if module, err = processor.NewProcessor(config.Processor, logger); err != nil {
+			logger.Panicw("Error initializing processor.", "Error", err)
+		}
 	default:
 		logger.Panicw("You must specify a valid `mode` in config file.")
 	}
@@ -0,0 +1,183 @@
+package executor
+
+import (
+	"fmt"
+	api "github.com/openmetric/graphite-api-client"
+	"github.com/openmetric/yamf/internal/types"
+	"math"
+	"sort"
+	"time"
+)
+
+// deviation reported when sigma is 0 and the value differs from the expected one, json
+// can not encode infinity
+const maxDeviation = 1000
+
+// baselineFrom returns the graphite "from" covering the history needed by config.
+func baselineFrom(config *types.BaselineConfig) string {
+	history := time.Duration(config.Seasons)*config.Season.Duration + time.Hour
+	return fmt.Sprintf("-%ds", int64(history.Seconds()))
+}
+
+// pointValue returns the value of metric at index i, absent if i is out of range.
+func pointValue(metric *api.FetchResponse, i int) (float64, bool) {
+	if i < 0 || i >= len(metric.Values) || (i < len(metric.IsAbsent) && metric.IsAbsent[i]) {
+		return 0, true
+	}
+	return metric.Values[i], false
+}
+
+// baselineMedian returns the median of values at the same time of the last seasons, and
+// their standard deviation as sigma.
+func baselineMedian(config *types.BaselineConfig, metric *api.FetchResponse, i, seasonPoints int) (expected, sigma float64, samples int) {
+	var values []float64
+	for k := 1; k <= config.Seasons; k++ {
+		if v, absent := pointValue(metric, i-k*seasonPoints); !absent {
+			values = append(values, v)
+		}
+	}
+	if len(values) < 2 {
+		return 0, 0, len(values)
+	}
+
+	sort.Float64s(values)
+	if n := len(values); n%2 == 1 {
+		expected = values[n/2]
+	} else {
+		expected = (values[n/2-1] + values[n/2]) / 2
+	}
+
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		sigma += (v - mean) * (v - mean)
+	}
+	sigma = math.Sqrt(sigma / float64(len(values)-1))
+	return expected, sigma, len(values)
+}
+
+// baselineHoltWinters fits the points before index i with Holt-Winters, the same way as
+// graphite's holtWintersAnalysis, and returns the prediction of point i, and the
+// smoothed seasonal deviation as sigma.
+func baselineHoltWinters(config *types.BaselineConfig, metric *api.FetchResponse, i, seasonPoints int) (expected, sigma float64, samples int) {
+	alpha, beta, gamma := config.Alpha, config.Beta, config.Gamma
+
+	seasonals := make([]float64, i+1)
+	deviations := make([]float64, i+1)
+	lastSeasonal := func(j int) float64 {
+		if j -= seasonPoints; j >= 0 {
+			return seasonals[j]
+		}
+		return 0
+	}
+	lastDeviation := func(j int) float64 {
+		if j -= seasonPoints; j >= 0 {
+			return deviations[j]
+		}
+		return 0
+	}
+
+	// intercept is NaN before the first value, and after each missing one
+	intercept, slope := math.NaN(), 0.0
+	prediction, havePrediction := 0.0, false
+	for j := 0; j < i; j++ {
+		actual, absent := pointValue(metric, j)
+		if absent {
+			seasonals[j], deviations[j] = 0, 0
+			intercept, slope, havePrediction = math.NaN(), 0, false
+			continue
+		}
+		samples++
+
+		lastIntercept, lastSlope := intercept, slope
+		if math.IsNaN(lastIntercept) {
+			lastIntercept, lastSlope = actual, 0
+		}
+		// like graphite, only the first point seeds the prediction, a point after a
+		// missing one has no prediction, which counts as 0 for its deviation
+		if j == 0 {
+			prediction = actual
+		} else if !havePrediction {
+			prediction = 0
+		}
+
+		intercept = alpha*(actual-lastSeasonal(j)) + (1-alpha)*(lastIntercept+lastSlope)
+		slope = beta*(intercept-lastIntercept) + (1-beta)*lastSlope
+		seasonals[j] = gamma*(actual-intercept) + (1-gamma)*lastSeasonal(j)
+		deviations[j] = gamma*math.Abs(actual-prediction) + (1-gamma)*lastDeviation(j)
+
+		prediction = intercept + slope + lastSeasonal(j+1)
+		havePrediction = true
+	}
+
+	// a model without at least a season of data predicts nothing useful
+	if !havePrediction || samples < seasonPoints {
+		return 0, 0, samples
+	}
+	return prediction, lastDeviation(i), samples
+}
+
+// evaluateBaseline returns the status of the last value of metric, at timestamp t, by its
+// deviation from the baseline. Status is Unknown if the value is absent, or there is not
+// enough history.
+func evaluateBaseline(config *types.BaselineConfig, metric *api.FetchResponse, v float64, t int32, absent bool) (int, *types.BaselineResult) {
+	if absent || metric.StepTime <= 0 || t < metric.StartTime {
+		return types.Unknown, nil
+	}
+	seasonPoints := int(config.Season.Seconds()) / int(metric.StepTime)
+	if seasonPoints < 1 {
+		return types.Unknown, nil
+	}
+	i := int((t - metric.StartTime) / metric.StepTime)
+
+	result := &types.BaselineResult{Method: config.Method}
+	switch config.Method {
+	case types.BaselineHoltWinters:
+		result.Expected, result.Sigma, result.Samples = baselineHoltWinters(config, metric, i, seasonPoints)
+		if result.Samples < seasonPoints {
+			return types.Unknown, nil
+		}
+	default:
+		result.Expected, result.Sigma, result.Samples = baselineMedian(config, metric, i, seasonPoints)
+		if result.Samples < 2 {
+			return types.Unknown, nil
+		}
+	}
+
+	if result.Sigma < config.MinSigma {
+		result.Sigma = config.MinSigma
+	}
+	diff := v - result.Expected
+	switch {
+	case result.Sigma > 0:
+		result.Deviation = diff / result.Sigma
+	case diff > 0:
+		result.Deviation = maxDeviation
+	case diff < 0:
+		result.Deviation = -maxDeviation
+	}
+	result.Deviation = math.Max(-maxDeviation, math.Min(maxDeviation, result.Deviation))
+	result.Lower = result.Expected - config.CriticalSigma*result.Sigma
+	result.Upper = result.Expected + config.CriticalSigma*result.Sigma
+
+	deviation := result.Deviation
+	switch config.Direction {
+	case "up":
+		deviation = math.Max(deviation, 0)
+	case "down":
+		deviation = math.Max(-deviation, 0)
+	default:
+		deviation = math.Abs(deviation)
+	}
+
+	switch {
+	case deviation >= config.CriticalSigma:
+		return types.Critical, result
+	case config.WarningSigma > 0 && deviation >= config.WarningSigma:
+		return types.Warning, result
+	}
+	return types.OK, result
+}
@@ -0,0 +1,137 @@
+package executor
+
+import (
+	api "github.com/openmetric/graphite-api-client"
+	"github.com/openmetric/yamf/internal/types"
+	"math"
+	"testing"
+	"time"
+)
+
+// newTestMetric returns a metric with a point per minute, NaN values are absent.
+func newTestMetric(values ...float64) *api.FetchResponse {
+	metric := &api.FetchResponse{
+		StartTime: 60,
+		StepTime:  60,
+		Values:    make([]float64, len(values)),
+		IsAbsent:  make([]bool, len(values)),
+	}
+	for i, v := range values {
+		if math.IsNaN(v) {
+			metric.IsAbsent[i] = true
+		} else {
+			metric.Values[i] = v
+		}
+	}
+	metric.StopTime = metric.StartTime + int32(len(values))*metric.StepTime
+	return metric
+}
+
+func floatEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestBaselineMedian(t *testing.T) {
+	nan := math.NaN()
+	config := &types.BaselineConfig{Seasons: 3}
+	cases := []struct {
+		values   []float64
+		i        int
+		expected float64
+		sigma    float64
+		samples  int
+	}{
+		// seasons of 2 points, 4, 8 and 6 at the same time of the last 3 seasons
+		{[]float64{4, 0, 8, 0, 6, 0, 100}, 6, 6, 2, 3},
+		{[]float64{4, 0, 8, 0, 7, 0, 100}, 6, 7, math.Sqrt(13.0 / 3), 3},
+		// absent values are skipped, the median of an even number is the mean of the middle two
+		{[]float64{4, 0, nan, 0, 6, 0, 100}, 6, 5, math.Sqrt2, 2},
+		// seasons before the start of the series are absent
+		{[]float64{8, 0, 6, 0, 100}, 4, 7, math.Sqrt2, 2},
+		// less than 2 values is not a baseline
+		{[]float64{nan, 0, nan, 0, 6, 0, 100}, 6, 0, 0, 1},
+	}
+
+	for n, c := range cases {
+		expected, sigma, samples := baselineMedian(config, newTestMetric(c.values...), c.i, 2)
+		if !floatEqual(expected, c.expected) || !floatEqual(sigma, c.sigma) || samples != c.samples {
+			t.Errorf("case %d: got expected %v, sigma %v, samples %d, want %v, %v, %d",
+				n, expected, sigma, samples, c.expected, c.sigma, c.samples)
+		}
+	}
+}
+
+func TestBaselineHoltWinters(t *testing.T) {
+	nan := math.NaN()
+	config := &types.BaselineConfig{Alpha: 0.1, Beta: 0.0035, Gamma: 0.1}
+	metric := newTestMetric(10, 20, 30, 20, 12, 22, 31, 19, 11, nan, 29, 21, 13, 23, 32, 18, 10, 21)
+
+	// predictions[i] and deviations[i-4] of graphite's holtWintersAnalysis of the series
+	// above, with seasonality of 4 points, and graphite's default smoothing factors
+	cases := []struct {
+		i        int
+		expected float64
+		sigma    float64
+	}{
+		{4, 13.63459801792875, 0},
+		{5, 14.383195227258353, 1},
+		{6, 15.969283597325452, 1.8996499999999998},
+		{7, 16.420456991376778, 0.7086701225},
+		{8, 15.914380843962402, 0.16345980179287506},
+		{9, 17.174735461018, 1.6616804772741647},
+		{11, 29.562645176085336, 0.8957574111123223},
+		{12, 27.242941796752195, 0.6385519060098277},
+		{13, 26.399001901890003, 0},
+		// deviation of the point after the missing one is from a prediction of 0
+		{14, 28.83568727165721, 5.79148097624071},
+		{15, 26.455477482322934, 1.662446187609624},
+		{16, 23.627237588547594, 1.9989908950840645},
+		{17, 23.81301161355791, 0.3399001901890003},
+	}
+	for _, c := range cases {
+		expected, sigma, _ := baselineHoltWinters(config, metric, c.i, 4)
+		if !floatEqual(expected, c.expected) || !floatEqual(sigma, c.sigma) {
+			t.Errorf("point %d: got expected %v, sigma %v, want %v, %v", c.i, expected, sigma, c.expected, c.sigma)
+		}
+	}
+
+	// no prediction right after a missing point, or before a season of data
+	for _, i := range []int{3, 10} {
+		if expected, sigma, _ := baselineHoltWinters(config, metric, i, 4); expected != 0 || sigma != 0 {
+			t.Errorf("point %d: got expected %v, sigma %v, want no prediction", i, expected, sigma)
+		}
+	}
+}
+
+func TestEvaluateBaseline(t *testing.T) {
+	config := &types.BaselineConfig{Season: types.FromDuration(2 * time.Minute), Seasons: 3}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// expected 6, sigma 2, critical beyond 3 sigmas
+	metric := newTestMetric(4, 0, 8, 0, 6, 0, 0)
+	last := metric.StartTime + 6*metric.StepTime
+
+	cases := []struct {
+		v         float64
+		direction string
+		status    int
+	}{
+		{6, "", types.OK},
+		{12.5, "", types.Critical},
+		{-0.5, "", types.Critical},
+		{-0.5, "up", types.OK},
+		{12.5, "down", types.OK},
+	}
+	for _, c := range cases {
+		config.Direction = c.direction
+		status, result := evaluateBaseline(config, metric, c.v, last, false)
+		if status != c.status {
+			t.Errorf("value %v, direction %q: status is %d, want %d, result: %+v", c.v, c.direction, status, c.status, result)
+		}
+	}
+
+	if status, _ := evaluateBaseline(config, metric, 6, last, true); status != types.Unknown {
+		t.Errorf("absent value: status is %d, want unknown", status)
+	}
+}
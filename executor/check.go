@@ -0,0 +1,160 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	api "github.com/openmetric/graphite-api-client"
+	"github.com/openmetric/yamf/internal/types"
+	"regexp"
+	"time"
+)
+
+// Execute performs the check carried by task and returns the resulting events.
+// Events are not emitted, it's up to the caller to decide what to do with them.
+func Execute(task *types.Task) ([]*types.Event, error) {
+	return execute(task, nil)
+}
+
+// execute is Execute counting graphite requests in stats, which may be nil.
+func execute(task *types.Task, stats *Stats) ([]*types.Event, error) {
+	switch task.Type {
+	case "graphite":
+		return executeGraphiteCheck(task, stats)
+	case "heartbeat":
+		return executeHeartbeatCheck(task)
+	case "composite":
+		// needs current states, see Executor.doCompositeTask
+		return nil, fmt.Errorf("composite checks are only executed by executors with processor_url")
+	default:
+		return nil, fmt.Errorf("unsupported task type: %s", task.Type)
+	}
+}
+
+// renderGraphite fetches query from graphite, with the task's deadline. Requests and
+// received series are counted in stats, if it's not nil.
+func renderGraphite(task *types.Task, stats *Stats, url, from, until, target string) ([]*api.FetchResponse, error) {
+	query := api.NewRenderQuery(url, from, until, api.NewRenderTarget(target))
+
+	ctx, cancel := context.WithDeadline(context.TODO(), task.Deadline.Time)
+	defer cancel()
+
+	if stats != nil {
+		stats.GraphiteExecutor.APIRequestTotal.Inc()
+	}
+	resp, err := query.Request(ctx)
+	if err != nil {
+		if stats != nil {
+			stats.GraphiteExecutor.APIRequestFailed.Inc()
+		}
+		return nil, fmt.Errorf("request to graphite server failed, url: %s, err: %s", query.URL(), err)
+	}
+	metrics := resp.MultiFetchResponse.Metrics
+	if stats != nil {
+		stats.GraphiteExecutor.MetricsReceived.Add(uint64(len(metrics)))
+	}
+	return metrics, nil
+}
+
+// extractMetadata extracts metadata from metric name with the named capture groups of re.
+func extractMetadata(re *regexp.Regexp, name string, metadata types.Metadata) {
+	matches := re.FindStringSubmatch(name)
+	names := re.SubexpNames()
+	for i, match := range matches {
+		if i != 0 && names[i] != "" {
+			metadata[names[i]] = match
+		}
+	}
+}
+
+// evaluateThresholds returns the status of value by the check's threshold expressions.
+func evaluateThresholds(check *types.GraphiteCheck, value float64, absent bool) int {
+	return evaluateExpressions(&check.CriticalExpression, &check.WarningExpression, value, absent)
+}
+
+// evaluateExpressions returns the status of value by critical and warning expressions,
+// warning is optional.
+func evaluateExpressions(critical, warning *types.ThresholdExpression, value float64, absent bool) int {
+	isCritical, isUnknown := critical.Evaluate(value, absent)
+	if isCritical {
+		return types.Critical
+	}
+
+	if warning != nil {
+		var isWarning bool
+		isWarning, isUnknown = warning.Evaluate(value, absent)
+		if isWarning {
+			return types.Warning
+		}
+	}
+
+	if isUnknown {
+		return types.Unknown
+	}
+	return types.OK
+}
+
+// newGraphiteEvent creates the event of a graphite check result.
+func newGraphiteEvent(task *types.Task, result *types.GraphiteResult) *types.Event {
+	event := &types.Event{
+		Namespace:   task.Namespace,
+		Source:      "rule",
+		Type:        "graphite",
+		Timestamp:   types.FromTime(time.Now()),
+		Status:      result.Status,
+		Description: "",
+		Metadata:    task.Metadata.Copy(),
+		RuleID:      task.RuleID,
+		Result:      result,
+	}
+	event.Metadata.Merge(result.Metadata)
+	event.Identifier, _ = task.EventIdentifierPattern.Parse(event.Metadata)
+	return event
+}
+
+func executeGraphiteCheck(task *types.Task, stats *Stats) ([]*types.Event, error) {
+	var metrics []*api.FetchResponse
+	var err error
+
+	begin := time.Now()
+	check := task.Check.(*types.GraphiteCheck)
+
+	if check.Compare != nil {
+		return executeCompareCheck(task, stats, check, begin)
+	}
+	if len(check.Queries) > 0 {
+		return executeMultiQueryCheck(task, stats, check, begin)
+	}
+
+	from := check.From
+	if check.Baseline != nil {
+		from = baselineFrom(check.Baseline)
+	}
+	if metrics, err = renderGraphite(task, stats, check.GraphiteURL, from, check.Until, check.Query); err != nil {
+		return nil, err
+	}
+
+	events := make([]*types.Event, 0, len(metrics))
+
+	metaExtractRegexp, _ := types.RegexpCompile(check.MetadataExtractPattern)
+	for _, metric := range metrics {
+		result := types.NewGraphiteResult()
+		result.CheckTimestamp = types.FromTime(begin)
+		extractMetadata(metaExtractRegexp, metric.Name, result.Metadata)
+
+		v, t, absent := api.GetLastNonNullValue(metric, check.MaxNullPoints)
+		result.MetricTimestamp = types.FromTime(time.Unix(int64(t), 0))
+		result.MetricValue = v
+		result.MetricValueAbsent = absent
+		result.MetricName = metric.Name
+
+		if check.Baseline != nil {
+			result.Status, result.Baseline = evaluateBaseline(check.Baseline, metric, v, t, absent)
+		} else {
+			result.Status = evaluateThresholds(check, v, absent)
+		}
+
+		events = append(events, newGraphiteEvent(task, result))
+	}
+
+	return events, nil
+}
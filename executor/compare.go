@@ -0,0 +1,156 @@
+package executor
+
+import (
+	api "github.com/openmetric/graphite-api-client"
+	"github.com/openmetric/yamf/internal/types"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compareKey returns the key pairing a series with its shifted ones, false if the series
+// does not have all match keys.
+func compareKey(config *types.CompareConfig, name string, metadata types.Metadata) (string, bool) {
+	if len(config.MatchKeys) == 0 {
+		return name, true
+	}
+	values := make([]string, 0, len(config.MatchKeys))
+	for _, key := range config.MatchKeys {
+		value, ok := metadata.GetString(key)
+		if !ok {
+			return "", false
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, "\x00"), true
+}
+
+// aggregate combines values with one of "avg", "min", "max" and "median".
+func aggregate(method string, values []float64) float64 {
+	switch method {
+	case "min":
+		result := values[0]
+		for _, v := range values[1:] {
+			result = math.Min(result, v)
+		}
+		return result
+	case "max":
+		result := values[0]
+		for _, v := range values[1:] {
+			result = math.Max(result, v)
+		}
+		return result
+	case "median":
+		sorted := append([]float64{}, values...)
+		sort.Float64s(sorted)
+		n := len(sorted)
+		if n%2 == 1 {
+			return sorted[n/2]
+		}
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	default:
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	}
+}
+
+// fetchShifted fetches the check's query with its time range shifted back by shift, and
+// returns the last values by compare key.
+func fetchShifted(task *types.Task, stats *Stats, check *types.GraphiteCheck, re *regexp.Regexp, now time.Time, shift time.Duration) (map[string]float64, []*api.FetchResponse, error) {
+	// validated already
+	fromOffset, _ := types.ParseGraphiteRelativeTime(check.From)
+	untilOffset, _ := types.ParseGraphiteRelativeTime(check.Until)
+	from := strconv.FormatInt(now.Add(fromOffset-shift).Unix(), 10)
+	until := strconv.FormatInt(now.Add(untilOffset-shift).Unix(), 10)
+
+	metrics, err := renderGraphite(task, stats, check.GraphiteURL, from, until, check.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make(map[string]float64)
+	for _, metric := range metrics {
+		metadata := make(types.Metadata)
+		extractMetadata(re, metric.Name, metadata)
+		key, ok := compareKey(check.Compare, metric.Name, metadata)
+		if !ok {
+			continue
+		}
+		if v, _, absent := api.GetLastNonNullValue(metric, check.MaxNullPoints); !absent {
+			values[key] = v
+		}
+	}
+	return values, metrics, nil
+}
+
+// executeCompareCheck evaluates threshold expressions on the ratio or difference between
+// the last value of each series and its values at the same time in the past.
+func executeCompareCheck(task *types.Task, stats *Stats, check *types.GraphiteCheck, begin time.Time) ([]*types.Event, error) {
+	config := check.Compare
+	re, _ := types.RegexpCompile(check.MetadataExtractPattern)
+
+	_, metrics, err := fetchShifted(task, stats, check, re, begin, 0)
+	if err != nil {
+		return nil, err
+	}
+	previous := make([]map[string]float64, len(config.Offsets))
+	for i, offset := range config.Offsets {
+		if previous[i], _, err = fetchShifted(task, stats, check, re, begin, offset.Duration); err != nil {
+			return nil, err
+		}
+	}
+
+	events := make([]*types.Event, 0, len(metrics))
+	for _, metric := range metrics {
+		result := types.NewGraphiteResult()
+		result.CheckTimestamp = types.FromTime(begin)
+		extractMetadata(re, metric.Name, result.Metadata)
+
+		v, t, absent := api.GetLastNonNullValue(metric, check.MaxNullPoints)
+		result.MetricTimestamp = types.FromTime(time.Unix(int64(t), 0))
+		result.MetricValue = v
+		result.MetricValueAbsent = absent
+		result.MetricName = metric.Name
+
+		compare := &types.CompareResult{
+			Mode:           config.Mode,
+			PreviousValues: make(map[string]float64),
+		}
+		var values []float64
+		if key, ok := compareKey(config, metric.Name, result.Metadata); ok {
+			for i, offset := range config.Offsets {
+				if pv, ok := previous[i][key]; ok {
+					compare.PreviousValues[offset.String()] = pv
+					values = append(values, pv)
+				}
+			}
+		}
+
+		compare.PreviousValueAbsent = len(values) == 0
+		if !compare.PreviousValueAbsent {
+			compare.PreviousValue = aggregate(config.Aggregate, values)
+		}
+		compare.DeltaAbsent = absent || compare.PreviousValueAbsent
+		if !compare.DeltaAbsent {
+			if config.Mode == types.CompareDifference {
+				compare.Delta = v - compare.PreviousValue
+			} else if compare.PreviousValue != 0 {
+				compare.Delta = v / compare.PreviousValue
+			} else {
+				compare.DeltaAbsent = true
+			}
+		}
+
+		result.Compare = compare
+		result.Status = evaluateThresholds(check, compare.Delta, compare.DeltaAbsent)
+		events = append(events, newGraphiteEvent(task, result))
+	}
+
+	return events, nil
+}
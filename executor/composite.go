@@ -0,0 +1,109 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// fetchStates fetches current states of all identifiers from processor api.
+func fetchStates(processorURL string, deadline time.Time) ([]*types.State, error) {
+	ctx, cancel := context.WithDeadline(context.TODO(), deadline)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(processorURL, "/")+"/v1/state", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("request to processor failed, err: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("processor responded %s", resp.Status)
+	}
+
+	body := &struct {
+		States []*types.State `json:"states"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(body); err != nil {
+		return nil, fmt.Errorf("failed to decode processor response, err: %s", err)
+	}
+	return body.States, nil
+}
+
+// executeCompositeCheck aggregates states of the composite rule's children into an
+// event. Identifiers of all and failing children are added to metadata as comma
+// separated "children" and "failing_children".
+func executeCompositeCheck(task *types.Task, states []*types.State) []*types.Event {
+	check := task.Check.(*types.CompositeCheck)
+	now := time.Now()
+
+	result := &types.CompositeResult{
+		CheckTimestamp: types.FromTime(now),
+		Aggregation:    check.Aggregation,
+		Children:       make([]types.CompositeChild, 0),
+	}
+	var children, failing []string
+	for _, state := range states {
+		if !check.Selects(task.RuleID, state) {
+			continue
+		}
+		if check.MaxAge.Duration > 0 && now.Sub(state.LastSeen.Time) > check.MaxAge.Duration {
+			continue
+		}
+		child := types.CompositeChild{
+			RuleID:     state.RuleID,
+			Identifier: state.Identifier,
+			Status:     state.Status,
+			Failing:    check.Failing(state.Status),
+		}
+		result.Children = append(result.Children, child)
+		children = append(children, child.Identifier)
+		if child.Failing {
+			failing = append(failing, child.Identifier)
+		}
+	}
+	result.Total, result.Failing = len(children), len(failing)
+
+	result.ValueAbsent = result.Total == 0
+	if !result.ValueAbsent {
+		switch check.Aggregation {
+		case types.CompositeAll:
+			if result.Failing == result.Total {
+				result.Value = 1
+			}
+		case types.CompositeCount:
+			result.Value = float64(result.Failing)
+		case types.CompositePercentage:
+			result.Value = 100 * float64(result.Failing) / float64(result.Total)
+		default:
+			if result.Failing > 0 {
+				result.Value = 1
+			}
+		}
+	}
+
+	result.Status = evaluateExpressions(&check.CriticalExpression, check.WarningExpression, result.Value, result.ValueAbsent)
+
+	event := &types.Event{
+		Namespace:   task.Namespace,
+		Source:      "rule",
+		Type:        "composite",
+		Timestamp:   types.FromTime(now),
+		Status:      result.Status,
+		Description: fmt.Sprintf("%d of %d children failing", result.Failing, result.Total),
+		Metadata:    task.Metadata.Copy(),
+		RuleID:      task.RuleID,
+		Result:      result,
+	}
+	event.Metadata["children"] = strings.Join(children, ",")
+	event.Metadata["failing_children"] = strings.Join(failing, ",")
+	event.Identifier, _ = task.EventIdentifierPattern.Parse(event.Metadata)
+	return []*types.Event{event}
+}
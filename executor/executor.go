@@ -1,11 +1,9 @@
 package executor
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/nsqio/go-nsq"
-	api "github.com/openmetric/graphite-api-client"
 	"github.com/openmetric/graphite-client"
 	"github.com/openmetric/yamf/internal/stats"
 	"github.com/openmetric/yamf/internal/types"
@@ -22,8 +20,31 @@ type Config struct {
 	NSQLookupdHTTPAddr string `yaml:"nsqlookupd_http_address"`
 	NSQTopic           string `yaml:"nsq_topic"`
 	NSQChannel         string `yaml:"nsq_channel"`
+	// topic of silences published by scheduler, empty to disable silences
+	NSQSilenceTopic string `yaml:"nsq_silence_topic"`
+	// what to do with silenced events, "drop" them, or "tag" them with the silence id
+	// and emit as usual
+	SilenceMode string `yaml:"silence_mode"`
+
+	// suppress events while related source events are not OK
+	InhibitRules []*InhibitRule `yaml:"inhibit_rules"`
+	// how long a non-OK source event keeps inhibiting, unless it's refreshed by the
+	// next check of its rule
+	InhibitSourceTTL time.Duration `yaml:"inhibit_source_ttl"`
+	// topic events are emitted to, if set, source events emitted by other executors
+	// inhibit too
+	InhibitStateTopic string `yaml:"inhibit_state_topic"`
+	// what to do with inhibited events, "drop" them, or "tag" them with the source
+	// identifier and emit as usual
+	InhibitMode string `yaml:"inhibit_mode"`
+
+	// processor api, composite rules and absent series are evaluated on current states
+	// read from there, and fail if it's not set
+	ProcessorURL string `yaml:"processor_url"`
 
 	Emit *EmitConfig `yaml:"emit"`
+	// emit events of these namespaces to their own emitters, instead of the default one
+	NamespaceEmit map[string]*EmitConfig `yaml:"namespace_emit"`
 }
 
 func NewConfig() *Config {
@@ -32,6 +53,10 @@ func NewConfig() *Config {
 		NSQLookupdHTTPAddr: "127.0.0.1:4161",
 		NSQTopic:           "yamf_tasks",
 		NSQChannel:         "yamf_task_executor",
+		NSQSilenceTopic:    "yamf_silences",
+		SilenceMode:        "drop",
+		InhibitSourceTTL:   10 * time.Minute,
+		InhibitMode:        "drop",
 		Emit: &EmitConfig{
 			FilterMode: 0,
 			Type:       "file",
@@ -61,7 +86,17 @@ type Executor struct {
 	logger  *zap.SugaredLogger
 	emitter Emitter
 	filter  *eventFilter
-	stats   Stats
+	// emitters of namespaces configured in NamespaceEmit
+	namespaceEmitters map[string]Emitter
+	stats             Stats
+
+	silences        []*types.Silence
+	silencesLock    sync.RWMutex
+	silenceConsumer *nsq.Consumer
+
+	inhibitor       *inhibitor
+	inhibitConsumer *nsq.Consumer
+	inhibitStop     chan struct{}
 
 	workerStops []chan struct{}
 	workerWG    *sync.WaitGroup
@@ -86,10 +121,41 @@ func (e *Executor) Start() error {
 	if e.emitter, err = NewEmitter(e.config.Emit); err != nil {
 		return fmt.Errorf("failed to initialize emitter: %s", err)
 	}
+	e.namespaceEmitters = make(map[string]Emitter)
+	for ns, config := range e.config.NamespaceEmit {
+		if e.namespaceEmitters[ns], err = NewEmitter(config); err != nil {
+			return fmt.Errorf("failed to initialize emitter of namespace %s: %s", ns, err)
+		}
+	}
 	if e.filter, err = NewEventFilter(e.config.Emit.FilterMode); err != nil {
 		return fmt.Errorf("failed to create event filter: %s", err)
 	}
 
+	if e.config.SilenceMode != "drop" && e.config.SilenceMode != "tag" {
+		return fmt.Errorf("unsupported silence mode: %s", e.config.SilenceMode)
+	}
+	if e.config.NSQSilenceTopic != "" {
+		if err = e.startSilenceConsumer(); err != nil {
+			return fmt.Errorf("failed to subscribe to silences: %s", err)
+		}
+	}
+
+	if e.config.InhibitMode != "drop" && e.config.InhibitMode != "tag" {
+		return fmt.Errorf("unsupported inhibit mode: %s", e.config.InhibitMode)
+	}
+	if len(e.config.InhibitRules) > 0 {
+		if e.inhibitor, err = newInhibitor(e.config.InhibitRules, e.config.InhibitSourceTTL); err != nil {
+			return err
+		}
+		e.inhibitStop = make(chan struct{})
+		go e.expireInhibitSources(e.inhibitStop)
+		if e.config.InhibitStateTopic != "" {
+			if err = e.startInhibitStateConsumer(); err != nil {
+				return fmt.Errorf("failed to subscribe to inhibit state topic: %s", err)
+			}
+		}
+	}
+
 	for i := 0; i < e.config.NumWorkers; i++ {
 		stop := make(chan struct{})
 		e.workerStops = append(e.workerStops, stop)
@@ -106,6 +172,18 @@ func (e *Executor) Stop() {
 		close(stop)
 	}
 	e.workerWG.Wait()
+
+	if e.silenceConsumer != nil {
+		e.silenceConsumer.Stop()
+		<-e.silenceConsumer.StopChan
+	}
+	if e.inhibitConsumer != nil {
+		e.inhibitConsumer.Stop()
+		<-e.inhibitConsumer.StopChan
+	}
+	if e.inhibitStop != nil {
+		close(e.inhibitStop)
+	}
 	e.logger.Info("executor stopped.")
 }
 
@@ -161,6 +239,10 @@ func (e *Executor) doTask(message *nsq.Message) error {
 		switch task.Type {
 		case "graphite":
 			e.doGraphiteTask(task)
+		case "heartbeat":
+			e.doHeartbeatTask(task)
+		case "composite":
+			e.doCompositeTask(task)
 		}
 		e.stats.TaskExecuted.Inc()
 	}
@@ -168,85 +250,41 @@ func (e *Executor) doTask(message *nsq.Message) error {
 }
 
 func (e *Executor) doGraphiteTask(task *types.Task) {
-	var query *api.RenderQuery
-	var resp *api.RenderResponse
+	var events []*types.Event
 	var err error
 
 	defer e.stats.GraphiteExecutor.TaskExecuted.Inc()
 
-	begin := time.Now()
-	check := task.Check.(*types.GraphiteCheck)
-	query = api.NewRenderQuery(check.GraphiteURL, check.From, check.Until, api.NewRenderTarget(check.Query))
-
-	e.logger.Debugw("Querying graphite.", "URL", query.URL())
-	ctx, cancel := context.WithDeadline(context.TODO(), task.Deadline.Time)
-	e.stats.GraphiteExecutor.APIRequestTotal.Inc()
-	defer cancel()
-
-	if resp, err = query.Request(ctx); err != nil {
-		e.stats.GraphiteExecutor.APIRequestFailed.Inc()
-		e.logger.Errorw("Request to graphite server failed.", "Error", err)
+	// graphite requests and received series are counted by renderGraphite
+	if events, err = execute(task, &e.stats); err != nil {
+		e.logger.Errorw("Failed to execute graphite check.", "Rule ID", task.RuleID, "Error", err)
 		return
 	}
 
-	metrics := resp.MultiFetchResponse.Metrics
-	e.stats.GraphiteExecutor.MetricsReceived.Add(uint64(len(metrics)))
-	e.logger.Debugw("Got graphite render response.", "N Metrics", len(metrics))
-
-	metaExtractRegexp, _ := types.RegexpCompile(check.MetadataExtractPattern)
-	for _, metric := range metrics {
-		result := types.NewGraphiteResult()
-		result.CheckTimestamp = types.FromTime(begin)
-
-		matches := metaExtractRegexp.FindStringSubmatch(metric.Name)
-		names := metaExtractRegexp.SubexpNames()
-		for i, match := range matches {
-			if i != 0 && names[i] != "" {
-				result.Metadata[names[i]] = match
-			}
-		}
-
-		var isCritical, isWarning, isUnknown bool
-
-		v, t, absent := api.GetLastNonNullValue(metric, check.MaxNullPoints)
-		result.MetricTimestamp = types.FromTime(time.Unix(int64(t), 0))
-		result.MetricValue = v
-		result.MetricValueAbsent = absent
-		result.MetricName = metric.Name
-
-		isCritical, isUnknown = check.CriticalExpression.Evaluate(v, absent)
-		if isCritical {
-			result.Status = types.Critical
-			goto EMIT
-		}
-
-		isWarning, isUnknown = check.WarningExpression.Evaluate(v, absent)
-		if isWarning {
-			result.Status = types.Warning
-			goto EMIT
-		}
+	e.logger.Debugw("Executed graphite check.", "N Events", len(events))
 
-		if isUnknown {
-			result.Status = types.Unknown
+	check := task.Check.(*types.GraphiteCheck)
+	now := time.Now()
+	count := len(events)
+	if check.Absent != nil {
+		// series seen before are the rule's states in processor, shared by all executors
+		if e.config.ProcessorURL == "" {
+			e.logger.Errorw("Absent series can not be checked without processor_url.", "Rule ID", task.RuleID)
+		} else if states, err := fetchStates(e.config.ProcessorURL, task.Deadline.Time); err != nil {
+			e.stats.GraphiteExecutor.SeriesStateFailed.Inc()
+			e.logger.Errorw("Failed to fetch states for absent series.", "Rule ID", task.RuleID, "Error", err)
 		} else {
-			result.Status = types.OK
+			absent := absentEvents(task, check.Absent, events, states, now)
+			e.stats.GraphiteExecutor.SeriesAbsent.Add(uint64(len(absent)))
+			events = append(events, absent...)
 		}
+	}
+	if check.SeriesCount != nil {
+		events = append(events, seriesCountEvent(task, check.SeriesCount, count, now))
+	}
 
-	EMIT:
-		event := &types.Event{
-			Source:      "rule",
-			Type:        "graphite",
-			Timestamp:   types.FromTime(time.Now()),
-			Status:      result.Status,
-			Description: "",
-			Metadata:    task.Metadata.Copy(),
-			RuleID:      task.RuleID,
-			Result:      result,
-		}
-		event.Metadata.Merge(result.Metadata)
-		event.Identifier, _ = task.EventIdentifierPattern.Parse(event.Metadata)
-
-		switch result.Status {
+	for _, event := range events {
+		switch event.Status {
 		case types.OK:
 			e.stats.GraphiteExecutor.EventOK.Inc()
 		case types.Warning:
@@ -262,6 +300,38 @@ func (e *Executor) doGraphiteTask(task *types.Task) {
 	}
 }
 
+func (e *Executor) doHeartbeatTask(task *types.Task) {
+	events, err := Execute(task)
+	if err != nil {
+		e.logger.Errorw("Failed to execute heartbeat check.", "Rule ID", task.RuleID, "Error", err)
+		return
+	}
+
+	for _, event := range events {
+		if event.Status == types.Critical {
+			e.stats.HeartbeatMissed.Inc()
+		}
+		e.emitEvent(event)
+	}
+}
+
+func (e *Executor) doCompositeTask(task *types.Task) {
+	if e.config.ProcessorURL == "" {
+		e.logger.Errorw("Composite rule can not be executed without processor_url.", "Rule ID", task.RuleID)
+		return
+	}
+	states, err := fetchStates(e.config.ProcessorURL, task.Deadline.Time)
+	if err != nil {
+		e.stats.CompositeStateFailed.Inc()
+		e.logger.Errorw("Failed to fetch states for composite rule.", "Rule ID", task.RuleID, "Error", err)
+		return
+	}
+
+	for _, event := range executeCompositeCheck(task, states) {
+		e.emitEvent(event)
+	}
+}
+
 func (e *Executor) emitEvent(event *types.Event) {
 	switch event.Status {
 	case types.OK:
@@ -273,10 +343,38 @@ func (e *Executor) emitEvent(event *types.Event) {
 	case types.Unknown:
 		e.stats.EventUnknown.Inc()
 	}
+
+	if e.inhibitor != nil {
+		e.inhibitor.observe(event)
+	}
+
+	if silence := e.silencedBy(event); silence != nil {
+		e.stats.EventSilenced.Inc()
+		if e.config.SilenceMode == "drop" {
+			return
+		}
+		event.SilencedBy = silence.ID
+	}
+
+	if e.inhibitor != nil {
+		if source := e.inhibitor.inhibitedBy(event); source != "" {
+			e.stats.EventInhibited.Inc()
+			if e.config.InhibitMode == "drop" {
+				return
+			}
+			event.InhibitedBy = source
+		}
+	}
+
 	e.stats.EventEmitted.Inc()
-	if e.emitter != nil {
+
+	emitter := e.emitter
+	if ne, ok := e.namespaceEmitters[event.Namespace]; ok {
+		emitter = ne
+	}
+	if emitter != nil {
 		if e.filter.ShouldEmit(event) {
-			e.emitter.Emit(event)
+			emitter.Emit(event)
 		}
 	}
 }
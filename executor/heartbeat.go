@@ -0,0 +1,47 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	"time"
+)
+
+// executeHeartbeatCheck checks whether the last ping of a heartbeat rule is recent enough.
+// Status is Unknown if the task does not carry the last ping time, e.g. when testing an
+// unsaved rule.
+func executeHeartbeatCheck(task *types.Task) ([]*types.Event, error) {
+	check := task.Check.(*types.HeartbeatCheck)
+	now := time.Now()
+
+	result := &types.HeartbeatResult{
+		CheckTimestamp: types.FromTime(now),
+		LastSeen:       check.LastSeen,
+		Period:         check.Period,
+	}
+	var description string
+	switch {
+	case check.LastSeen == nil:
+		result.Status = types.Unknown
+		description = "last heartbeat is unknown"
+	case now.Sub(check.LastSeen.Time) > check.Period.Duration+check.Grace.Duration:
+		result.Status = types.Critical
+		result.Overdue = types.FromDuration((now.Sub(check.LastSeen.Time) - check.Period.Duration).Truncate(time.Second))
+		description = fmt.Sprintf("no heartbeat since %s, expected every %s", check.LastSeen.Format(time.RFC3339), check.Period)
+	default:
+		result.Status = types.OK
+	}
+
+	event := &types.Event{
+		Namespace:   task.Namespace,
+		Source:      "rule",
+		Type:        "heartbeat",
+		Timestamp:   types.FromTime(now),
+		Status:      result.Status,
+		Description: description,
+		Metadata:    task.Metadata.Copy(),
+		RuleID:      task.RuleID,
+		Result:      result,
+	}
+	event.Identifier, _ = task.EventIdentifierPattern.Parse(event.Metadata)
+	return []*types.Event{event}, nil
+}
@@ -0,0 +1,198 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nsqio/go-nsq"
+	"github.com/openmetric/yamf/internal/types"
+	"os"
+	"sync"
+	"time"
+)
+
+// InhibitRule suppresses target events while a source event is not OK, e.g. service
+// checks of a host while the host is down. Source and target are related if they have
+// the same values for all metadata keys in Equal.
+type InhibitRule struct {
+	SourceMatchers []types.EventMatcher `yaml:"source_matchers"`
+	TargetMatchers []types.EventMatcher `yaml:"target_matchers"`
+	Equal          []string             `yaml:"equal"`
+}
+
+func (r *InhibitRule) Validate() error {
+	if len(r.SourceMatchers) == 0 || len(r.TargetMatchers) == 0 {
+		return fmt.Errorf("both source_matchers and target_matchers are required")
+	}
+	for _, matchers := range [][]types.EventMatcher{r.SourceMatchers, r.TargetMatchers} {
+		for i := range matchers {
+			if err := matchers[i].Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// related tells whether source and target have equal values of r.Equal keys, keys
+// missing in either of them never match.
+func (r *InhibitRule) related(source, target types.Metadata) bool {
+	for _, key := range r.Equal {
+		sv, ok := source.GetString(key)
+		if !ok {
+			return false
+		}
+		if tv, ok := target.GetString(key); !ok || sv != tv {
+			return false
+		}
+	}
+	return true
+}
+
+type inhibitSource struct {
+	metadata types.Metadata
+	expires  time.Time
+}
+
+// inhibitor tracks current state of source events across all rules, and tells which
+// events are inhibited.
+type inhibitor struct {
+	rules []*InhibitRule
+	ttl   time.Duration
+	// non-OK source events of each inhibit rule, by event identifier
+	sources []map[string]*inhibitSource
+
+	sync.RWMutex
+}
+
+func newInhibitor(rules []*InhibitRule, ttl time.Duration) (*inhibitor, error) {
+	in := &inhibitor{
+		rules:   rules,
+		ttl:     ttl,
+		sources: make([]map[string]*inhibitSource, len(rules)),
+	}
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid inhibit rule %d: %s", i, err)
+		}
+		in.sources[i] = make(map[string]*inhibitSource)
+	}
+	return in, nil
+}
+
+// observe records the current state of event, if it's a source of any inhibit rule.
+func (in *inhibitor) observe(event *types.Event) {
+	in.Lock()
+	defer in.Unlock()
+
+	for i, rule := range in.rules {
+		if !types.MatchAll(rule.SourceMatchers, event) {
+			continue
+		}
+		if event.Status == types.OK {
+			delete(in.sources[i], event.Identifier)
+		} else {
+			in.sources[i][event.Identifier] = &inhibitSource{
+				metadata: event.Metadata,
+				expires:  time.Now().Add(in.ttl),
+			}
+		}
+	}
+}
+
+// inhibitedBy returns identifier of the source event inhibiting event, empty if event is
+// not inhibited. OK events are never inhibited, so that recoveries get through.
+func (in *inhibitor) inhibitedBy(event *types.Event) string {
+	if event.Status == types.OK {
+		return ""
+	}
+
+	now := time.Now()
+	in.RLock()
+	defer in.RUnlock()
+
+	for i, rule := range in.rules {
+		if len(in.sources[i]) == 0 || !types.MatchAll(rule.TargetMatchers, event) {
+			continue
+		}
+		for identifier, source := range in.sources[i] {
+			// an event never inhibits itself
+			if identifier != event.Identifier && now.Before(source.expires) && rule.related(source.metadata, event.Metadata) {
+				return identifier
+			}
+		}
+	}
+	return ""
+}
+
+// expire removes source events which have not been refreshed within ttl.
+func (in *inhibitor) expire() {
+	now := time.Now()
+	in.Lock()
+	defer in.Unlock()
+
+	for _, sources := range in.sources {
+		for identifier, source := range sources {
+			if !now.Before(source.expires) {
+				delete(sources, identifier)
+			}
+		}
+	}
+}
+
+// startInhibitStateConsumer subscribes to events emitted by all executors, so that
+// sources evaluated by other executors inhibit targets evaluated by this one.
+func (e *Executor) startInhibitStateConsumer() error {
+	consumer, err := nsq.NewConsumer(e.config.InhibitStateTopic, ephemeralChannel("inhibit"), nsq.NewConfig())
+	if err != nil {
+		return err
+	}
+	consumer.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
+		// only the fields needed for inhibition, result is type specific
+		var data struct {
+			Namespace  string         `json:"namespace"`
+			Status     int            `json:"status"`
+			Identifier string         `json:"identifier"`
+			Metadata   types.Metadata `json:"metadata"`
+			RuleID     int            `json:"rule_id"`
+		}
+		if err := json.Unmarshal(message.Body, &data); err != nil {
+			e.logger.Errorw("Failed to decode event from message.", "Error", err)
+			return nil
+		}
+		e.inhibitor.observe(&types.Event{
+			Namespace:  data.Namespace,
+			Status:     data.Status,
+			Identifier: data.Identifier,
+			Metadata:   data.Metadata,
+			RuleID:     data.RuleID,
+		})
+		return nil
+	}))
+	if err = consumer.ConnectToNSQLookupd(e.config.NSQLookupdHTTPAddr); err != nil {
+		return err
+	}
+	e.inhibitConsumer = consumer
+	return nil
+}
+
+// expireInhibitSources expires stale source events periodically, until stop is closed.
+func (e *Executor) expireInhibitSources(stop chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.inhibitor.expire()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ephemeralChannel returns a nsq channel name unique to this process, for topics of
+// which every executor needs all messages.
+func ephemeralChannel(purpose string) string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("executor-%s-%s-%d#ephemeral", purpose, hostname, os.Getpid())
+}
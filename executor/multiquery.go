@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"fmt"
+	api "github.com/openmetric/graphite-api-client"
+	"github.com/openmetric/yamf/internal/types"
+	"strings"
+	"time"
+)
+
+// querySeries is the last value of a series of a named query.
+type querySeries struct {
+	name      string
+	value     float64
+	timestamp int32
+	absent    bool
+	metadata  types.Metadata
+}
+
+// joinKey returns the key joining series of different queries, false if the series does
+// not have all join keys.
+func joinKey(keys []string, metadata types.Metadata) (string, bool) {
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value, ok := metadata.GetString(key)
+		if !ok {
+			return "", false
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, "\x00"), true
+}
+
+// executeMultiQueryCheck fetches each named query, joins their series on the join keys,
+// and evaluates threshold expressions on the combined value of each joined group.
+func executeMultiQueryCheck(task *types.Task, stats *Stats, check *types.GraphiteCheck, begin time.Time) ([]*types.Event, error) {
+	// keys in the order first seen, so events are stable across executions
+	var keys []string
+	if len(check.JoinKeys) == 0 {
+		keys = append(keys, "")
+	}
+	series := make(map[string]map[string]*querySeries)
+
+	for _, q := range check.Queries {
+		metrics, err := renderGraphite(task, stats, q.GraphiteURL, q.From, q.Until, q.Query)
+		if err != nil {
+			return nil, err
+		}
+		if len(check.JoinKeys) == 0 && len(metrics) > 1 {
+			return nil, fmt.Errorf("query %s returned %d series, `join_keys` is required to join them", q.Name, len(metrics))
+		}
+
+		re, _ := types.RegexpCompile(q.MetadataExtractPattern)
+		for _, metric := range metrics {
+			s := &querySeries{name: metric.Name, metadata: make(types.Metadata)}
+			extractMetadata(re, metric.Name, s.metadata)
+			key, ok := joinKey(check.JoinKeys, s.metadata)
+			if !ok {
+				continue
+			}
+			s.value, s.timestamp, s.absent = api.GetLastNonNullValue(metric, check.MaxNullPoints)
+
+			if _, ok := series[key]; !ok {
+				if len(check.JoinKeys) > 0 {
+					keys = append(keys, key)
+				}
+				series[key] = make(map[string]*querySeries)
+			}
+			series[key][q.Name] = s
+		}
+	}
+
+	events := make([]*types.Event, 0, len(keys))
+	for _, key := range keys {
+		result := types.NewGraphiteResult()
+		result.CheckTimestamp = types.FromTime(begin)
+		result.MetricName = check.Expression.String()
+		result.QueryValues = make(map[string]float64)
+		result.QueryMetrics = make(map[string]string)
+
+		var timestamp int32
+		for _, q := range check.Queries {
+			s, ok := series[key][q.Name]
+			if !ok {
+				continue
+			}
+			result.Metadata.Merge(s.metadata)
+			result.QueryMetrics[q.Name] = s.name
+			if !s.absent {
+				result.QueryValues[q.Name] = s.value
+				if s.timestamp > timestamp {
+					timestamp = s.timestamp
+				}
+			}
+		}
+
+		v, absent := check.Expression.Evaluate(result.QueryValues)
+		result.MetricTimestamp = types.FromTime(time.Unix(int64(timestamp), 0))
+		result.MetricValue = v
+		result.MetricValueAbsent = absent
+		result.Status = evaluateThresholds(check, v, absent)
+
+		events = append(events, newGraphiteEvent(task, result))
+	}
+
+	return events, nil
+}
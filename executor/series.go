@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	"sort"
+	"time"
+)
+
+// absentSinceKey is the metadata key of absent events telling when the series was last
+// returned, the state's last seen time is refreshed by the absent events themselves.
+const absentSinceKey = "absent_since"
+
+// absentEvents returns events of the rule's series known by the processor, which are
+// missing from events for longer than the grace period. Series missing longer than the
+// forget period are no longer reported.
+func absentEvents(task *types.Task, config *types.AbsentConfig, events []*types.Event, states []*types.State, now time.Time) []*types.Event {
+	seen := make(map[string]bool)
+	for _, event := range events {
+		seen[event.Identifier] = true
+	}
+	check := task.Check.(*types.GraphiteCheck)
+	if check.SeriesCount != nil {
+		seen[seriesCountIdentifier(task, check.SeriesCount)] = true
+	}
+
+	var missing []*types.State
+	for _, state := range states {
+		if state.RuleID != task.RuleID || seen[state.Identifier] {
+			continue
+		}
+		missing = append(missing, state)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Identifier < missing[j].Identifier })
+
+	absent := make([]*types.Event, 0)
+	for _, state := range missing {
+		lastSeen := state.LastSeen.Time
+		if since, ok := state.Metadata.GetString(absentSinceKey); ok {
+			if t, err := time.Parse(time.RFC3339, since); err == nil {
+				lastSeen = t
+			}
+		}
+		if d := now.Sub(lastSeen); d < config.GracePeriod.Duration || d >= config.Forget.Duration {
+			continue
+		}
+
+		result := types.NewGraphiteResult()
+		result.Status = config.StatusCode()
+		result.CheckTimestamp = types.FromTime(now)
+		result.MetricTimestamp = types.FromTime(lastSeen)
+		result.MetricValueAbsent = true
+		result.Metadata = state.Metadata.Copy()
+		result.Metadata[absentSinceKey] = lastSeen.Format(time.RFC3339)
+
+		event := newGraphiteEvent(task, result)
+		event.Identifier = state.Identifier
+		event.Description = fmt.Sprintf("series absent since %s", lastSeen.Format(time.RFC3339))
+		absent = append(absent, event)
+	}
+	return absent
+}
+
+// seriesCountEvent returns the event of the number of series returned by task.
+func seriesCountEvent(task *types.Task, config *types.SeriesCountConfig, count int, now time.Time) *types.Event {
+	result := types.NewGraphiteResult()
+	result.CheckTimestamp = types.FromTime(now)
+	result.MetricName = "series_count"
+	result.MetricTimestamp = types.FromTime(now)
+	result.MetricValue = float64(count)
+	result.Status = evaluateExpressions(&config.CriticalExpression, &config.WarningExpression, result.MetricValue, false)
+
+	event := newGraphiteEvent(task, result)
+	event.Identifier = seriesCountIdentifier(task, config)
+	event.Description = fmt.Sprintf("%d series returned", count)
+	return event
+}
+
+func seriesCountIdentifier(task *types.Task, config *types.SeriesCountConfig) string {
+	if config.Identifier != "" {
+		return config.Identifier
+	}
+	return fmt.Sprintf("rule-%d-series-count", task.RuleID)
+}
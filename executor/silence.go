@@ -0,0 +1,51 @@
+package executor
+
+import (
+	"encoding/json"
+	"github.com/nsqio/go-nsq"
+	"github.com/openmetric/yamf/internal/types"
+	"time"
+)
+
+// startSilenceConsumer subscribes to silences published by scheduler. Every executor
+// needs all silences, so each one uses its own ephemeral channel.
+func (e *Executor) startSilenceConsumer() error {
+	consumer, err := nsq.NewConsumer(e.config.NSQSilenceTopic, ephemeralChannel("silence"), nsq.NewConfig())
+	if err != nil {
+		return err
+	}
+	consumer.AddHandler(nsq.HandlerFunc(e.updateSilences))
+	if err = consumer.ConnectToNSQLookupd(e.config.NSQLookupdHTTPAddr); err != nil {
+		return err
+	}
+	e.silenceConsumer = consumer
+	return nil
+}
+
+// updateSilences replaces current silences with the published list.
+func (e *Executor) updateSilences(message *nsq.Message) error {
+	var silences []*types.Silence
+	if err := json.Unmarshal(message.Body, &silences); err != nil {
+		e.logger.Errorw("Failed to decode silences from message.", "Error", err)
+		return nil
+	}
+
+	e.silencesLock.Lock()
+	defer e.silencesLock.Unlock()
+	e.silences = silences
+	return nil
+}
+
+// silencedBy returns the active silence matching event, nil if event is not silenced.
+func (e *Executor) silencedBy(event *types.Event) *types.Silence {
+	now := time.Now()
+	e.silencesLock.RLock()
+	defer e.silencesLock.RUnlock()
+
+	for _, silence := range e.silences {
+		if silence.Active(now) && silence.Matches(event) {
+			return silence
+		}
+	}
+	return nil
+}
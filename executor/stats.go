@@ -9,18 +9,31 @@ type Stats struct {
 	TaskExecuted stats.Counter `stats:"TaskExecuted"`
 	TaskExpired  stats.Counter `stats:"TaskExpired"`
 	EventEmitted stats.Counter `stats:"EventEmitted"`
+	// events dropped or tagged because of a silence
+	EventSilenced stats.Counter `stats:"EventSilenced"`
+	// events dropped or tagged because of an inhibit rule
+	EventInhibited stats.Counter `stats:"EventInhibited"`
 
 	EventOK       stats.Counter `stats:"EventOK"`
 	EventWarning  stats.Counter `stats:"EventWarning"`
 	EventCritical stats.Counter `stats:"EventCritical"`
 	EventUnknown  stats.Counter `stats:"EventUnknown"`
 
+	// heartbeat checks found overdue
+	HeartbeatMissed stats.Counter `stats:"HeartbeatMissed"`
+	// composite tasks failed to fetch states from processor
+	CompositeStateFailed stats.Counter `stats:"CompositeStateFailed"`
+
 	GraphiteExecutor struct {
 		TaskExecuted     stats.Counter `stats:"TaskExecuted"`
 		EventEmitted     stats.Counter `stats:"EventEmitted"`
 		APIRequestTotal  stats.Counter `stats:"APIRequestTotal"`
 		APIRequestFailed stats.Counter `stats:"APIRequestFailed"`
 		MetricsReceived  stats.Counter `stats:"MetricsReceived"`
+		// events of series missing from responses
+		SeriesAbsent stats.Counter `stats:"SeriesAbsent"`
+		// failures to fetch states of seen series from processor
+		SeriesStateFailed stats.Counter `stats:"SeriesStateFailed"`
 
 		EventOK       stats.Counter `stats:"EventOK"`
 		EventWarning  stats.Counter `stats:"EventWarning"`
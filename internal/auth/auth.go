@@ -0,0 +1,212 @@
+// Package auth authenticates api requests of scheduler and processor, and checks roles
+// and scopes of api users.
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	"github.com/openmetric/yamf/internal/utils"
+	"go.uber.org/zap"
+	"gopkg.in/gin-gonic/gin.v1"
+	"strings"
+)
+
+// api user roles, each role has all permissions of the roles before it
+const (
+	RoleReadOnly = "read-only"
+	RoleEditor   = "editor"
+	RoleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleReadOnly: 1,
+	RoleEditor:   2,
+	RoleAdmin:    3,
+}
+
+type Config struct {
+	// if not enabled, all requests are treated as made by an admin
+	Enabled bool    `yaml:"enabled"`
+	Users   []*User `yaml:"users"`
+	// yaml file with a list of users, in the same form of `users`
+	UsersFile string `yaml:"users_file"`
+}
+
+// User is an api user, who authenticates with either a bearer token, or basic auth
+// using Name and Password.
+type User struct {
+	Name     string `yaml:"name"`
+	Token    string `yaml:"token"`
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"`
+	// label selector, editors can only modify rules matching it. Empty means all rules.
+	Scope string `yaml:"scope"`
+
+	scope types.LabelSelector
+}
+
+// anonymous user used when auth is not enabled
+var anonymousUser = &User{Name: "anonymous", Role: RoleAdmin}
+
+// loadUsers validates configured users, and loads users from UsersFile.
+func (c *Config) loadUsers() ([]*User, error) {
+	users := append([]*User{}, c.Users...)
+	if c.UsersFile != "" {
+		var fileUsers []*User
+		if err := utils.UnmarshalYAMLFile(c.UsersFile, &fileUsers); err != nil {
+			return nil, fmt.Errorf("failed to load users file: %s", err)
+		}
+		users = append(users, fileUsers...)
+	}
+
+	names := make(map[string]bool)
+	for _, user := range users {
+		var err error
+		if user.Name == "" {
+			return nil, fmt.Errorf("user without a name")
+		}
+		if names[user.Name] {
+			return nil, fmt.Errorf("duplicate user: %s", user.Name)
+		}
+		names[user.Name] = true
+		if user.Token == "" && user.Password == "" {
+			return nil, fmt.Errorf("user %s has neither token nor password", user.Name)
+		}
+		if _, ok := roleRanks[user.Role]; !ok {
+			return nil, fmt.Errorf("user %s has invalid role: %s", user.Name, user.Role)
+		}
+		if user.scope, err = types.ParseLabelSelector(user.Scope); err != nil {
+			return nil, fmt.Errorf("user %s has invalid scope: %s", user.Name, err)
+		}
+	}
+	return users, nil
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Authenticator authenticates api requests and checks roles of users.
+type Authenticator struct {
+	config *Config
+	users  []*User
+	logger *zap.SugaredLogger
+	// writes failure responses in the format of the api
+	writeFail func(c *gin.Context, code int, messageFmt string, v ...interface{})
+}
+
+// NewAuthenticator loads users of config. writeFail writes failure responses in the
+// format of the api using the authenticator.
+func NewAuthenticator(config *Config, logger *zap.SugaredLogger, writeFail func(c *gin.Context, code int, messageFmt string, v ...interface{})) (*Authenticator, error) {
+	a := &Authenticator{
+		config:    config,
+		logger:    logger,
+		writeFail: writeFail,
+	}
+	if config.Enabled {
+		var err error
+		if a.users, err = config.loadUsers(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// authenticate finds the user making the request, returns nil if credentials are
+// missing or wrong.
+func (a *Authenticator) authenticate(c *gin.Context) *User {
+	header := c.Request.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		for _, user := range a.users {
+			if user.Token != "" && secureEqual(user.Token, token) {
+				return user
+			}
+		}
+		return nil
+	}
+
+	if name, password, ok := c.Request.BasicAuth(); ok {
+		for _, user := range a.users {
+			if user.Name == name && user.Password != "" && secureEqual(user.Password, password) {
+				return user
+			}
+		}
+	}
+	return nil
+}
+
+// LogDenied logs a denied request, user is nil if the request was not authenticated.
+func (a *Authenticator) LogDenied(c *gin.Context, user *User, reason string) {
+	name, role := "", ""
+	if user != nil {
+		name, role = user.Name, user.Role
+	}
+	a.logger.Warnw("API request denied.",
+		"User", name,
+		"Role", role,
+		"Method", c.Request.Method,
+		"Path", c.Request.URL.Path,
+		"Remote Address", c.ClientIP(),
+		"Reason", reason,
+	)
+}
+
+// Authenticate is a middleware which identifies the user making the request.
+func (a *Authenticator) Authenticate(c *gin.Context) {
+	if !a.config.Enabled {
+		c.Set("user", anonymousUser)
+		c.Next()
+		return
+	}
+
+	user := a.authenticate(c)
+	if user == nil {
+		a.LogDenied(c, nil, "authentication failed")
+		c.Header("WWW-Authenticate", `Bearer realm="yamf", Basic realm="yamf"`)
+		a.writeFail(c, 401, "Authentication required")
+		c.Abort()
+		return
+	}
+
+	c.Set("user", user)
+	c.Next()
+}
+
+// RequireRole returns a middleware which rejects users without the role.
+func (a *Authenticator) RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := APIUser(c)
+		if roleRanks[user.Role] < roleRanks[role] {
+			a.LogDenied(c, user, "requires role "+role)
+			a.writeFail(c, 403, "Permission denied, requires role: %s", role)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// CanModify tells whether the rule is in scope of the user.
+func (u *User) CanModify(rule *types.Rule) bool {
+	return u.Role == RoleAdmin || u.scope.Matches(rule.Labels)
+}
+
+// Scoped tells whether the user is limited to rules matching a scope.
+func (u *User) Scoped() bool {
+	return u.Role != RoleAdmin && len(u.scope) > 0
+}
+
+// ScopeSelector returns the parsed scope of the user.
+func (u *User) ScopeSelector() types.LabelSelector {
+	return u.scope
+}
+
+// APIUser returns the authenticated user of the request.
+func APIUser(c *gin.Context) *User {
+	if user, ok := c.Get("user"); ok {
+		return user.(*User)
+	}
+	return anonymousUser
+}
@@ -0,0 +1,536 @@
+// Package eventdb stores the history of events in bbolt files, one file per day. Events
+// are indexed by identifier, rule id, status and metadata, and old days are dropped
+// according to retention.
+package eventdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// events are partitioned by utc day
+const (
+	partitionDuration = 24 * time.Hour
+	partitionFormat   = "20060102"
+	partitionPrefix   = "events-"
+	partitionSuffix   = ".db"
+)
+
+// pending events are written once there are this many of them, or on Flush
+const flushSize = 1000
+
+// MaxBuckets is the max number of buckets a count query can return.
+const MaxBuckets = 10000
+
+var (
+	eventsBucket   = []byte("events")
+	identBucket    = []byte("idx_identifier")
+	ruleBucket     = []byte("idx_rule")
+	statusBucket   = []byte("idx_status")
+	metadataBucket = []byte("idx_metadata")
+)
+
+// Query selects events in [From, To), all filters must match.
+type Query struct {
+	From time.Time
+	To   time.Time
+
+	Identifier string
+	RuleID     int
+	// only events with one of these statuses, empty for any status
+	Statuses []int
+	// metadata values, compared as strings
+	Metadata map[string]string
+
+	// newest events first
+	Descending bool
+	// max number of events to return, 0 for no limit
+	Limit int
+}
+
+func (q *Query) Validate() error {
+	if q.From.IsZero() || q.To.IsZero() {
+		return fmt.Errorf("time range is required")
+	}
+	if !q.From.Before(q.To) {
+		return fmt.Errorf("from must be before to")
+	}
+	return nil
+}
+
+// Matches tells whether event satisfies the filters of q, time range is not checked.
+func (q *Query) Matches(event *types.Event) bool {
+	if q.Identifier != "" && event.Identifier != q.Identifier {
+		return false
+	}
+	if q.RuleID != 0 && event.RuleID != q.RuleID {
+		return false
+	}
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, status := range q.Statuses {
+			found = found || status == event.Status
+		}
+		if !found {
+			return false
+		}
+	}
+	for key, value := range q.Metadata {
+		if v, ok := event.Metadata.GetString(key); !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Bucket is the number of events in [Start, Start+interval), by status.
+type Bucket struct {
+	Start    types.Time `json:"start"`
+	Total    int        `json:"total"`
+	OK       int        `json:"ok"`
+	Warning  int        `json:"warning"`
+	Critical int        `json:"critical"`
+	Unknown  int        `json:"unknown"`
+}
+
+// Store is the event history, events added are buffered in memory until Flush, or until
+// there are flushSize of them.
+type Store struct {
+	dir       string
+	retention time.Duration
+
+	partitions map[string]*bolt.DB
+	lock       sync.RWMutex
+
+	pending     []*types.Event
+	pendingLock sync.Mutex
+}
+
+// Open opens the event history in dir, events older than retention are dropped by
+// Expire, 0 to keep them forever.
+func Open(dir string, retention time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:        dir,
+		retention:  retention,
+		partitions: make(map[string]*bolt.DB),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, partitionPrefix) || !strings.HasSuffix(name, partitionSuffix) {
+			continue
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(name, partitionPrefix), partitionSuffix)
+		if _, err := time.Parse(partitionFormat, day); err != nil {
+			continue
+		}
+		if _, err := s.partition(day, false); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to open partition %s: %s", name, err)
+		}
+	}
+	return s, nil
+}
+
+// partition returns the db of day, which is created if create is true, nil if it does
+// not exist.
+func (s *Store) partition(day string, create bool) (*bolt.DB, error) {
+	s.lock.RLock()
+	db, ok := s.partitions[day]
+	s.lock.RUnlock()
+	if ok {
+		return db, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if db, ok = s.partitions[day]; ok {
+		return db, nil
+	}
+
+	path := filepath.Join(s.dir, partitionPrefix+day+partitionSuffix)
+	if _, err := os.Stat(path); os.IsNotExist(err) && !create {
+		return nil, nil
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{eventsBucket, identBucket, ruleBucket, statusBucket, metadataBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.partitions[day] = db
+	return db, nil
+}
+
+// days returns the partition names covering [from, to), in ascending order.
+func days(from, to time.Time) []string {
+	var result []string
+	for t := from.UTC().Truncate(partitionDuration); t.Before(to); t = t.Add(partitionDuration) {
+		result = append(result, t.Format(partitionFormat))
+	}
+	return result
+}
+
+// timeKey encodes t so that keys are sorted by time.
+func timeKey(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+// eventKey is the event time followed by a sequence number, unique in a partition.
+func eventKey(t time.Time, seq uint64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], seq)
+	return b
+}
+
+func identifierPrefix(identifier string) []byte {
+	return append([]byte(identifier), 0)
+}
+
+func rulePrefix(ruleID int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(ruleID))
+	return b
+}
+
+func statusPrefix(status int) []byte {
+	return []byte{byte(status)}
+}
+
+func metadataPrefix(key, value string) []byte {
+	b := append([]byte(key), 0)
+	b = append(b, value...)
+	return append(b, 0)
+}
+
+// Add buffers an event to be written, the buffer is written if it's full.
+func (s *Store) Add(event *types.Event) error {
+	s.pendingLock.Lock()
+	s.pending = append(s.pending, event)
+	full := len(s.pending) >= flushSize
+	s.pendingLock.Unlock()
+
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush writes buffered events, one transaction per partition. Events of partitions
+// failed to write are buffered again, to be retried by the next Flush.
+func (s *Store) Flush() error {
+	s.pendingLock.Lock()
+	events := s.pending
+	s.pending = nil
+	s.pendingLock.Unlock()
+
+	byDay := make(map[string][]*types.Event)
+	for _, event := range events {
+		day := event.Timestamp.UTC().Format(partitionFormat)
+		byDay[day] = append(byDay[day], event)
+	}
+
+	var unwritten []*types.Event
+	var firstErr error
+	for day, events := range byDay {
+		db, err := s.partition(day, true)
+		if err == nil {
+			err = db.Update(func(tx *bolt.Tx) error { return writeEvents(tx, events) })
+		}
+		if err != nil {
+			unwritten = append(unwritten, events...)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if len(unwritten) > 0 {
+		s.pendingLock.Lock()
+		s.pending = append(unwritten, s.pending...)
+		s.pendingLock.Unlock()
+	}
+	return firstErr
+}
+
+func writeEvents(tx *bolt.Tx, events []*types.Event) error {
+	eb := tx.Bucket(eventsBucket)
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		seq, err := eb.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := eventKey(event.Timestamp.Time, seq)
+		if err = eb.Put(key, data); err != nil {
+			return err
+		}
+
+		indexes := []struct {
+			bucket []byte
+			prefix []byte
+		}{
+			{identBucket, identifierPrefix(event.Identifier)},
+			{ruleBucket, rulePrefix(event.RuleID)},
+			{statusBucket, statusPrefix(event.Status)},
+		}
+		for _, index := range indexes {
+			if err = tx.Bucket(index.bucket).Put(append(index.prefix, key...), nil); err != nil {
+				return err
+			}
+		}
+		mb := tx.Bucket(metadataBucket)
+		for k := range event.Metadata {
+			v, _ := event.Metadata.GetString(k)
+			if err = mb.Put(append(metadataPrefix(k, v), key...), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan calls fn with events matching q in time order, until fn returns false. The most
+// selective index available for q is used to find candidates.
+func (s *Store) scan(q *Query, fn func(*types.Event) bool) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	var bucket, prefix []byte
+	switch {
+	case q.Identifier != "":
+		bucket, prefix = identBucket, identifierPrefix(q.Identifier)
+	case q.RuleID != 0:
+		bucket, prefix = ruleBucket, rulePrefix(q.RuleID)
+	case len(q.Metadata) > 0:
+		keys := make([]string, 0, len(q.Metadata))
+		for k := range q.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		bucket, prefix = metadataBucket, metadataPrefix(keys[0], q.Metadata[keys[0]])
+	case len(q.Statuses) == 1:
+		bucket, prefix = statusBucket, statusPrefix(q.Statuses[0])
+	default:
+		bucket, prefix = eventsBucket, nil
+	}
+
+	partitions := days(q.From, q.To)
+	if q.Descending {
+		for i, j := 0, len(partitions)-1; i < j; i, j = i+1, j-1 {
+			partitions[i], partitions[j] = partitions[j], partitions[i]
+		}
+	}
+
+	for _, day := range partitions {
+		db, err := s.partition(day, false)
+		if err != nil {
+			return err
+		}
+		if db == nil {
+			continue
+		}
+		more := true
+		err = db.View(func(tx *bolt.Tx) error {
+			more, err = scanPartition(tx, bucket, prefix, q, fn)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// scanPartition scans keys of bucket starting with prefix, followed by an event key in
+// the query's time range. Returns false if fn stopped the scan.
+func scanPartition(tx *bolt.Tx, bucket, prefix []byte, q *Query, fn func(*types.Event) bool) (bool, error) {
+	eb := tx.Bucket(eventsBucket)
+	c := tx.Bucket(bucket).Cursor()
+	from := append(append([]byte{}, prefix...), timeKey(q.From)...)
+	to := append(append([]byte{}, prefix...), timeKey(q.To)...)
+
+	var k []byte
+	if q.Descending {
+		if k, _ = c.Seek(to); k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+	} else {
+		k, _ = c.Seek(from)
+	}
+
+	for k != nil {
+		if bytes.Compare(k, from) < 0 || bytes.Compare(k, to) >= 0 {
+			break
+		}
+
+		key := k[len(prefix):]
+		data := eb.Get(key)
+		if data != nil {
+			event := &types.Event{}
+			if err := json.Unmarshal(data, event); err != nil {
+				return false, err
+			}
+			// json only keeps seconds, the key has the exact time
+			event.Timestamp = types.FromTime(time.Unix(0, int64(binary.BigEndian.Uint64(key[:8]))))
+			if q.Matches(event) && !fn(event) {
+				return false, nil
+			}
+		}
+
+		if q.Descending {
+			k, _ = c.Prev()
+		} else {
+			k, _ = c.Next()
+		}
+	}
+	return true, nil
+}
+
+// Query returns events matching q.
+func (s *Store) Query(q *Query) ([]*types.Event, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	events := make([]*types.Event, 0)
+	err := s.scan(q, func(event *types.Event) bool {
+		events = append(events, event)
+		return q.Limit <= 0 || len(events) < q.Limit
+	})
+	return events, err
+}
+
+// Scan calls fn with events matching q in time order, until fn returns false.
+func (s *Store) Scan(q *Query, fn func(*types.Event) bool) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	return s.scan(q, fn)
+}
+
+// Count counts events matching q in buckets of interval, starting at q.From. Limit and
+// order of q are ignored.
+func (s *Store) Count(q *Query, interval time.Duration) ([]*Bucket, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive")
+	}
+	n := int((q.To.Sub(q.From) + interval - 1) / interval)
+	if n > MaxBuckets {
+		return nil, fmt.Errorf("too many buckets: %d, max allowed is %d", n, MaxBuckets)
+	}
+
+	buckets := make([]*Bucket, n)
+	for i := range buckets {
+		buckets[i] = &Bucket{Start: types.FromTime(q.From.Add(time.Duration(i) * interval))}
+	}
+
+	scanQuery := *q
+	scanQuery.Descending = false
+	err := s.scan(&scanQuery, func(event *types.Event) bool {
+		b := buckets[int(event.Timestamp.Sub(q.From)/interval)]
+		b.Total++
+		switch event.Status {
+		case types.OK:
+			b.OK++
+		case types.Warning:
+			b.Warning++
+		case types.Critical:
+			b.Critical++
+		case types.Unknown:
+			b.Unknown++
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// Expire drops partitions whose events are all older than retention, returns the number
+// of partitions dropped.
+func (s *Store) Expire(now time.Time) (int, error) {
+	if s.retention <= 0 {
+		return 0, nil
+	}
+	deadline := now.Add(-s.retention)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dropped := 0
+	for day, db := range s.partitions {
+		start, _ := time.Parse(partitionFormat, day)
+		if !start.Add(partitionDuration).Before(deadline) {
+			continue
+		}
+		path := db.Path()
+		if err := db.Close(); err != nil {
+			return dropped, err
+		}
+		delete(s.partitions, day)
+		if err := os.Remove(path); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+// Close writes buffered events and closes all partitions.
+func (s *Store) Close() error {
+	err := s.Flush()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for day, db := range s.partitions {
+		if e := db.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(s.partitions, day)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package ruledb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/openmetric/yamf/internal/types"
+	"sort"
+	"time"
+)
+
+// AuditQuery filters audit records, zero values match everything.
+type AuditQuery struct {
+	Actor  string
+	Action string
+	RuleID int
+	From   time.Time
+	Until  time.Time
+	// max number of records to return (newest first), 0 for no limit
+	Limit int
+}
+
+func (q *AuditQuery) matches(r *types.AuditRecord) bool {
+	switch {
+	case q.Actor != "" && r.Actor != q.Actor:
+		return false
+	case q.Action != "" && r.Action != q.Action:
+		return false
+	case q.RuleID != 0 && r.RuleID != q.RuleID:
+		return false
+	case !q.From.IsZero() && r.Timestamp.Before(q.From):
+		return false
+	case !q.Until.IsZero() && r.Timestamp.After(q.Until):
+		return false
+	}
+	return true
+}
+
+// AddAuditRecord saves an audit record.
+func (rdb *RuleDB) AddAuditRecord(record *types.AuditRecord) error {
+	if rdb.db == nil {
+		return fmt.Errorf("query on closed db")
+	}
+
+	doc, err := toDoc(record)
+	if err != nil {
+		return err
+	}
+	_, err = rdb.audit.Insert(doc)
+	return err
+}
+
+// QueryAudit returns audit records matching q, newest first.
+func (rdb *RuleDB) QueryAudit(q *AuditQuery) ([]*types.AuditRecord, error) {
+	if rdb.db == nil {
+		return nil, fmt.Errorf("query on closed db")
+	}
+
+	var records []*types.AuditRecord
+	var err error
+	decode := func(doc map[string]interface{}) {
+		record := &types.AuditRecord{}
+		if e := fromDoc(doc, record); e != nil {
+			err = e
+		} else if q.matches(record) {
+			records = append(records, record)
+		}
+	}
+
+	if q.RuleID != 0 {
+		result := make(map[int]struct{})
+		query := map[string]interface{}{"eq": ruleIDValue(q.RuleID), "in": []interface{}{"rule_id"}}
+		if err = db.EvalQuery(query, rdb.audit, &result); err != nil {
+			return nil, err
+		}
+		for id := range result {
+			doc, e := rdb.audit.Read(id)
+			if e != nil {
+				return nil, e
+			}
+			decode(doc)
+		}
+	} else {
+		rdb.audit.ForEachDoc(func(id int, data []byte) (moveOn bool) {
+			var doc map[string]interface{}
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			if err = decoder.Decode(&doc); err == nil {
+				decode(doc)
+			}
+			return err == nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Timestamp.After(records[j].Timestamp.Time) })
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[:q.Limit]
+	}
+	return records, nil
+}
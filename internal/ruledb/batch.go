@@ -0,0 +1,65 @@
+package ruledb
+
+import (
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+)
+
+// RuleOp is a single change of a batch.
+type RuleOp struct {
+	// "create", "update" or "delete"
+	Action string
+	// id of the rule to update or delete, set to id of the created rule after applied
+	ID int
+	// expected current version of the rule, 0 matches any version
+	Version int
+	// rule to create or update, nil for delete
+	Rule *types.Rule
+}
+
+// Batcher is implemented by stores which can apply multiple changes atomically, either
+// all of the changes are applied or none of them.
+type Batcher interface {
+	ApplyBatch(ops []*RuleOp) error
+}
+
+// ApplyBatch applies ops to store, atomically if the store implements Batcher, otherwise
+// one by one, stopping at the first error. Returns number of ops applied.
+func ApplyBatch(store RuleStore, ops []*RuleOp) (int, error) {
+	if batcher, ok := store.(Batcher); ok {
+		if err := batcher.ApplyBatch(ops); err != nil {
+			return 0, err
+		}
+		return len(ops), nil
+	}
+
+	for i, op := range ops {
+		var err error
+		switch op.Action {
+		case "create":
+			op.ID, err = store.Insert(op.Rule)
+		case "update":
+			err = store.UpdateIfMatch(op.ID, op.Version, op.Rule)
+		case "delete":
+			err = store.DeleteIfMatch(op.ID, op.Version)
+		default:
+			err = fmt.Errorf("unsupported batch action: %s", op.Action)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(ops), nil
+}
+
+// applyOps updates the index after ops have been applied.
+func (idx *ruleIndex) applyOps(ops []*RuleOp) {
+	for _, op := range ops {
+		if op.Action == "delete" {
+			idx.remove(op.ID)
+		} else {
+			op.Rule.ID = op.ID
+			idx.add(op.Rule)
+		}
+	}
+}
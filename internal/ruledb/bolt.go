@@ -0,0 +1,742 @@
+package ruledb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"time"
+)
+
+// BoltStore is a RuleStore backed by a single bbolt file. Rules, revisions and audit
+// records are kept in separate buckets, all values are json encoded.
+type BoltStore struct {
+	db          *bolt.DB
+	rulesBucket []byte
+	revsBucket  []byte
+	auditBucket []byte
+	maintBucket []byte
+	silBucket   []byte
+	hbBucket    []byte
+	index       *ruleIndex
+}
+
+func NewBoltStore(path, bucket string) (*BoltStore, error) {
+	s := &BoltStore{
+		rulesBucket: []byte(bucket),
+		revsBucket:  []byte(bucket + "_revisions"),
+		auditBucket: []byte(bucket + "_audit"),
+		maintBucket: []byte(bucket + "_maintenance"),
+		silBucket:   []byte(bucket + "_silences"),
+		hbBucket:    []byte(bucket + "_heartbeats"),
+	}
+	var err error
+
+	if s.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+		return nil, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{s.rulesBucket, s.revsBucket, s.auditBucket, s.maintBucket, s.silBucket, s.hbBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+
+	if err = s.buildIndex(); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// itob encodes v as 8-byte big endian, so that keys are sorted numerically.
+func itob(v int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func btoi(b []byte) int {
+	return int(binary.BigEndian.Uint64(b))
+}
+
+// revisionKey is rule id followed by revision number, so revisions of a rule are
+// adjacent and ordered.
+func revisionKey(ruleID, revision int) []byte {
+	return append(itob(ruleID), itob(revision)...)
+}
+
+func encodeRule(rule *types.Rule) ([]byte, error) {
+	return json.Marshal(rule)
+}
+
+func decodeRule(id int, data []byte) (*types.Rule, error) {
+	rule := &types.Rule{}
+	if err := json.Unmarshal(data, rule); err != nil {
+		return nil, err
+	}
+	rule.ID = id
+	setDefaults(rule)
+	return rule, nil
+}
+
+func (s *BoltStore) buildIndex() error {
+	s.index = newRuleIndex()
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.rulesBucket).ForEach(func(k, v []byte) error {
+			if rule, err := decodeRule(btoi(k), v); err == nil {
+				s.index.add(rule)
+			}
+			return nil
+		})
+	})
+}
+
+func (s *BoltStore) GetAll() ([]*types.Rule, []error, error) {
+	var rules []*types.Rule
+	var errors []error
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.rulesBucket).ForEach(func(k, v []byte) error {
+			rule, err := decodeRule(btoi(k), v)
+			if err != nil {
+				rule = &types.Rule{ID: btoi(k)}
+			}
+			rules = append(rules, rule)
+			errors = append(errors, err)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return rules, errors, nil
+}
+
+func (s *BoltStore) get(tx *bolt.Tx, id int) (*types.Rule, error) {
+	data := tx.Bucket(s.rulesBucket).Get(itob(id))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	return decodeRule(id, data)
+}
+
+func (s *BoltStore) Get(id int) (*types.Rule, error) {
+	var rule *types.Rule
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rule, err = s.get(tx, id)
+		return err
+	})
+	return rule, err
+}
+
+func (s *BoltStore) insert(tx *bolt.Tx, rule *types.Rule) (int, error) {
+	b := tx.Bucket(s.rulesBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	rule.Version = 1
+	data, err := encodeRule(rule)
+	if err != nil {
+		return 0, err
+	}
+	return int(seq), b.Put(itob(int(seq)), data)
+}
+
+func (s *BoltStore) update(tx *bolt.Tx, id int, version int, rule *types.Rule) error {
+	current, err := s.get(tx, id)
+	if err != nil {
+		return err
+	}
+	if version != 0 && current.Version != version {
+		return ErrVersionConflict
+	}
+	rule.Version = current.Version + 1
+	data, err := encodeRule(rule)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(s.rulesBucket).Put(itob(id), data)
+}
+
+func (s *BoltStore) delete(tx *bolt.Tx, id int, version int) error {
+	current, err := s.get(tx, id)
+	if err != nil {
+		return err
+	}
+	if version != 0 && current.Version != version {
+		return ErrVersionConflict
+	}
+	return tx.Bucket(s.rulesBucket).Delete(itob(id))
+}
+
+func (s *BoltStore) Insert(rule *types.Rule) (int, error) {
+	var id int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		id, err = s.insert(tx, rule)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	rule.ID = id
+	s.index.add(rule)
+	return id, nil
+}
+
+func (s *BoltStore) Update(id int, rule *types.Rule) error {
+	return s.UpdateIfMatch(id, 0, rule)
+}
+
+func (s *BoltStore) UpdateIfMatch(id int, version int, rule *types.Rule) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.update(tx, id, version, rule)
+	})
+	if err != nil {
+		return err
+	}
+	rule.ID = id
+	s.index.add(rule)
+	return nil
+}
+
+func (s *BoltStore) Delete(id int) error {
+	return s.DeleteIfMatch(id, 0)
+}
+
+func (s *BoltStore) DeleteIfMatch(id int, version int) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.delete(tx, id, version)
+	})
+	if err != nil {
+		return err
+	}
+	s.index.remove(id)
+	return nil
+}
+
+// ApplyBatch applies all ops in a single transaction.
+func (s *BoltStore) ApplyBatch(ops []*RuleOp) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			var err error
+			switch op.Action {
+			case "create":
+				op.ID, err = s.insert(tx, op.Rule)
+			case "update":
+				err = s.update(tx, op.ID, op.Version, op.Rule)
+			case "delete":
+				err = s.delete(tx, op.ID, op.Version)
+			default:
+				err = fmt.Errorf("unsupported batch action: %s", op.Action)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.index.applyOps(ops)
+	return nil
+}
+
+func (s *BoltStore) Query(q *Query) ([]*types.Rule, string, error) {
+	ids, next, err := s.index.query(q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rules := make([]*types.Rule, 0, len(ids))
+	err = s.db.View(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			rule, err := s.get(tx, id)
+			if err == ErrNotFound {
+				// deleted after the index was queried
+				continue
+			} else if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return rules, next, nil
+}
+
+func (s *BoltStore) Count(q *Query) (int, error) {
+	c := *q
+	c.Sort, c.Limit, c.Cursor = "", 0, ""
+	ids, _, err := s.index.query(&c)
+	return len(ids), err
+}
+
+func (s *BoltStore) AddRevision(rev *types.RuleRevision) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.revsBucket)
+
+		// the last key with rule id prefix holds the latest revision
+		rev.Revision = 1
+		prefix := itob(rev.RuleID)
+		c := b.Cursor()
+		k, _ := c.Seek(itob(rev.RuleID + 1))
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		if k != nil && bytes.HasPrefix(k, prefix) {
+			rev.Revision = btoi(k[8:]) + 1
+		}
+
+		data, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+		return b.Put(revisionKey(rev.RuleID, rev.Revision), data)
+	})
+}
+
+func (s *BoltStore) GetRevisions(ruleID int) ([]*types.RuleRevision, error) {
+	revs := make([]*types.RuleRevision, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := itob(ruleID)
+		c := tx.Bucket(s.revsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rev := &types.RuleRevision{}
+			if err := json.Unmarshal(v, rev); err != nil {
+				return err
+			}
+			revs = append(revs, rev)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+func (s *BoltStore) GetRevision(ruleID, revision int) (*types.RuleRevision, error) {
+	var rev *types.RuleRevision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(s.revsBucket).Get(revisionKey(ruleID, revision))
+		if data == nil {
+			return nil
+		}
+		rev = &types.RuleRevision{}
+		return json.Unmarshal(data, rev)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+func (s *BoltStore) AddAuditRecord(record *types.AuditRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.auditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(int(seq)), data)
+	})
+}
+
+func (s *BoltStore) QueryAudit(q *AuditQuery) ([]*types.AuditRecord, error) {
+	var records []*types.AuditRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// records are appended in time order, walk backwards for newest first
+		c := tx.Bucket(s.auditBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			record := &types.AuditRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			if q.matches(record) {
+				records = append(records, record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Timestamp.After(records[j].Timestamp.Time) })
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[:q.Limit]
+	}
+	return records, nil
+}
+
+func (s *BoltStore) GetMaintenanceWindows() ([]*types.MaintenanceWindow, error) {
+	windows := make([]*types.MaintenanceWindow, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.maintBucket).ForEach(func(k, v []byte) error {
+			w := &types.MaintenanceWindow{}
+			if err := json.Unmarshal(v, w); err != nil {
+				return err
+			}
+			w.ID = btoi(k)
+			windows = append(windows, w)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+func (s *BoltStore) AddMaintenanceWindow(w *types.MaintenanceWindow) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.maintBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		w.ID = int(seq)
+		data, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(w.ID), data)
+	})
+}
+
+func (s *BoltStore) DeleteMaintenanceWindow(id int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.maintBucket)
+		if b.Get(itob(id)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete(itob(id))
+	})
+}
+
+func (s *BoltStore) GetSilences() ([]*types.Silence, error) {
+	silences := make([]*types.Silence, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.silBucket).ForEach(func(k, v []byte) error {
+			silence := &types.Silence{}
+			if err := json.Unmarshal(v, silence); err != nil {
+				return err
+			}
+			silence.ID = btoi(k)
+			silences = append(silences, silence)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return silences, nil
+}
+
+func (s *BoltStore) AddSilence(silence *types.Silence) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.silBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		silence.ID = int(seq)
+		data, err := json.Marshal(silence)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(silence.ID), data)
+	})
+}
+
+func (s *BoltStore) UpdateSilence(silence *types.Silence) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.silBucket)
+		if b.Get(itob(silence.ID)) == nil {
+			return ErrNotFound
+		}
+		data, err := json.Marshal(silence)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(silence.ID), data)
+	})
+}
+
+func (s *BoltStore) GetHeartbeat(ruleID int) (time.Time, error) {
+	var lastSeen time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(s.hbBucket).Get(itob(ruleID))
+		if data == nil {
+			return nil
+		}
+		record := &heartbeatRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return err
+		}
+		lastSeen = record.LastSeen.Time
+		return nil
+	})
+	return lastSeen, err
+}
+
+func (s *BoltStore) SetHeartbeat(ruleID int, lastSeen time.Time) error {
+	data, err := json.Marshal(&heartbeatRecord{RuleID: ruleID, LastSeen: types.FromTime(lastSeen)})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.hbBucket).Put(itob(ruleID), data)
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// MigrateCounts are numbers of records copied by MigrateTiedot.
+type MigrateCounts struct {
+	Rules              int
+	Revisions          int
+	AuditRecords       int
+	MaintenanceWindows int
+	Silences           int
+	Heartbeats         int
+}
+
+// MigrateTiedot copies rules, revisions, audit records, maintenance windows, silences and
+// heartbeats from a tiedot database into a bolt file, rule and silence ids are preserved.
+// The bolt buckets must be empty.
+func MigrateTiedot(tiedotPath, collection, boltPath string) (*MigrateCounts, error) {
+	counts := &MigrateCounts{}
+
+	src, err := NewRuleDB(tiedotPath, collection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tiedot database: %s", err)
+	}
+	defer src.Close()
+
+	dst, err := NewBoltStore(boltPath, collection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database: %s", err)
+	}
+	defer dst.Close()
+
+	rules, errors, err := src.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if errors[i] != nil {
+			return nil, fmt.Errorf("failed to decode rule %d: %s", rule.ID, errors[i])
+		}
+	}
+
+	// rule ids of records saved before they were stored as strings went through float64,
+	// they are mapped back to the rule with the same float64 id
+	ruleIDs := make(map[int]bool, len(rules))
+	roundedIDs := make(map[float64][]int, len(rules))
+	for _, rule := range rules {
+		ruleIDs[rule.ID] = true
+		roundedIDs[float64(rule.ID)] = append(roundedIDs[float64(rule.ID)], rule.ID)
+	}
+	fixRuleID := func(id int) int {
+		if ids := roundedIDs[float64(id)]; !ruleIDs[id] && len(ids) == 1 {
+			return ids[0]
+		}
+		return id
+	}
+
+	var revs []*types.RuleRevision
+	src.revs.ForEachDoc(func(id int, data []byte) (moveOn bool) {
+		rev := &types.RuleRevision{}
+		if err = decodeDoc(data, rev); err != nil {
+			err = fmt.Errorf("failed to decode revision: %s", err)
+			return false
+		}
+		rev.RuleID = fixRuleID(rev.RuleID)
+		if rev.Rule != nil {
+			rev.Rule.ID = rev.RuleID
+		}
+		revs = append(revs, rev)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*types.AuditRecord
+	src.audit.ForEachDoc(func(id int, data []byte) (moveOn bool) {
+		record := &types.AuditRecord{}
+		if err = decodeDoc(data, record); err != nil {
+			err = fmt.Errorf("failed to decode audit record: %s", err)
+			return false
+		}
+		record.RuleID = fixRuleID(record.RuleID)
+		for _, rule := range []*types.Rule{record.Before, record.After} {
+			if rule != nil {
+				rule.ID = record.RuleID
+			}
+		}
+		records = append(records, record)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Timestamp.Before(records[j].Timestamp.Time) })
+
+	windows, err := src.GetMaintenanceWindows()
+	if err != nil {
+		return nil, err
+	}
+
+	silences, err := src.GetSilences()
+	if err != nil {
+		return nil, err
+	}
+
+	var heartbeats []*heartbeatRecord
+	src.heartbeats.ForEachDoc(func(id int, data []byte) (moveOn bool) {
+		record := &heartbeatRecord{}
+		if err = decodeDoc(data, record); err != nil {
+			err = fmt.Errorf("failed to decode heartbeat: %s", err)
+			return false
+		}
+		record.RuleID = fixRuleID(record.RuleID)
+		heartbeats = append(heartbeats, record)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = dst.db.Update(func(tx *bolt.Tx) error {
+		rb, vb, ab, mb := tx.Bucket(dst.rulesBucket), tx.Bucket(dst.revsBucket), tx.Bucket(dst.auditBucket), tx.Bucket(dst.maintBucket)
+		sb, hb := tx.Bucket(dst.silBucket), tx.Bucket(dst.hbBucket)
+		for _, b := range []*bolt.Bucket{rb, vb, ab, mb, sb, hb} {
+			if k, _ := b.Cursor().First(); k != nil {
+				return fmt.Errorf("bolt database is not empty")
+			}
+		}
+
+		maxID := 0
+		for _, rule := range rules {
+			data, err := encodeRule(rule)
+			if err != nil {
+				return err
+			}
+			if err = rb.Put(itob(rule.ID), data); err != nil {
+				return err
+			}
+			if rule.ID > maxID {
+				maxID = rule.ID
+			}
+			counts.Rules++
+		}
+		// new rules must not reuse migrated ids
+		if err := rb.SetSequence(uint64(maxID)); err != nil {
+			return err
+		}
+
+		for _, rev := range revs {
+			data, err := json.Marshal(rev)
+			if err != nil {
+				return err
+			}
+			if err = vb.Put(revisionKey(rev.RuleID, rev.Revision), data); err != nil {
+				return err
+			}
+			counts.Revisions++
+		}
+
+		for i, record := range records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err = ab.Put(itob(i+1), data); err != nil {
+				return err
+			}
+			counts.AuditRecords++
+		}
+		if err := ab.SetSequence(uint64(len(records))); err != nil {
+			return err
+		}
+
+		maxID = 0
+		for _, w := range windows {
+			data, err := json.Marshal(w)
+			if err != nil {
+				return err
+			}
+			if err = mb.Put(itob(w.ID), data); err != nil {
+				return err
+			}
+			if w.ID > maxID {
+				maxID = w.ID
+			}
+			counts.MaintenanceWindows++
+		}
+		if err := mb.SetSequence(uint64(maxID)); err != nil {
+			return err
+		}
+
+		maxID = 0
+		for _, silence := range silences {
+			data, err := json.Marshal(silence)
+			if err != nil {
+				return err
+			}
+			if err = sb.Put(itob(silence.ID), data); err != nil {
+				return err
+			}
+			if silence.ID > maxID {
+				maxID = silence.ID
+			}
+			counts.Silences++
+		}
+		if err := sb.SetSequence(uint64(maxID)); err != nil {
+			return err
+		}
+
+		for _, record := range heartbeats {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err = hb.Put(itob(record.RuleID), data); err != nil {
+				return err
+			}
+			counts.Heartbeats++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
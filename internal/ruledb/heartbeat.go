@@ -0,0 +1,76 @@
+package ruledb
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/openmetric/yamf/internal/types"
+	"time"
+)
+
+// heartbeatRecord is the last ping of a heartbeat rule, as saved by tiedot and bolt.
+type heartbeatRecord struct {
+	RuleID   int        `json:"rule_id"`
+	LastSeen types.Time `json:"last_seen"`
+}
+
+// findHeartbeat returns document id and record of the rule's heartbeat, id is -1 if the
+// rule was never pinged.
+func (rdb *RuleDB) findHeartbeat(ruleID int) (int, *heartbeatRecord, error) {
+	result := make(map[int]struct{})
+	query := map[string]interface{}{"eq": ruleIDValue(ruleID), "in": []interface{}{"rule_id"}}
+	if err := db.EvalQuery(query, rdb.heartbeats, &result); err != nil {
+		return -1, nil, err
+	}
+
+	for id := range result {
+		doc, err := rdb.heartbeats.Read(id)
+		if err != nil {
+			return -1, nil, err
+		}
+		record := &heartbeatRecord{}
+		if err = fromDoc(doc, record); err != nil {
+			return -1, nil, err
+		}
+		// tiedot hash index may have collisions
+		if record.RuleID == ruleID {
+			return id, record, nil
+		}
+	}
+	return -1, nil, nil
+}
+
+func (rdb *RuleDB) GetHeartbeat(ruleID int) (time.Time, error) {
+	if rdb.db == nil {
+		return time.Time{}, fmt.Errorf("query on closed db")
+	}
+
+	_, record, err := rdb.findHeartbeat(ruleID)
+	if err != nil || record == nil {
+		return time.Time{}, err
+	}
+	return record.LastSeen.Time, nil
+}
+
+func (rdb *RuleDB) SetHeartbeat(ruleID int, lastSeen time.Time) error {
+	if rdb.db == nil {
+		return fmt.Errorf("query on closed db")
+	}
+
+	rdb.writeLock.Lock()
+	defer rdb.writeLock.Unlock()
+
+	id, _, err := rdb.findHeartbeat(ruleID)
+	if err != nil {
+		return err
+	}
+	doc, err := toDoc(&heartbeatRecord{RuleID: ruleID, LastSeen: types.FromTime(lastSeen)})
+	if err != nil {
+		return err
+	}
+	if id < 0 {
+		_, err = rdb.heartbeats.Insert(doc)
+	} else {
+		err = rdb.heartbeats.Update(id, doc)
+	}
+	return err
+}
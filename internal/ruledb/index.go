@@ -0,0 +1,322 @@
+package ruledb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Query describes which rules to fetch, and in which order.
+type Query struct {
+	Namespace string
+	Selector  types.LabelSelector
+	Type      string
+	Paused    *bool
+	// case insensitive search over name, check query and event identifier pattern
+	Search string
+
+	// sort by "id", "name" or "type", prefix with "-" for descending order
+	Sort string
+	// max number of rules to return, 0 for no limit
+	Limit int
+	// cursor returned by previous query, to fetch the next page
+	Cursor string
+}
+
+// Validate checks sort field and cursor of the query.
+func (q *Query) Validate() error {
+	switch strings.TrimPrefix(q.Sort, "-") {
+	case "", "id", "name", "type":
+	default:
+		return fmt.Errorf("unsupported sort field: %s", q.Sort)
+	}
+	if q.Cursor != "" {
+		if _, err := decodeCursor(q.Cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type indexEntry struct {
+	Namespace string
+	ID        int
+	Name      string
+	Type      string
+	Paused    bool
+	Labels    types.Labels
+	Text      string
+}
+
+type idSet map[int]struct{}
+
+// ruleIndex is an in memory index of rule attributes, so that rules can be filtered
+// without scanning and decoding all documents in the collection.
+type ruleIndex struct {
+	entries     map[int]*indexEntry
+	byNamespace map[string]idSet
+	byType      map[string]idSet
+	byLabel     map[string]map[string]idSet
+
+	sync.RWMutex
+}
+
+func newRuleIndex() *ruleIndex {
+	return &ruleIndex{
+		entries:     make(map[int]*indexEntry),
+		byNamespace: make(map[string]idSet),
+		byType:      make(map[string]idSet),
+		byLabel:     make(map[string]map[string]idSet),
+	}
+}
+
+func searchText(rule *types.Rule) string {
+	parts := []string{rule.Name, rule.EventIdentifierPattern}
+	switch check := rule.Check.(type) {
+	case *types.GraphiteCheck:
+		parts = append(parts, check.Query)
+	}
+	return strings.ToLower(strings.Join(parts, "\n"))
+}
+
+func (idx *ruleIndex) add(rule *types.Rule) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	idx.removeLocked(rule.ID)
+
+	e := &indexEntry{
+		Namespace: rule.Namespace,
+		ID:        rule.ID,
+		Name:      rule.Name,
+		Type:      rule.Type,
+		Paused:    rule.Paused,
+		Labels:    make(types.Labels, len(rule.Labels)),
+		Text:      searchText(rule),
+	}
+	for k, v := range rule.Labels {
+		e.Labels[k] = v
+	}
+	idx.entries[e.ID] = e
+
+	if idx.byNamespace[e.Namespace] == nil {
+		idx.byNamespace[e.Namespace] = make(idSet)
+	}
+	idx.byNamespace[e.Namespace][e.ID] = struct{}{}
+
+	if idx.byType[e.Type] == nil {
+		idx.byType[e.Type] = make(idSet)
+	}
+	idx.byType[e.Type][e.ID] = struct{}{}
+
+	for k, v := range e.Labels {
+		if idx.byLabel[k] == nil {
+			idx.byLabel[k] = make(map[string]idSet)
+		}
+		if idx.byLabel[k][v] == nil {
+			idx.byLabel[k][v] = make(idSet)
+		}
+		idx.byLabel[k][v][e.ID] = struct{}{}
+	}
+}
+
+func (idx *ruleIndex) remove(id int) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.removeLocked(id)
+}
+
+func (idx *ruleIndex) removeLocked(id int) {
+	e, ok := idx.entries[id]
+	if !ok {
+		return
+	}
+	delete(idx.entries, id)
+
+	delete(idx.byNamespace[e.Namespace], id)
+	if len(idx.byNamespace[e.Namespace]) == 0 {
+		delete(idx.byNamespace, e.Namespace)
+	}
+
+	delete(idx.byType[e.Type], id)
+	if len(idx.byType[e.Type]) == 0 {
+		delete(idx.byType, e.Type)
+	}
+
+	for k, v := range e.Labels {
+		delete(idx.byLabel[k][v], id)
+		if len(idx.byLabel[k][v]) == 0 {
+			delete(idx.byLabel[k], v)
+		}
+		if len(idx.byLabel[k]) == 0 {
+			delete(idx.byLabel, k)
+		}
+	}
+}
+
+// candidates narrows down rules using indexed attributes. Returns nil if the query
+// has no indexed condition, which means all rules are candidates.
+func (idx *ruleIndex) candidates(q *Query) idSet {
+	var result idSet
+	intersect := func(set idSet) {
+		if result == nil {
+			result = make(idSet, len(set))
+			for id := range set {
+				result[id] = struct{}{}
+			}
+			return
+		}
+		for id := range result {
+			if _, ok := set[id]; !ok {
+				delete(result, id)
+			}
+		}
+	}
+
+	if q.Namespace != "" {
+		intersect(idx.byNamespace[q.Namespace])
+	}
+	if q.Type != "" {
+		intersect(idx.byType[q.Type])
+	}
+	for _, r := range q.Selector {
+		switch r.Op {
+		case "=":
+			intersect(idx.byLabel[r.Key][r.Value])
+		case "exists":
+			set := make(idSet)
+			for _, ids := range idx.byLabel[r.Key] {
+				for id := range ids {
+					set[id] = struct{}{}
+				}
+			}
+			intersect(set)
+		}
+	}
+	return result
+}
+
+func (q *Query) matches(e *indexEntry) bool {
+	if q.Namespace != "" && e.Namespace != q.Namespace {
+		return false
+	}
+	if q.Type != "" && e.Type != q.Type {
+		return false
+	}
+	if q.Paused != nil && e.Paused != *q.Paused {
+		return false
+	}
+	if !q.Selector.Matches(e.Labels) {
+		return false
+	}
+	if q.Search != "" && !strings.Contains(e.Text, strings.ToLower(q.Search)) {
+		return false
+	}
+	return true
+}
+
+type cursor struct {
+	Key string `json:"k"`
+	ID  int    `json:"id"`
+}
+
+func encodeCursor(c *cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(str string) (*cursor, error) {
+	c := &cursor{}
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err == nil {
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %s", str)
+	}
+	return c, nil
+}
+
+// query returns ids of rules matching the query, in requested order, and cursor
+// of the next page (empty if there are no more rules).
+func (idx *ruleIndex) query(q *Query) ([]int, string, error) {
+	var sortKey func(e *indexEntry) string
+	field := strings.TrimPrefix(q.Sort, "-")
+	desc := strings.HasPrefix(q.Sort, "-")
+	switch field {
+	case "", "id":
+		sortKey = func(e *indexEntry) string { return "" }
+	case "name":
+		sortKey = func(e *indexEntry) string { return e.Name }
+	case "type":
+		sortKey = func(e *indexEntry) string { return e.Type }
+	default:
+		return nil, "", fmt.Errorf("unsupported sort field: %s", field)
+	}
+	less := func(ka string, ia int, kb string, ib int) bool {
+		if ka != kb {
+			return (ka < kb) != desc
+		}
+		if ia != ib {
+			return (ia < ib) != desc
+		}
+		return false
+	}
+
+	var after *cursor
+	var err error
+	if q.Cursor != "" {
+		if after, err = decodeCursor(q.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	idx.RLock()
+	var matched []*indexEntry
+	if candidates := idx.candidates(q); candidates != nil {
+		for id := range candidates {
+			if e := idx.entries[id]; q.matches(e) {
+				matched = append(matched, e)
+			}
+		}
+	} else {
+		for _, e := range idx.entries {
+			if q.matches(e) {
+				matched = append(matched, e)
+			}
+		}
+	}
+	idx.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return less(sortKey(matched[i]), matched[i].ID, sortKey(matched[j]), matched[j].ID)
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return less(after.Key, after.ID, sortKey(matched[i]), matched[i].ID)
+		})
+	}
+	end := len(matched)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+
+	ids := make([]int, 0, end-start)
+	for _, e := range matched[start:end] {
+		ids = append(ids, e.ID)
+	}
+
+	var next string
+	if end < len(matched) {
+		last := matched[end-1]
+		next = encodeCursor(&cursor{Key: sortKey(last), ID: last.ID})
+	}
+
+	return ids, next, nil
+}
@@ -0,0 +1,60 @@
+package ruledb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/openmetric/yamf/internal/types"
+	"sort"
+)
+
+func (rdb *RuleDB) GetMaintenanceWindows() ([]*types.MaintenanceWindow, error) {
+	if rdb.db == nil {
+		return nil, fmt.Errorf("query on closed db")
+	}
+
+	windows := make([]*types.MaintenanceWindow, 0)
+	var err error
+	rdb.maint.ForEachDoc(func(id int, data []byte) (moveOn bool) {
+		w := &types.MaintenanceWindow{}
+		if err = json.Unmarshal(data, w); err != nil {
+			return false
+		}
+		w.ID = id
+		windows = append(windows, w)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(windows, func(i, j int) bool { return windows[i].ID < windows[j].ID })
+	return windows, nil
+}
+
+func (rdb *RuleDB) AddMaintenanceWindow(w *types.MaintenanceWindow) error {
+	if rdb.db == nil {
+		return fmt.Errorf("query on closed db")
+	}
+
+	doc, err := toDoc(w)
+	if err != nil {
+		return err
+	}
+	if w.ID, err = rdb.maint.Insert(doc); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdb *RuleDB) DeleteMaintenanceWindow(id int) error {
+	if rdb.db == nil {
+		return fmt.Errorf("query on closed db")
+	}
+
+	if err := rdb.maint.Delete(id); dberr.Type(err) == dberr.ErrorNoDoc {
+		return ErrNotFound
+	} else {
+		return err
+	}
+}
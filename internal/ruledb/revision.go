@@ -0,0 +1,160 @@
+package ruledb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/openmetric/yamf/internal/types"
+	"sort"
+	"strconv"
+)
+
+// AddRevision appends a revision to history of rev.RuleID, revision number is assigned
+// automatically.
+func (rdb *RuleDB) AddRevision(rev *types.RuleRevision) error {
+	if rdb.db == nil {
+		return fmt.Errorf("query on closed db")
+	}
+
+	var revs []*types.RuleRevision
+	var doc map[string]interface{}
+	var err error
+
+	// numbering is read-check-write, concurrent revisions of a rule must not get the same
+	// number. Callers must not hold writeLock.
+	rdb.writeLock.Lock()
+	defer rdb.writeLock.Unlock()
+
+	if revs, err = rdb.GetRevisions(rev.RuleID); err != nil {
+		return err
+	}
+	rev.Revision = 1
+	if len(revs) > 0 {
+		rev.Revision = revs[len(revs)-1].Revision + 1
+	}
+
+	if doc, err = toDoc(rev); err != nil {
+		return err
+	}
+	_, err = rdb.revs.Insert(doc)
+	return err
+}
+
+// GetRevisions returns history of a rule, oldest revision first.
+func (rdb *RuleDB) GetRevisions(ruleID int) ([]*types.RuleRevision, error) {
+	if rdb.db == nil {
+		return nil, fmt.Errorf("query on closed db")
+	}
+
+	result := make(map[int]struct{})
+	query := map[string]interface{}{"eq": ruleIDValue(ruleID), "in": []interface{}{"rule_id"}}
+	if err := db.EvalQuery(query, rdb.revs, &result); err != nil {
+		return nil, err
+	}
+
+	revs := make([]*types.RuleRevision, 0, len(result))
+	for id := range result {
+		doc, err := rdb.revs.Read(id)
+		if err != nil {
+			return nil, err
+		}
+		rev := &types.RuleRevision{}
+		if err = fromDoc(doc, rev); err != nil {
+			return nil, err
+		}
+		// tiedot hash index may have collisions
+		if rev.RuleID == ruleID {
+			revs = append(revs, rev)
+		}
+	}
+
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Revision < revs[j].Revision })
+	return revs, nil
+}
+
+// GetRevision returns a single revision of a rule, nil if it does not exist.
+func (rdb *RuleDB) GetRevision(ruleID, revision int) (*types.RuleRevision, error) {
+	revs, err := rdb.GetRevisions(ruleID)
+	if err != nil {
+		return nil, err
+	}
+	for _, rev := range revs {
+		if rev.Revision == revision {
+			return rev, nil
+		}
+	}
+	return nil, nil
+}
+
+// ruleIDValue is how "rule_id" of documents is saved and looked up. tiedot reads numbers
+// of documents as float64, which can't hold rule ids generated by tiedot exactly, so
+// rule ids are saved as strings.
+func ruleIDValue(ruleID int) string {
+	return strconv.Itoa(ruleID)
+}
+
+// toDoc converts v into a tiedot document, using its json representation.
+func toDoc(v interface{}) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if ruleID, ok := doc["rule_id"].(json.Number); ok {
+		doc["rule_id"] = ruleID.String()
+	}
+	return doc, nil
+}
+
+// fromDoc decodes a tiedot document into v, using its json representation. Rules
+// embedded in revisions and audit records get the record's rule id, their own id went
+// through float64.
+func fromDoc(doc map[string]interface{}, v interface{}) error {
+	if ruleID, ok := doc["rule_id"].(string); ok {
+		copied := make(map[string]interface{}, len(doc))
+		for k, v := range doc {
+			copied[k] = v
+		}
+		copied["rule_id"] = json.Number(ruleID)
+		doc = copied
+	}
+
+	data, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case *types.RuleRevision:
+		if v.Rule != nil {
+			v.Rule.ID = v.RuleID
+		}
+	case *types.AuditRecord:
+		for _, rule := range []*types.Rule{v.Before, v.After} {
+			if rule != nil {
+				rule.ID = v.RuleID
+			}
+		}
+	}
+	return nil
+}
+
+// decodeDoc decodes a document iterated by ForEachDoc into v, like fromDoc.
+func decodeDoc(data []byte, v interface{}) error {
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return err
+	}
+	return fromDoc(doc, v)
+}
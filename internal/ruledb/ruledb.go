@@ -4,12 +4,27 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/openmetric/yamf/internal/types"
+	"reflect"
+	"sync"
 )
 
+// RuleDB is a RuleStore backed by tiedot.
 type RuleDB struct {
-	db  *db.DB
-	col *db.Col
+	db    *db.DB
+	col   *db.Col
+	revs  *db.Col
+	audit *db.Col
+	maint *db.Col
+	// silences are not rule specific, but distributed by scheduler, so they live here too
+	silences *db.Col
+	// last pings of heartbeat rules, kept apart so pings don't create rule versions
+	heartbeats *db.Col
+	index      *ruleIndex
+
+	// serializes read-check-write of versioned updates
+	writeLock sync.Mutex
 }
 
 func NewRuleDB(dbPath, dbCollection string) (*RuleDB, error) {
@@ -19,16 +34,86 @@ func NewRuleDB(dbPath, dbCollection string) (*RuleDB, error) {
 	if rdb.db, err = db.OpenDB(dbPath); err != nil {
 		return nil, err
 	}
-	if rdb.col = rdb.db.Use(dbCollection); rdb.col == nil {
-		if err := rdb.db.Create(dbCollection); err != nil {
-			return nil, err
-		}
-		rdb.col = rdb.db.Use(dbCollection)
+	if rdb.col, err = rdb.useCollection(dbCollection); err != nil {
+		return nil, err
+	}
+	if rdb.revs, err = rdb.useCollection(dbCollection + "_revisions"); err != nil {
+		return nil, err
+	}
+	if err = rdb.ensureIndex(rdb.revs, "rule_id"); err != nil {
+		return nil, err
+	}
+	if rdb.audit, err = rdb.useCollection(dbCollection + "_audit"); err != nil {
+		return nil, err
+	}
+	if err = rdb.ensureIndex(rdb.audit, "rule_id"); err != nil {
+		return nil, err
+	}
+	if rdb.maint, err = rdb.useCollection(dbCollection + "_maintenance"); err != nil {
+		return nil, err
+	}
+	if rdb.silences, err = rdb.useCollection(dbCollection + "_silences"); err != nil {
+		return nil, err
+	}
+	if rdb.heartbeats, err = rdb.useCollection(dbCollection + "_heartbeats"); err != nil {
+		return nil, err
+	}
+	if err = rdb.ensureIndex(rdb.heartbeats, "rule_id"); err != nil {
+		return nil, err
 	}
 
+	rdb.buildIndex()
+
 	return rdb, nil
 }
 
+// setDefaults fills fields added after the rule was saved.
+func setDefaults(rule *types.Rule) {
+	if rule.Namespace == "" {
+		rule.Namespace = types.DefaultNamespace
+	}
+	// rules saved before versioning are at their first version, so clients can match them
+	if rule.Version == 0 {
+		rule.Version = 1
+	}
+}
+
+// useCollection opens a collection, creates it if it does not exist.
+func (rdb *RuleDB) useCollection(name string) (*db.Col, error) {
+	if col := rdb.db.Use(name); col != nil {
+		return col, nil
+	}
+	if err := rdb.db.Create(name); err != nil {
+		return nil, err
+	}
+	return rdb.db.Use(name), nil
+}
+
+// ensureIndex creates tiedot index on path if it does not exist.
+func (rdb *RuleDB) ensureIndex(col *db.Col, path ...string) error {
+	for _, idx := range col.AllIndexes() {
+		if reflect.DeepEqual(idx, path) {
+			return nil
+		}
+	}
+	return col.Index(path)
+}
+
+// buildIndex indexes all rules in collection, documents which can not be decoded are
+// not indexed.
+func (rdb *RuleDB) buildIndex() {
+	rdb.index = newRuleIndex()
+	rdb.col.ForEachDoc(func(id int, doc []byte) (moveOn bool) {
+		rule := &types.Rule{}
+		if err := json.Unmarshal(doc, rule); err == nil {
+			rule.ID = id
+			setDefaults(rule)
+			rdb.index.add(rule)
+		}
+		return true
+	})
+}
+
 func (rdb *RuleDB) GetAll() ([]*types.Rule, []error, error) {
 	if rdb.db == nil {
 		return nil, nil, fmt.Errorf("query on closed db")
@@ -47,6 +132,7 @@ func (rdb *RuleDB) GetAll() ([]*types.Rule, []error, error) {
 			errors = append(errors, err)
 		} else {
 			rule.ID = id
+			setDefaults(rule)
 			rules = append(rules, rule)
 			errors = append(errors, nil)
 		}
@@ -65,7 +151,9 @@ func (rdb *RuleDB) Get(id int) (*types.Rule, error) {
 	var doc map[string]interface{}
 	var err error
 
-	if doc, err = rdb.col.Read(id); err != nil {
+	if doc, err = rdb.col.Read(id); dberr.Type(err) == dberr.ErrorNoDoc {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -74,6 +162,7 @@ func (rdb *RuleDB) Get(id int) (*types.Rule, error) {
 	}
 
 	rule.ID = id
+	setDefaults(rule)
 	return rule, nil
 }
 
@@ -82,32 +171,113 @@ func (rdb *RuleDB) Insert(rule *types.Rule) (int, error) {
 		return 0, fmt.Errorf("query on closed db")
 	}
 
+	rule.Version = 1
 	id, err := rdb.col.Insert(rule.MarshalMap())
 	if err == nil {
 		rule.ID = id
+		rdb.index.add(rule)
 	}
 	return id, err
 }
 
+// Update saves rule with id, and increases its version.
 func (rdb *RuleDB) Update(id int, rule *types.Rule) error {
+	return rdb.UpdateIfMatch(id, 0, rule)
+}
+
+// UpdateIfMatch saves rule with id only if the rule's current version equals to version,
+// ErrVersionConflict is returned otherwise. Version 0 matches any version.
+func (rdb *RuleDB) UpdateIfMatch(id int, version int, rule *types.Rule) error {
 	if rdb.db == nil {
 		return fmt.Errorf("query on closed db")
 	}
 
+	rdb.writeLock.Lock()
+	defer rdb.writeLock.Unlock()
+
+	current, err := rdb.Get(id)
+	if err != nil {
+		return err
+	}
+	if version != 0 && current.Version != version {
+		return ErrVersionConflict
+	}
+
+	rule.Version = current.Version + 1
 	if err := rdb.col.Update(id, rule.MarshalMap()); err != nil {
 		return err
 	} else {
 		rule.ID = id
+		rdb.index.add(rule)
 		return nil
 	}
 }
 
 func (rdb *RuleDB) Delete(id int) error {
+	return rdb.DeleteIfMatch(id, 0)
+}
+
+// DeleteIfMatch deletes rule with id only if the rule's current version equals to version,
+// ErrVersionConflict is returned otherwise. Version 0 matches any version.
+func (rdb *RuleDB) DeleteIfMatch(id int, version int) error {
 	if rdb.db == nil {
 		return fmt.Errorf("query on closed db")
 	}
 
-	return rdb.col.Delete(id)
+	rdb.writeLock.Lock()
+	defer rdb.writeLock.Unlock()
+
+	if version != 0 {
+		if current, err := rdb.Get(id); err != nil {
+			return err
+		} else if current.Version != version {
+			return ErrVersionConflict
+		}
+	}
+
+	if err := rdb.col.Delete(id); err != nil {
+		return err
+	}
+	rdb.index.remove(id)
+	return nil
+}
+
+// Query fetches rules matching q, using the in memory index. Returns the rules and
+// cursor of the next page, cursor is empty if there are no more rules.
+func (rdb *RuleDB) Query(q *Query) ([]*types.Rule, string, error) {
+	if rdb.db == nil {
+		return nil, "", fmt.Errorf("query on closed db")
+	}
+
+	ids, next, err := rdb.index.query(q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rules := make([]*types.Rule, 0, len(ids))
+	for _, id := range ids {
+		rule, err := rdb.Get(id)
+		if err == ErrNotFound {
+			// deleted after the index was queried
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, next, nil
+}
+
+// Count returns number of rules matching q, Sort, Limit and Cursor are ignored.
+func (rdb *RuleDB) Count(q *Query) (int, error) {
+	if rdb.db == nil {
+		return 0, fmt.Errorf("query on closed db")
+	}
+
+	c := *q
+	c.Sort, c.Limit, c.Cursor = "", 0, ""
+	ids, _, err := rdb.index.query(&c)
+	return len(ids), err
 }
 
 func (rdb *RuleDB) Close() error {
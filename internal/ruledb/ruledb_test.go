@@ -0,0 +1,200 @@
+package ruledb
+
+import (
+	"github.com/openmetric/yamf/internal/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestRuleDB opens a tiedot store in a temporary directory, which is removed by
+// cleanup.
+func openTestRuleDB(t *testing.T) (*RuleDB, func()) {
+	dir, err := ioutil.TempDir("", "yamf-ruledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := NewRuleDB(dir, "yamf")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return rdb, func() {
+		rdb.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// insertTestRule inserts a rule, tiedot generates ids with rand.Int, which are too
+// large for float64 most of the time.
+func insertTestRule(t *testing.T, rdb *RuleDB, name string) *types.Rule {
+	rule := newTestRule(name, nil)
+	if _, err := rdb.Insert(rule); err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func TestTiedotRevisions(t *testing.T) {
+	rdb, cleanup := openTestRuleDB(t)
+	defer cleanup()
+
+	rule := insertTestRule(t, rdb, "load")
+	other := insertTestRule(t, rdb, "other")
+	for _, r := range []*types.Rule{rule, rule, other} {
+		if err := rdb.AddRevision(&types.RuleRevision{RuleID: r.ID, Action: "update", Rule: r}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revs, err := rdb.GetRevisions(rule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[0].Revision != 1 || revs[1].Revision != 2 {
+		t.Fatalf("got %d revisions, want revisions 1 and 2", len(revs))
+	}
+	for _, rev := range revs {
+		if rev.RuleID != rule.ID || rev.Rule.ID != rule.ID {
+			t.Errorf("revision %d has rule id %d and rule %d, want %d", rev.Revision, rev.RuleID, rev.Rule.ID, rule.ID)
+		}
+	}
+
+	rev, err := rdb.GetRevision(rule.ID, 2)
+	if err != nil || rev == nil {
+		t.Fatalf("revision 2 not found, err: %v", err)
+	}
+	if rev, _ = rdb.GetRevision(other.ID, 2); rev != nil {
+		t.Errorf("other rule has revision 2")
+	}
+}
+
+func TestTiedotHeartbeat(t *testing.T) {
+	rdb, cleanup := openTestRuleDB(t)
+	defer cleanup()
+
+	rule := insertTestRule(t, rdb, "cron")
+	if lastSeen, err := rdb.GetHeartbeat(rule.ID); err != nil || !lastSeen.IsZero() {
+		t.Fatalf("never pinged rule has last seen %s, err: %v", lastSeen, err)
+	}
+
+	first := time.Unix(1500000000, 0)
+	second := first.Add(time.Minute)
+	for _, ts := range []time.Time{first, second} {
+		if err := rdb.SetHeartbeat(rule.ID, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastSeen, err := rdb.GetHeartbeat(rule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastSeen.Equal(second) {
+		t.Errorf("last seen is %s, want %s", lastSeen, second)
+	}
+
+	// pings update the rule's record instead of adding new ones
+	n := 0
+	rdb.heartbeats.ForEachDoc(func(id int, data []byte) bool {
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Errorf("got %d heartbeat records, want 1", n)
+	}
+}
+
+func TestTiedotAuditByRule(t *testing.T) {
+	rdb, cleanup := openTestRuleDB(t)
+	defer cleanup()
+
+	rule := insertTestRule(t, rdb, "load")
+	other := insertTestRule(t, rdb, "other")
+	records := []*types.AuditRecord{
+		{Timestamp: types.FromTime(time.Unix(1500000000, 0)), Action: "create", RuleID: rule.ID, After: rule},
+		{Timestamp: types.FromTime(time.Unix(1500000060, 0)), Action: "update", RuleID: rule.ID, Before: rule, After: rule},
+		{Timestamp: types.FromTime(time.Unix(1500000120, 0)), Action: "create", RuleID: other.ID, After: other},
+	}
+	for _, record := range records {
+		if err := rdb.AddAuditRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := rdb.QueryAudit(&AuditQuery{RuleID: rule.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Action != "update" || got[1].Action != "create" {
+		t.Fatalf("got %d records, want update and create of rule %d", len(got), rule.ID)
+	}
+	if got[0].RuleID != rule.ID || got[0].Before.ID != rule.ID || got[0].After.ID != rule.ID {
+		t.Errorf("record has rule ids %d, %d and %d, want %d", got[0].RuleID, got[0].Before.ID, got[0].After.ID, rule.ID)
+	}
+
+	// unfiltered queries read all documents
+	if got, err = rdb.QueryAudit(&AuditQuery{Action: "create"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].RuleID != other.ID || got[1].RuleID != rule.ID {
+		t.Errorf("got %d create records, want ones of rules %d and %d", len(got), other.ID, rule.ID)
+	}
+}
+
+func TestMigrateTiedot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamf-ruledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rdb, err := NewRuleDB(filepath.Join(dir, "tiedot"), "yamf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := insertTestRule(t, rdb, "load")
+	if err = rdb.AddRevision(&types.RuleRevision{RuleID: rule.ID, Action: "create", Rule: rule}); err != nil {
+		t.Fatal(err)
+	}
+	// saved before rule ids were saved as strings
+	legacy := map[string]interface{}{"rule_id": float64(rule.ID), "revision": 2, "action": "update"}
+	if _, err = rdb.revs.Insert(legacy); err != nil {
+		t.Fatal(err)
+	}
+	lastSeen := time.Unix(1500000000, 0)
+	if err = rdb.SetHeartbeat(rule.ID, lastSeen); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	w := &types.MaintenanceWindow{Start: types.FromTime(start), End: types.FromTime(start.Add(time.Hour))}
+	if err = rdb.AddMaintenanceWindow(w); err != nil {
+		t.Fatal(err)
+	}
+	rdb.Close()
+
+	counts, err := MigrateTiedot(filepath.Join(dir, "tiedot"), "yamf", filepath.Join(dir, "rules.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Rules != 1 || counts.Revisions != 2 || counts.MaintenanceWindows != 1 || counts.Heartbeats != 1 {
+		t.Fatalf("unexpected counts: %+v", counts)
+	}
+
+	s, err := NewBoltStore(filepath.Join(dir, "rules.bolt"), "yamf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	revs, err := s.GetRevisions(rule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[0].Rule.ID != rule.ID {
+		t.Fatalf("got %d revisions of rule %d, want 2", len(revs), rule.ID)
+	}
+	if seen, err := s.GetHeartbeat(rule.ID); err != nil || !seen.Equal(lastSeen) {
+		t.Fatalf("heartbeat is %s (err: %v), want %s", seen, err, lastSeen)
+	}
+}
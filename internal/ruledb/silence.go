@@ -0,0 +1,63 @@
+package ruledb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/openmetric/yamf/internal/types"
+	"sort"
+)
+
+func (rdb *RuleDB) GetSilences() ([]*types.Silence, error) {
+	if rdb.db == nil {
+		return nil, fmt.Errorf("query on closed db")
+	}
+
+	silences := make([]*types.Silence, 0)
+	var err error
+	rdb.silences.ForEachDoc(func(id int, data []byte) (moveOn bool) {
+		silence := &types.Silence{}
+		if err = json.Unmarshal(data, silence); err != nil {
+			return false
+		}
+		silence.ID = id
+		silences = append(silences, silence)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(silences, func(i, j int) bool { return silences[i].ID < silences[j].ID })
+	return silences, nil
+}
+
+func (rdb *RuleDB) AddSilence(silence *types.Silence) error {
+	if rdb.db == nil {
+		return fmt.Errorf("query on closed db")
+	}
+
+	doc, err := toDoc(silence)
+	if err != nil {
+		return err
+	}
+	if silence.ID, err = rdb.silences.Insert(doc); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rdb *RuleDB) UpdateSilence(silence *types.Silence) error {
+	if rdb.db == nil {
+		return fmt.Errorf("query on closed db")
+	}
+
+	doc, err := toDoc(silence)
+	if err != nil {
+		return err
+	}
+	if err = rdb.silences.Update(silence.ID, doc); dberr.Type(err) == dberr.ErrorNoDoc {
+		return ErrNotFound
+	}
+	return err
+}
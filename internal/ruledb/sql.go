@@ -0,0 +1,1047 @@
+package ruledb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/openmetric/yamf/internal/types"
+	_ "modernc.org/sqlite"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlDialect holds what differs between the supported sql databases.
+type sqlDialect struct {
+	driver string
+	// column types
+	serial string
+	json   string
+	text   string
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"postgres": {
+		driver: "postgres",
+		serial: "BIGSERIAL PRIMARY KEY",
+		json:   "JSONB",
+		text:   "TEXT",
+	},
+	"mysql": {
+		driver: "mysql",
+		serial: "BIGINT AUTO_INCREMENT PRIMARY KEY",
+		json:   "JSON",
+		text:   "TEXT",
+	},
+	"sqlite": {
+		driver: "sqlite",
+		serial: "INTEGER PRIMARY KEY AUTOINCREMENT",
+		json:   "TEXT",
+		text:   "TEXT",
+	},
+}
+
+// sqlMigrations are applied in order, each one exactly once. The applied version is kept
+// in {prefix}_schema_version. Never modify a released migration, append a new one.
+var sqlMigrations = [][]string{
+	// 1: initial schema
+	{
+		`CREATE TABLE {prefix}_rules (
+			id {serial},
+			namespace VARCHAR(255) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			type VARCHAR(64) NOT NULL,
+			check_spec {json} NOT NULL,
+			metadata {json} NOT NULL,
+			labels {json} NOT NULL,
+			event_identifier_pattern {text} NOT NULL,
+			paused BOOLEAN NOT NULL,
+			check_interval VARCHAR(64) NOT NULL,
+			check_timeout VARCHAR(64) NOT NULL,
+			source VARCHAR(64) NOT NULL,
+			version INTEGER NOT NULL
+		)`,
+		`CREATE INDEX {prefix}_rules_namespace_name ON {prefix}_rules (namespace, name)`,
+		`CREATE TABLE {prefix}_rule_labels (
+			rule_id BIGINT NOT NULL,
+			label_key VARCHAR(255) NOT NULL,
+			label_value VARCHAR(255) NOT NULL,
+			PRIMARY KEY (rule_id, label_key)
+		)`,
+		`CREATE INDEX {prefix}_rule_labels_key_value ON {prefix}_rule_labels (label_key, label_value)`,
+		`CREATE TABLE {prefix}_revisions (
+			rule_id BIGINT NOT NULL,
+			revision INTEGER NOT NULL,
+			doc {json} NOT NULL,
+			PRIMARY KEY (rule_id, revision)
+		)`,
+		`CREATE TABLE {prefix}_audit (
+			id {serial},
+			ts BIGINT NOT NULL,
+			actor VARCHAR(255) NOT NULL,
+			action VARCHAR(64) NOT NULL,
+			rule_id BIGINT NOT NULL,
+			doc {json} NOT NULL
+		)`,
+		`CREATE INDEX {prefix}_audit_ts ON {prefix}_audit (ts)`,
+		`CREATE INDEX {prefix}_audit_rule_id ON {prefix}_audit (rule_id)`,
+		`CREATE TABLE {prefix}_changes (
+			id {serial},
+			ts BIGINT NOT NULL,
+			rule_id BIGINT NOT NULL,
+			action VARCHAR(16) NOT NULL
+		)`,
+	},
+	// 2: maintenance windows
+	{
+		`CREATE TABLE {prefix}_maintenance (
+			id {serial},
+			start_ts BIGINT NOT NULL,
+			end_ts BIGINT NOT NULL,
+			doc {json} NOT NULL
+		)`,
+	},
+	// 3: silences
+	{
+		`CREATE TABLE {prefix}_silences (
+			id {serial},
+			expires_ts BIGINT NOT NULL,
+			doc {json} NOT NULL
+		)`,
+		`CREATE INDEX {prefix}_silences_expires_ts ON {prefix}_silences (expires_ts)`,
+	},
+	// 4: heartbeats
+	{
+		`CREATE TABLE {prefix}_heartbeats (
+			rule_id BIGINT PRIMARY KEY,
+			last_seen_ts BIGINT NOT NULL
+		)`,
+	},
+	// 5: label selectors are matched by the in-memory index, the label table was never read
+	{
+		`DROP TABLE {prefix}_rule_labels`,
+	},
+	// 6: one row per namespace, locked by writers to check max rules
+	{
+		`CREATE TABLE {prefix}_namespaces (
+			namespace VARCHAR(255) PRIMARY KEY
+		)`,
+	},
+}
+
+// how often to poll for changes made by other processes, on postgres changes are also
+// pushed with LISTEN/NOTIFY
+var sqlChangesPollInterval = 5 * time.Second
+
+// how long to keep change records
+const sqlChangesRetention = 24 * time.Hour
+
+// number of change ids before the greatest seen one which are read again on every poll,
+// to catch changes committed out of id order
+const sqlChangesWindow = 1000
+
+// SQLStore is a RuleStore backed by postgres, mysql or sqlite. Multiple schedulers can
+// share the same database, changes made by one of them are reported by Changes() of the
+// others.
+type SQLStore struct {
+	db      *sql.DB
+	dsn     string
+	dialect *sqlDialect
+	prefix  string
+	index   *ruleIndex
+
+	maxRules     map[string]int
+	maxRulesLock sync.RWMutex
+
+	changes     chan RuleChange
+	changesOnce sync.Once
+	stop        chan struct{}
+	listener    *pq.Listener
+}
+
+// NewSQLStore opens database of dbType ("postgres", "mysql" or "sqlite") with dsn, and
+// migrates the schema to the latest version. Table names are prefixed with prefix.
+func NewSQLStore(dbType, dsn, prefix string) (*SQLStore, error) {
+	dialect, ok := sqlDialects[dbType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sql db type: %s", dbType)
+	}
+
+	s := &SQLStore{
+		dsn:     dsn,
+		dialect: dialect,
+		prefix:  prefix,
+		stop:    make(chan struct{}),
+	}
+	var err error
+
+	if s.db, err = sql.Open(dialect.driver, dsn); err != nil {
+		return nil, err
+	}
+	if dbType == "sqlite" {
+		// sqlite does not allow concurrent writers
+		s.db.SetMaxOpenConns(1)
+	}
+	if err = s.migrate(); err != nil {
+		s.db.Close()
+		return nil, fmt.Errorf("failed to migrate database schema: %s", err)
+	}
+	if err = s.buildIndex(); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// q expands table prefix and column types in query, and converts "?" placeholders to
+// the dialect's style.
+func (s *SQLStore) q(query string) string {
+	query = strings.NewReplacer(
+		"{prefix}", s.prefix,
+		"{serial}", s.dialect.serial,
+		"{json}", s.dialect.json,
+		"{text}", s.dialect.text,
+	).Replace(query)
+
+	if s.dialect.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (s *SQLStore) migrate() error {
+	if _, err := s.db.Exec(s.q(`CREATE TABLE IF NOT EXISTS {prefix}_schema_version (version INTEGER NOT NULL)`)); err != nil {
+		return err
+	}
+
+	var current int
+	if err := s.db.QueryRow(s.q(`SELECT COALESCE(MAX(version), 0) FROM {prefix}_schema_version`)).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(sqlMigrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", current, len(sqlMigrations))
+	}
+
+	for i := current; i < len(sqlMigrations); i++ {
+		err := s.inTx(func(tx *sql.Tx) error {
+			for _, stmt := range sqlMigrations[i] {
+				if _, err := tx.Exec(s.q(stmt)); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(s.q(`INSERT INTO {prefix}_schema_version (version) VALUES (?)`), i+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, commits if fn returns nil, rolls back otherwise.
+func (s *SQLStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetMaxRules sets max number of rules of namespaces, namespaces not in maxRules are not
+// limited. Writes which would exceed it fail with ErrQuotaExceeded.
+func (s *SQLStore) SetMaxRules(maxRules map[string]int) {
+	s.maxRulesLock.Lock()
+	s.maxRules = maxRules
+	s.maxRulesLock.Unlock()
+}
+
+// inQuotaTx runs fn in a transaction like inTx, rules may be added to namespaces by fn.
+// Namespaces with max rules are locked first, so writers in all processes sharing the
+// database are serialized, and the transaction fails with ErrQuotaExceeded if fn made
+// any of them grow beyond its max rules.
+func (s *SQLStore) inQuotaTx(namespaces []string, fn func(tx *sql.Tx) error) error {
+	s.maxRulesLock.RLock()
+	limited := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		if s.maxRules[namespace] > 0 {
+			limited = append(limited, namespace)
+		}
+	}
+	maxRules := s.maxRules
+	s.maxRulesLock.RUnlock()
+	// locked in the same order by all writers, so they don't deadlock
+	sort.Strings(limited)
+
+	return s.inTx(func(tx *sql.Tx) error {
+		counts := make(map[string]int, len(limited))
+		for _, namespace := range limited {
+			if _, ok := counts[namespace]; ok {
+				continue
+			}
+			if err := s.lockNamespace(tx, namespace); err != nil {
+				return err
+			}
+			count, err := s.countNamespace(tx, namespace)
+			if err != nil {
+				return err
+			}
+			counts[namespace] = count
+		}
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		for namespace, before := range counts {
+			count, err := s.countNamespace(tx, namespace)
+			if err != nil {
+				return err
+			}
+			// namespaces already beyond a lowered limit can still be modified, as long
+			// as they don't grow
+			if count > maxRules[namespace] && count > before {
+				return ErrQuotaExceeded
+			}
+		}
+		return nil
+	})
+}
+
+// lockNamespace locks row of namespace until the transaction ends, creates the row if it
+// does not exist.
+func (s *SQLStore) lockNamespace(tx *sql.Tx, namespace string) error {
+	upsert := `INSERT INTO {prefix}_namespaces (namespace) VALUES (?) ON CONFLICT (namespace) DO NOTHING`
+	if s.dialect.driver == "mysql" {
+		upsert = `INSERT IGNORE INTO {prefix}_namespaces (namespace) VALUES (?)`
+	}
+	if _, err := tx.Exec(s.q(upsert), namespace); err != nil {
+		return err
+	}
+	if s.dialect.driver == "sqlite" {
+		// sqlite has no row locks, the write above already locked the database
+		return nil
+	}
+	var locked string
+	return tx.QueryRow(s.q(`SELECT namespace FROM {prefix}_namespaces WHERE namespace = ? FOR UPDATE`), namespace).Scan(&locked)
+}
+
+func (s *SQLStore) countNamespace(tx *sql.Tx, namespace string) (int, error) {
+	var count int
+	err := tx.QueryRow(s.q(`SELECT COUNT(*) FROM {prefix}_rules WHERE namespace = ?`), namespace).Scan(&count)
+	return count, err
+}
+
+const sqlRuleColumns = `id, namespace, name, type, check_spec, metadata, labels, event_identifier_pattern, paused, check_interval, check_timeout, source, version`
+
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRule(row sqlScanner) (*types.Rule, error) {
+	var id, version int
+	var namespace, name, typ, check, metadata, labels, pattern, interval, timeout, source string
+	var paused bool
+
+	if err := row.Scan(&id, &namespace, &name, &typ, &check, &metadata, &labels, &pattern, &paused, &interval, &timeout, &source, &version); err != nil {
+		return nil, err
+	}
+
+	doc := map[string]interface{}{
+		"namespace":                namespace,
+		"name":                     name,
+		"type":                     typ,
+		"check":                    json.RawMessage(check),
+		"metadata":                 json.RawMessage(metadata),
+		"labels":                   json.RawMessage(labels),
+		"event_identifier_pattern": pattern,
+		"paused":                   paused,
+		"interval":                 interval,
+		"timeout":                  timeout,
+		"source":                   source,
+		"version":                  version,
+	}
+	rule := &types.Rule{}
+	if err := rule.UnmarshalMap(doc); err != nil {
+		return &types.Rule{ID: id}, err
+	}
+	rule.ID = id
+	setDefaults(rule)
+	return rule, nil
+}
+
+// ruleValues returns column values of rule, in the order of sqlRuleColumns without id.
+func ruleValues(rule *types.Rule) ([]interface{}, error) {
+	check, err := json.Marshal(rule.Check)
+	if err != nil {
+		return nil, err
+	}
+	metadata := rule.Metadata
+	if metadata == nil {
+		metadata = make(types.Metadata)
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	labels := rule.Labels
+	if labels == nil {
+		labels = make(types.Labels)
+	}
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	return []interface{}{
+		rule.Namespace, rule.Name, rule.Type, string(check), string(metadataJSON), string(labelsJSON),
+		rule.EventIdentifierPattern, rule.Paused, rule.Interval.String(), rule.Timeout.String(),
+		rule.Source, rule.Version,
+	}, nil
+}
+
+func (s *SQLStore) buildIndex() error {
+	rules, errors, err := s.GetAll()
+	if err != nil {
+		return err
+	}
+	s.index = newRuleIndex()
+	for i, rule := range rules {
+		if errors[i] == nil {
+			s.index.add(rule)
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) GetAll() ([]*types.Rule, []error, error) {
+	rows, err := s.db.Query(s.q(`SELECT ` + sqlRuleColumns + ` FROM {prefix}_rules ORDER BY id`))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var rules []*types.Rule
+	var errors []error
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if rule == nil {
+			return nil, nil, err
+		}
+		rules = append(rules, rule)
+		errors = append(errors, err)
+	}
+	return rules, errors, rows.Err()
+}
+
+func (s *SQLStore) get(tx *sql.Tx, id int) (*types.Rule, error) {
+	query := s.q(`SELECT ` + sqlRuleColumns + ` FROM {prefix}_rules WHERE id = ?`)
+	var row *sql.Row
+	if tx != nil {
+		row = tx.QueryRow(query, id)
+	} else {
+		row = s.db.QueryRow(query, id)
+	}
+	rule, err := scanRule(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (s *SQLStore) Get(id int) (*types.Rule, error) {
+	return s.get(nil, id)
+}
+
+// recordChange saves a change record for other processes sharing the database.
+func (s *SQLStore) recordChange(tx *sql.Tx, id int, action string) error {
+	_, err := tx.Exec(s.q(`INSERT INTO {prefix}_changes (ts, rule_id, action) VALUES (?, ?, ?)`), time.Now().UnixNano(), id, action)
+	if err == nil && s.dialect.driver == "postgres" {
+		// delivered when the transaction commits
+		_, err = tx.Exec(`SELECT pg_notify($1, '')`, s.prefix+"_changes")
+	}
+	return err
+}
+
+func (s *SQLStore) insert(tx *sql.Tx, rule *types.Rule) (int, error) {
+	var id int
+	rule.Version = 1
+	values, err := ruleValues(rule)
+	if err != nil {
+		return 0, err
+	}
+
+	insert := `INSERT INTO {prefix}_rules (namespace, name, type, check_spec, metadata, labels, event_identifier_pattern, paused, check_interval, check_timeout, source, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if s.dialect.driver == "postgres" {
+		if err = tx.QueryRow(s.q(insert+` RETURNING id`), values...).Scan(&id); err != nil {
+			return 0, err
+		}
+	} else {
+		result, err := tx.Exec(s.q(insert), values...)
+		if err != nil {
+			return 0, err
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		id = int(lastID)
+	}
+	return id, s.recordChange(tx, id, "create")
+}
+
+func (s *SQLStore) update(tx *sql.Tx, id int, version int, rule *types.Rule) error {
+	current, err := s.get(tx, id)
+	if err != nil {
+		return err
+	}
+	if version != 0 && current.Version != version {
+		return ErrVersionConflict
+	}
+
+	rule.Version = current.Version + 1
+	values, err := ruleValues(rule)
+	if err != nil {
+		return err
+	}
+	// the version condition guards against concurrent writers in other processes
+	result, err := tx.Exec(s.q(`UPDATE {prefix}_rules SET namespace = ?, name = ?, type = ?, check_spec = ?, metadata = ?, labels = ?, event_identifier_pattern = ?, paused = ?, check_interval = ?, check_timeout = ?, source = ?, version = ? WHERE id = ? AND version = ?`),
+		append(values, id, current.Version)...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrVersionConflict
+	}
+	return s.recordChange(tx, id, "update")
+}
+
+func (s *SQLStore) delete(tx *sql.Tx, id int, version int) error {
+	current, err := s.get(tx, id)
+	if err != nil {
+		return err
+	}
+	if version != 0 && current.Version != version {
+		return ErrVersionConflict
+	}
+
+	result, err := tx.Exec(s.q(`DELETE FROM {prefix}_rules WHERE id = ? AND version = ?`), id, current.Version)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrVersionConflict
+	}
+	return s.recordChange(tx, id, "delete")
+}
+
+func (s *SQLStore) Insert(rule *types.Rule) (int, error) {
+	var id int
+	err := s.inQuotaTx([]string{rule.Namespace}, func(tx *sql.Tx) error {
+		var err error
+		id, err = s.insert(tx, rule)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	rule.ID = id
+	s.index.add(rule)
+	return id, nil
+}
+
+func (s *SQLStore) Update(id int, rule *types.Rule) error {
+	return s.UpdateIfMatch(id, 0, rule)
+}
+
+func (s *SQLStore) UpdateIfMatch(id int, version int, rule *types.Rule) error {
+	err := s.inQuotaTx([]string{rule.Namespace}, func(tx *sql.Tx) error {
+		return s.update(tx, id, version, rule)
+	})
+	if err != nil {
+		return err
+	}
+	rule.ID = id
+	s.index.add(rule)
+	return nil
+}
+
+func (s *SQLStore) Delete(id int) error {
+	return s.DeleteIfMatch(id, 0)
+}
+
+func (s *SQLStore) DeleteIfMatch(id int, version int) error {
+	err := s.inTx(func(tx *sql.Tx) error {
+		return s.delete(tx, id, version)
+	})
+	if err != nil {
+		return err
+	}
+	s.index.remove(id)
+	return nil
+}
+
+// ApplyBatch applies all ops in a single transaction.
+func (s *SQLStore) ApplyBatch(ops []*RuleOp) error {
+	var namespaces []string
+	for _, op := range ops {
+		if op.Action == "create" || op.Action == "update" {
+			namespaces = append(namespaces, op.Rule.Namespace)
+		}
+	}
+	err := s.inQuotaTx(namespaces, func(tx *sql.Tx) error {
+		for _, op := range ops {
+			var err error
+			switch op.Action {
+			case "create":
+				op.ID, err = s.insert(tx, op.Rule)
+			case "update":
+				err = s.update(tx, op.ID, op.Version, op.Rule)
+			case "delete":
+				err = s.delete(tx, op.ID, op.Version)
+			default:
+				err = fmt.Errorf("unsupported batch action: %s", op.Action)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.index.applyOps(ops)
+	return nil
+}
+
+func (s *SQLStore) Query(q *Query) ([]*types.Rule, string, error) {
+	ids, next, err := s.index.query(q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rules := make([]*types.Rule, 0, len(ids))
+	for _, id := range ids {
+		rule, err := s.Get(id)
+		if err == ErrNotFound {
+			// deleted by another process, index is not updated yet
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, next, nil
+}
+
+func (s *SQLStore) Count(q *Query) (int, error) {
+	c := *q
+	c.Sort, c.Limit, c.Cursor = "", 0, ""
+	ids, _, err := s.index.query(&c)
+	return len(ids), err
+}
+
+func (s *SQLStore) AddRevision(rev *types.RuleRevision) error {
+	// retry if another process added a revision of the same rule concurrently
+	var err error
+	for i := 0; i < 3; i++ {
+		err = s.inTx(func(tx *sql.Tx) error {
+			var last int
+			if err := tx.QueryRow(s.q(`SELECT COALESCE(MAX(revision), 0) FROM {prefix}_revisions WHERE rule_id = ?`), rev.RuleID).Scan(&last); err != nil {
+				return err
+			}
+			rev.Revision = last + 1
+
+			doc, err := json.Marshal(rev)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(s.q(`INSERT INTO {prefix}_revisions (rule_id, revision, doc) VALUES (?, ?, ?)`), rev.RuleID, rev.Revision, string(doc))
+			return err
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *SQLStore) GetRevisions(ruleID int) ([]*types.RuleRevision, error) {
+	rows, err := s.db.Query(s.q(`SELECT doc FROM {prefix}_revisions WHERE rule_id = ? ORDER BY revision`), ruleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := make([]*types.RuleRevision, 0)
+	for rows.Next() {
+		var doc string
+		if err = rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		rev := &types.RuleRevision{}
+		if err = json.Unmarshal([]byte(doc), rev); err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+func (s *SQLStore) GetRevision(ruleID, revision int) (*types.RuleRevision, error) {
+	var doc string
+	err := s.db.QueryRow(s.q(`SELECT doc FROM {prefix}_revisions WHERE rule_id = ? AND revision = ?`), ruleID, revision).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rev := &types.RuleRevision{}
+	if err = json.Unmarshal([]byte(doc), rev); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+func (s *SQLStore) AddAuditRecord(record *types.AuditRecord) error {
+	doc, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.q(`INSERT INTO {prefix}_audit (ts, actor, action, rule_id, doc) VALUES (?, ?, ?, ?, ?)`),
+		record.Timestamp.UnixNano(), record.Actor, record.Action, record.RuleID, string(doc))
+	return err
+}
+
+func (s *SQLStore) QueryAudit(q *AuditQuery) ([]*types.AuditRecord, error) {
+	var conds []string
+	var args []interface{}
+	if q.Actor != "" {
+		conds, args = append(conds, "actor = ?"), append(args, q.Actor)
+	}
+	if q.Action != "" {
+		conds, args = append(conds, "action = ?"), append(args, q.Action)
+	}
+	if q.RuleID != 0 {
+		conds, args = append(conds, "rule_id = ?"), append(args, q.RuleID)
+	}
+	if !q.From.IsZero() {
+		conds, args = append(conds, "ts >= ?"), append(args, q.From.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		conds, args = append(conds, "ts <= ?"), append(args, q.Until.UnixNano())
+	}
+
+	query := `SELECT doc FROM {prefix}_audit`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY ts DESC, id DESC"
+	if q.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(q.Limit)
+	}
+
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*types.AuditRecord
+	for rows.Next() {
+		var doc string
+		if err = rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		record := &types.AuditRecord{}
+		if err = json.Unmarshal([]byte(doc), record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLStore) GetMaintenanceWindows() ([]*types.MaintenanceWindow, error) {
+	rows, err := s.db.Query(s.q(`SELECT id, doc FROM {prefix}_maintenance ORDER BY id`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	windows := make([]*types.MaintenanceWindow, 0)
+	for rows.Next() {
+		var id int
+		var doc string
+		if err = rows.Scan(&id, &doc); err != nil {
+			return nil, err
+		}
+		w := &types.MaintenanceWindow{}
+		if err = json.Unmarshal([]byte(doc), w); err != nil {
+			return nil, err
+		}
+		w.ID = id
+		windows = append(windows, w)
+	}
+	return windows, rows.Err()
+}
+
+func (s *SQLStore) AddMaintenanceWindow(w *types.MaintenanceWindow) error {
+	doc, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	insert := `INSERT INTO {prefix}_maintenance (start_ts, end_ts, doc) VALUES (?, ?, ?)`
+	values := []interface{}{w.Start.UnixNano(), w.End.UnixNano(), string(doc)}
+	if s.dialect.driver == "postgres" {
+		return s.db.QueryRow(s.q(insert+` RETURNING id`), values...).Scan(&w.ID)
+	}
+	result, err := s.db.Exec(s.q(insert), values...)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	w.ID = int(id)
+	return err
+}
+
+func (s *SQLStore) DeleteMaintenanceWindow(id int) error {
+	result, err := s.db.Exec(s.q(`DELETE FROM {prefix}_maintenance WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) GetSilences() ([]*types.Silence, error) {
+	rows, err := s.db.Query(s.q(`SELECT id, doc FROM {prefix}_silences ORDER BY id`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	silences := make([]*types.Silence, 0)
+	for rows.Next() {
+		var id int
+		var doc string
+		if err = rows.Scan(&id, &doc); err != nil {
+			return nil, err
+		}
+		silence := &types.Silence{}
+		if err = json.Unmarshal([]byte(doc), silence); err != nil {
+			return nil, err
+		}
+		silence.ID = id
+		silences = append(silences, silence)
+	}
+	return silences, rows.Err()
+}
+
+func (s *SQLStore) AddSilence(silence *types.Silence) error {
+	doc, err := json.Marshal(silence)
+	if err != nil {
+		return err
+	}
+
+	insert := `INSERT INTO {prefix}_silences (expires_ts, doc) VALUES (?, ?)`
+	values := []interface{}{silence.ExpiresAt.UnixNano(), string(doc)}
+	if s.dialect.driver == "postgres" {
+		return s.db.QueryRow(s.q(insert+` RETURNING id`), values...).Scan(&silence.ID)
+	}
+	result, err := s.db.Exec(s.q(insert), values...)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	silence.ID = int(id)
+	return err
+}
+
+func (s *SQLStore) UpdateSilence(silence *types.Silence) error {
+	doc, err := json.Marshal(silence)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(s.q(`UPDATE {prefix}_silences SET expires_ts = ?, doc = ? WHERE id = ?`), silence.ExpiresAt.UnixNano(), string(doc), silence.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) GetHeartbeat(ruleID int) (time.Time, error) {
+	var ts int64
+	err := s.db.QueryRow(s.q(`SELECT last_seen_ts FROM {prefix}_heartbeats WHERE rule_id = ?`), ruleID).Scan(&ts)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ts), nil
+}
+
+func (s *SQLStore) SetHeartbeat(ruleID int, lastSeen time.Time) error {
+	upsert := `INSERT INTO {prefix}_heartbeats (rule_id, last_seen_ts) VALUES (?, ?)
+		ON CONFLICT (rule_id) DO UPDATE SET last_seen_ts = excluded.last_seen_ts`
+	if s.dialect.driver == "mysql" {
+		upsert = `INSERT INTO {prefix}_heartbeats (rule_id, last_seen_ts) VALUES (?, ?)
+			ON DUPLICATE KEY UPDATE last_seen_ts = VALUES(last_seen_ts)`
+	}
+	_, err := s.db.Exec(s.q(upsert), ruleID, lastSeen.UnixNano())
+	return err
+}
+
+// Changes returns a channel of changes made to rules, by this or other processes sharing
+// the database. The in memory index is updated before a change is sent. The channel must
+// be consumed, it's closed when the store is closed.
+func (s *SQLStore) Changes() <-chan RuleChange {
+	s.changesOnce.Do(func() {
+		s.changes = make(chan RuleChange)
+
+		var notify <-chan *pq.Notification
+		if s.dialect.driver == "postgres" {
+			s.listener = pq.NewListener(s.dsn, time.Second, time.Minute, nil)
+			if err := s.listener.Listen(s.prefix + "_changes"); err == nil {
+				notify = s.listener.Notify
+			}
+		}
+
+		// changes before this call are not reported. Ids are taken from a sequence before
+		// commit, so a change may become visible after changes with greater ids were
+		// read, a trailing window of ids is read again on every poll and seen ids are
+		// skipped.
+		var last int64
+		if err := s.db.QueryRow(s.q(`SELECT COALESCE(MAX(id), 0) FROM {prefix}_changes`)).Scan(&last); err != nil {
+			close(s.changes)
+			return
+		}
+		seen := make(map[int64]bool)
+		if existing, err := s.fetchChanges(last - sqlChangesWindow); err == nil {
+			for _, change := range existing {
+				seen[change.seq] = true
+			}
+		}
+
+		go s.watchChanges(notify, last, seen)
+	})
+	return s.changes
+}
+
+func (s *SQLStore) watchChanges(notify <-chan *pq.Notification, last int64, seen map[int64]bool) {
+	defer close(s.changes)
+
+	ticker := time.NewTicker(sqlChangesPollInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-notify:
+		case <-s.stop:
+			return
+		}
+
+		changes, err := s.fetchChanges(last - sqlChangesWindow)
+		if err != nil {
+			continue
+		}
+		for _, change := range changes {
+			if seen[change.seq] {
+				continue
+			}
+			seen[change.seq] = true
+			if change.seq > last {
+				last = change.seq
+			}
+			if rule, err := s.Get(change.RuleID); err == ErrNotFound {
+				s.index.remove(change.RuleID)
+			} else if err == nil {
+				s.index.add(rule)
+			}
+			select {
+			case s.changes <- change.RuleChange:
+			case <-s.stop:
+				return
+			}
+		}
+		for seq := range seen {
+			if seq <= last-sqlChangesWindow {
+				delete(seen, seq)
+			}
+		}
+
+		if time.Since(lastPrune) > time.Hour {
+			lastPrune = time.Now()
+			s.db.Exec(s.q(`DELETE FROM {prefix}_changes WHERE ts < ?`), time.Now().Add(-sqlChangesRetention).UnixNano())
+		}
+	}
+}
+
+type sqlChange struct {
+	RuleChange
+	seq int64
+}
+
+func (s *SQLStore) fetchChanges(after int64) ([]sqlChange, error) {
+	rows, err := s.db.Query(s.q(`SELECT id, rule_id, action FROM {prefix}_changes WHERE id > ? ORDER BY id`), after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []sqlChange
+	for rows.Next() {
+		var c sqlChange
+		if err = rows.Scan(&c.seq, &c.RuleID, &c.Action); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (s *SQLStore) Close() error {
+	close(s.stop)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	return s.db.Close()
+}
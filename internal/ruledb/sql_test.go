@@ -0,0 +1,333 @@
+package ruledb
+
+import (
+	"github.com/openmetric/yamf/internal/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSQLiteDSN waits for locks, the change feed tests open two stores on one file.
+func testSQLiteDSN(dir string) string {
+	return "file:" + filepath.Join(dir, "rules.db") + "?_pragma=busy_timeout(5000)"
+}
+
+// openTestSQLStore opens a sqlite store in a temporary directory, returns the store and
+// the directory, which is removed by cleanup.
+func openTestSQLStore(t *testing.T) (*SQLStore, string, func()) {
+	dir, err := ioutil.TempDir("", "yamf-ruledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLStore("sqlite", testSQLiteDSN(dir), "yamf")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestRule(name string, labels types.Labels) *types.Rule {
+	critical, _ := types.NewThresholdExpression("> 10")
+	warning, _ := types.NewThresholdExpression("> 5")
+	return &types.Rule{
+		Namespace: types.DefaultNamespace,
+		Name:      name,
+		Type:      "graphite",
+		Check: &types.GraphiteCheck{
+			GraphiteURL:        "http://graphite",
+			Query:              "servers.*.load",
+			From:               "-5min",
+			Until:              "now",
+			CriticalExpression: *critical,
+			WarningExpression:  *warning,
+		},
+		Metadata:               types.Metadata{},
+		Labels:                 labels,
+		EventIdentifierPattern: "load",
+		Interval:               types.FromDuration(time.Minute),
+		Timeout:                types.FromDuration(10 * time.Second),
+	}
+}
+
+func TestSQLMigrations(t *testing.T) {
+	s, dir, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	var version int
+	if err := s.db.QueryRow(s.q(`SELECT MAX(version) FROM {prefix}_schema_version`)).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqlMigrations) {
+		t.Fatalf("schema version is %d, want %d", version, len(sqlMigrations))
+	}
+
+	// reopening applies nothing
+	again, err := NewSQLStore("sqlite", testSQLiteDSN(dir), "yamf")
+	if err != nil {
+		t.Fatalf("failed to reopen: %s", err)
+	}
+	again.Close()
+}
+
+func TestSQLCRUD(t *testing.T) {
+	s, _, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	id, err := s.Insert(newTestRule("load", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Name != "load" || rule.Version != 1 || rule.Check.(*types.GraphiteCheck).Query != "servers.*.load" {
+		t.Fatalf("unexpected rule: %+v", rule)
+	}
+
+	rule.Name = "load2"
+	if err = s.Update(id, rule); err != nil {
+		t.Fatal(err)
+	}
+	if rule, err = s.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Name != "load2" || rule.Version != 2 {
+		t.Fatalf("unexpected rule after update: %+v", rule)
+	}
+
+	rules, errors, err := s.GetAll()
+	if err != nil || len(rules) != 1 || errors[0] != nil {
+		t.Fatalf("GetAll returned %d rules, err: %v", len(rules), err)
+	}
+
+	if err = s.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(id); err != ErrNotFound {
+		t.Fatalf("Get after delete returned %v, want ErrNotFound", err)
+	}
+	if err = s.Delete(id); err != ErrNotFound {
+		t.Fatalf("second delete returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestSQLVersionConflict(t *testing.T) {
+	s, _, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	rule := newTestRule("load", nil)
+	id, err := s.Insert(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.UpdateIfMatch(id, 1, rule); err != nil {
+		t.Fatalf("update with current version failed: %s", err)
+	}
+	if err = s.UpdateIfMatch(id, 1, rule); err != ErrVersionConflict {
+		t.Fatalf("update with stale version returned %v, want ErrVersionConflict", err)
+	}
+	if err = s.DeleteIfMatch(id, 1); err != ErrVersionConflict {
+		t.Fatalf("delete with stale version returned %v, want ErrVersionConflict", err)
+	}
+	if err = s.DeleteIfMatch(id, 2); err != nil {
+		t.Fatalf("delete with current version failed: %s", err)
+	}
+}
+
+func TestSQLLabelQuery(t *testing.T) {
+	s, _, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	for _, rule := range []*types.Rule{
+		newTestRule("a", types.Labels{"team": "infra", "env": "prod"}),
+		newTestRule("b", types.Labels{"team": "infra", "env": "dev"}),
+		newTestRule("c", types.Labels{"team": "web", "env": "prod"}),
+	} {
+		if _, err := s.Insert(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for str, want := range map[string][]string{
+		"team=infra":          {"a", "b"},
+		"team=infra,env=prod": {"a"},
+		"env=prod":            {"a", "c"},
+		"team=db":             {},
+	} {
+		selector, err := types.ParseLabelSelector(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, _, err := s.Query(&Query{Selector: selector, Sort: "name"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, rule := range rules {
+			names = append(names, rule.Name)
+		}
+		if len(names) != len(want) {
+			t.Fatalf("query %s returned %v, want %v", str, names, want)
+		}
+		for i := range want {
+			if names[i] != want[i] {
+				t.Fatalf("query %s returned %v, want %v", str, names, want)
+			}
+		}
+	}
+}
+
+func TestSQLApplyBatchRollback(t *testing.T) {
+	s, _, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	existing := newTestRule("existing", nil)
+	id, err := s.Insert(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.ApplyBatch([]*RuleOp{
+		{Action: "create", Rule: newTestRule("new", nil)},
+		{Action: "update", ID: id, Version: 1, Rule: newTestRule("renamed", nil)},
+		{Action: "delete", ID: id + 100},
+	})
+	if err != ErrNotFound {
+		t.Fatalf("batch returned %v, want ErrNotFound", err)
+	}
+
+	rules, _, err := s.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Name != "existing" || rules[0].Version != 1 {
+		t.Fatalf("batch was not rolled back, rules: %+v", rules)
+	}
+	if n, _ := s.Count(&Query{}); n != 1 {
+		t.Fatalf("index has %d rules after rollback, want 1", n)
+	}
+}
+
+func TestSQLMaxRules(t *testing.T) {
+	first, dir, cleanup := openTestSQLStore(t)
+	defer cleanup()
+	// a second scheduler sharing the database, its index does not know rules of the first
+	second, err := NewSQLStore("sqlite", testSQLiteDSN(dir), "yamf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	maxRules := map[string]int{types.DefaultNamespace: 2}
+	first.SetMaxRules(maxRules)
+	second.SetMaxRules(maxRules)
+
+	if _, err = first.Insert(newTestRule("a", nil)); err != nil {
+		t.Fatal(err)
+	}
+	id, err := second.Insert(newTestRule("b", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = first.Insert(newTestRule("c", nil)); err != ErrQuotaExceeded {
+		t.Fatalf("insert beyond max rules returned %v, want ErrQuotaExceeded", err)
+	}
+	err = second.ApplyBatch([]*RuleOp{{Action: "create", Rule: newTestRule("c", nil)}})
+	if err != ErrQuotaExceeded {
+		t.Fatalf("batch beyond max rules returned %v, want ErrQuotaExceeded", err)
+	}
+	if rules, _, _ := first.GetAll(); len(rules) != 2 {
+		t.Fatalf("namespace has %d rules, want 2", len(rules))
+	}
+
+	// updates in a full namespace, and batches which don't grow it, are allowed
+	if err = second.Update(id, newTestRule("renamed", nil)); err != nil {
+		t.Fatalf("update in full namespace failed: %s", err)
+	}
+	err = second.ApplyBatch([]*RuleOp{
+		{Action: "delete", ID: id},
+		{Action: "create", Rule: newTestRule("d", nil)},
+	})
+	if err != nil {
+		t.Fatalf("batch replacing a rule failed: %s", err)
+	}
+}
+
+func TestSQLChanges(t *testing.T) {
+	interval := sqlChangesPollInterval
+	sqlChangesPollInterval = 50 * time.Millisecond
+	defer func() { sqlChangesPollInterval = interval }()
+
+	writer, dir, cleanup := openTestSQLStore(t)
+	defer cleanup()
+	reader, err := NewSQLStore("sqlite", testSQLiteDSN(dir), "yamf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	changes := reader.Changes()
+
+	next := func() RuleChange {
+		select {
+		case change := <-changes:
+			return change
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for change")
+		}
+		return RuleChange{}
+	}
+
+	id, err := writer.Insert(newTestRule("load", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change := next(); change.RuleID != id || change.Action != "create" {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	if _, err = reader.Get(id); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := reader.Count(&Query{}); n != 1 {
+		t.Fatalf("reader index has %d rules, want 1", n)
+	}
+
+	if err = writer.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if change := next(); change.RuleID != id || change.Action != "delete" {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	if n, _ := reader.Count(&Query{}); n != 0 {
+		t.Fatalf("reader index has %d rules, want 0", n)
+	}
+
+	// a change committed after one with a greater id is still reported, once
+	var last int64
+	if err = writer.db.QueryRow(writer.q(`SELECT MAX(id) FROM {prefix}_changes`)).Scan(&last); err != nil {
+		t.Fatal(err)
+	}
+	insert := writer.q(`INSERT INTO {prefix}_changes (id, ts, rule_id, action) VALUES (?, ?, ?, ?)`)
+	if _, err = writer.db.Exec(insert, last+5, time.Now().UnixNano(), 1001, "update"); err != nil {
+		t.Fatal(err)
+	}
+	if change := next(); change.RuleID != 1001 {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	if _, err = writer.db.Exec(insert, last+2, time.Now().UnixNano(), 1002, "update"); err != nil {
+		t.Fatal(err)
+	}
+	if change := next(); change.RuleID != 1002 {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	select {
+	case change := <-changes:
+		t.Fatalf("change reported twice: %+v", change)
+	case <-time.After(4 * sqlChangesPollInterval):
+	}
+}
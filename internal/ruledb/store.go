@@ -0,0 +1,112 @@
+package ruledb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	"time"
+)
+
+// ErrNotFound is returned when the requested rule does not exist.
+var ErrNotFound = errors.New("rule not found")
+
+// ErrVersionConflict is returned when a rule is modified with a stale version.
+var ErrVersionConflict = errors.New("rule version conflict")
+
+// ErrQuotaExceeded is returned when a write would make a namespace have more rules than
+// allowed by SetMaxRules.
+var ErrQuotaExceeded = errors.New("namespace max rules exceeded")
+
+// RuleStore stores rules, together with their revision history and audit records.
+type RuleStore interface {
+	// GetAll returns all rules, rules which can not be decoded are returned with only
+	// ID set, and the error at the same index in the second return value.
+	GetAll() ([]*types.Rule, []error, error)
+	Get(id int) (*types.Rule, error)
+	Insert(rule *types.Rule) (int, error)
+	// Update saves rule with id, and increases its version.
+	Update(id int, rule *types.Rule) error
+	// UpdateIfMatch saves rule with id only if the rule's current version equals to
+	// version, ErrVersionConflict is returned otherwise. Version 0 matches any version.
+	UpdateIfMatch(id int, version int, rule *types.Rule) error
+	Delete(id int) error
+	DeleteIfMatch(id int, version int) error
+	// Query fetches rules matching q, returns the rules and cursor of the next page,
+	// cursor is empty if there are no more rules.
+	Query(q *Query) ([]*types.Rule, string, error)
+	// Count returns number of rules matching q, Sort, Limit and Cursor are ignored.
+	Count(q *Query) (int, error)
+
+	// AddRevision appends a revision to history of rev.RuleID, revision number is
+	// assigned automatically.
+	AddRevision(rev *types.RuleRevision) error
+	// GetRevisions returns history of a rule, oldest revision first.
+	GetRevisions(ruleID int) ([]*types.RuleRevision, error)
+	// GetRevision returns a single revision of a rule, nil if it does not exist.
+	GetRevision(ruleID, revision int) (*types.RuleRevision, error)
+
+	AddAuditRecord(record *types.AuditRecord) error
+	// QueryAudit returns audit records matching q, newest first.
+	QueryAudit(q *AuditQuery) ([]*types.AuditRecord, error)
+
+	// GetMaintenanceWindows returns all maintenance windows, ordered by id.
+	GetMaintenanceWindows() ([]*types.MaintenanceWindow, error)
+	// AddMaintenanceWindow saves a new maintenance window, and sets its id.
+	AddMaintenanceWindow(w *types.MaintenanceWindow) error
+	// DeleteMaintenanceWindow deletes a maintenance window, ErrNotFound is returned if it
+	// does not exist.
+	DeleteMaintenanceWindow(id int) error
+
+	// GetSilences returns all silences, ordered by id.
+	GetSilences() ([]*types.Silence, error)
+	// AddSilence saves a new silence, and sets its id.
+	AddSilence(silence *types.Silence) error
+	// UpdateSilence saves an existing silence, ErrNotFound is returned if it does not exist.
+	UpdateSilence(silence *types.Silence) error
+
+	// GetHeartbeat returns time of the last ping of a heartbeat rule, zero if it was
+	// never pinged.
+	GetHeartbeat(ruleID int) (time.Time, error)
+	// SetHeartbeat saves time of the last ping of a heartbeat rule.
+	SetHeartbeat(ruleID int, lastSeen time.Time) error
+
+	Close() error
+}
+
+// RuleChange tells that a rule was created, updated or deleted.
+type RuleChange struct {
+	RuleID int
+	// "create", "update" or "delete"
+	Action string
+}
+
+// ChangeNotifier is implemented by stores which can be shared by multiple processes, to
+// report changes made by any of them.
+type ChangeNotifier interface {
+	Changes() <-chan RuleChange
+}
+
+// QuotaEnforcer is implemented by stores which can be shared by multiple processes, to
+// check max rules of namespaces in the same transaction as the writes.
+type QuotaEnforcer interface {
+	// SetMaxRules sets max number of rules of namespaces, namespaces not in maxRules
+	// are not limited.
+	SetMaxRules(maxRules map[string]int)
+}
+
+// Open opens a rule store. For "tiedot", path is the database directory and collection
+// is the collection name. For "bolt", path is the database file and collection is the
+// bucket name. For "postgres", "mysql" and "sqlite", path is the data source name and
+// collection is the table name prefix.
+func Open(dbType, path, collection string) (RuleStore, error) {
+	switch dbType {
+	case "", "tiedot":
+		return NewRuleDB(path, collection)
+	case "bolt":
+		return NewBoltStore(path, collection)
+	case "postgres", "mysql", "sqlite":
+		return NewSQLStore(dbType, path, collection)
+	default:
+		return nil, fmt.Errorf("unsupported db type: %s", dbType)
+	}
+}
@@ -0,0 +1,19 @@
+package types
+
+// AuditRecord records a mutation (or an attempt) made to rules.
+type AuditRecord struct {
+	Timestamp Time   `json:"timestamp"`
+	Actor     string `json:"actor"`
+	SourceIP  string `json:"source_ip"`
+	// create, update, pause, resume, delete or restore
+	Action string `json:"action"`
+	RuleID int    `json:"rule_id"`
+
+	Before *Rule `json:"before"`
+	After  *Rule `json:"after"`
+
+	// result of the request
+	Success bool   `json:"success"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
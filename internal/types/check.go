@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 // pattern used to parse threshold expression
@@ -47,6 +48,249 @@ type GraphiteCheck struct {
 	// it's apparently no sense if there are too many null values. If there are more then
 	// 'MaxNullPoints' null values in the end, the value will be considered as null.
 	MaxNullPoints int `json:"max_null_points"`
+
+	// If set, status is decided by how far the last value deviates from the value
+	// expected by a seasonal model, instead of the threshold expressions.
+	Baseline *BaselineConfig `json:"baseline,omitempty"`
+
+	// If set, the query is fetched again shifted back by each offset, and threshold
+	// expressions are evaluated on how the last value compares with the shifted ones.
+	Compare *CompareConfig `json:"compare,omitempty"`
+
+	// Instead of Query, several named queries can be combined with Expression, e.g.
+	// queries "errors" and "requests" with expression "errors / requests * 100".
+	// Series of the queries are joined on the metadata keys JoinKeys, extracted with
+	// each query's pattern, and threshold expressions are evaluated on the combined
+	// value. Without JoinKeys, each query must return a single series.
+	Queries    []*NamedQuery    `json:"queries,omitempty"`
+	Expression *ArithExpression `json:"expression,omitempty"`
+	JoinKeys   []string         `json:"join_keys,omitempty"`
+
+	// If set, series seen by earlier executions but missing from the response are
+	// reported as absent, so hosts which stopped reporting don't go silent.
+	Absent *AbsentConfig `json:"absent,omitempty"`
+	// If set, an extra event is emitted with the number of returned series as value.
+	SeriesCount *SeriesCountConfig `json:"series_count,omitempty"`
+}
+
+// AbsentConfig configures reporting of series which disappeared from a check's response.
+// Series seen before are the rule's states in processor, so executors need processor_url,
+// and it works no matter which executor runs the tasks.
+type AbsentConfig struct {
+	// how long a series may be missing before it's reported, defaults to 5m
+	GracePeriod Duration `json:"grace_period"`
+	// status of absent events, "unknown" (default) or "critical"
+	Status string `json:"status"`
+	// how long a missing series is reported before it's forgotten, defaults to 24h
+	Forget Duration `json:"forget"`
+}
+
+// Validate checks the config, and sets defaults.
+func (c *AbsentConfig) Validate() error {
+	if c.GracePeriod.Duration == 0 {
+		c.GracePeriod = FromDuration(5 * time.Minute)
+	}
+	if c.Forget.Duration == 0 {
+		c.Forget = FromDuration(24 * time.Hour)
+	}
+	if c.GracePeriod.Duration < 0 || c.Forget.Duration <= c.GracePeriod.Duration {
+		return fmt.Errorf("absent `forget` must be longer than `grace_period`")
+	}
+	switch c.Status {
+	case "":
+		c.Status = "unknown"
+	case "unknown", "critical":
+	default:
+		return fmt.Errorf("unsupported absent status: %s", c.Status)
+	}
+	return nil
+}
+
+// StatusCode returns the event status of absent series.
+func (c *AbsentConfig) StatusCode() int {
+	if c.Status == "critical" {
+		return Critical
+	}
+	return Unknown
+}
+
+// SeriesCountConfig configures the series count event of GraphiteCheck, e.g. with critical
+// expression "< 10", it's critical if less than 10 of a cluster's hosts are reporting.
+type SeriesCountConfig struct {
+	// identifier of the series count event, defaults to "rule-{rule id}-series-count"
+	Identifier         string              `json:"identifier"`
+	CriticalExpression ThresholdExpression `json:"critical_expression"`
+	WarningExpression  ThresholdExpression `json:"warning_expression"`
+}
+
+// NamedQuery is a query of a multi-query GraphiteCheck, empty GraphiteURL, From, Until and
+// MetadataExtractPattern default to the check's.
+type NamedQuery struct {
+	Name                   string `json:"name"`
+	GraphiteURL            string `json:"graphite_url"`
+	Query                  string `json:"query"`
+	From                   string `json:"from"`
+	Until                  string `json:"until"`
+	MetadataExtractPattern string `json:"metadata_extract_pattern"`
+}
+
+// compare modes
+const (
+	// current / previous
+	CompareRatio = "ratio"
+	// current - previous
+	CompareDifference = "difference"
+)
+
+// CompareConfig configures comparison of GraphiteCheck with the past, e.g. with offset
+// "168h", mode "ratio" and critical expression "< 0.7", it's critical if the value is 30%
+// lower than the same time last week.
+type CompareConfig struct {
+	Offsets []Duration `json:"offsets"`
+	// "ratio" (default) or "difference"
+	Mode string `json:"mode"`
+	// how values of multiple offsets are combined into the previous value, "avg"
+	// (default), "min", "max" or "median"
+	Aggregate string `json:"aggregate"`
+	// metadata keys to pair current and shifted series with, series are paired by name
+	// if empty
+	MatchKeys []string `json:"match_keys"`
+}
+
+func (c *CompareConfig) Validate() error {
+	if len(c.Offsets) == 0 {
+		return fmt.Errorf("compare `offsets` is required")
+	}
+	for _, offset := range c.Offsets {
+		if offset.Duration <= 0 {
+			return fmt.Errorf("compare offsets must be positive")
+		}
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = CompareRatio
+	case CompareRatio, CompareDifference:
+	default:
+		return fmt.Errorf("unsupported compare mode: %s", c.Mode)
+	}
+	switch c.Aggregate {
+	case "":
+		c.Aggregate = "avg"
+	case "avg", "min", "max", "median":
+	default:
+		return fmt.Errorf("unsupported compare aggregate: %s", c.Aggregate)
+	}
+	return nil
+}
+
+// graphite relative time units, months and years are approximated
+var graphiteTimeUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "second": time.Second, "seconds": time.Second,
+	"min": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	"mon": 30 * 24 * time.Hour, "month": 30 * 24 * time.Hour, "months": 30 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour, "year": 365 * 24 * time.Hour, "years": 365 * 24 * time.Hour,
+}
+
+// ParseGraphiteRelativeTime parses graphite "from" or "until" relative to now, like
+// "-10min", "-1h" or "now" (also for empty), into an offset from now.
+func ParseGraphiteRelativeTime(str string) (time.Duration, error) {
+	if str == "" || str == "now" {
+		return 0, nil
+	}
+	matches := RegexpMustCompile(`^-([0-9]+)([a-z]+)$`).FindStringSubmatch(str)
+	if matches == nil {
+		return 0, fmt.Errorf("not a relative time: %s", str)
+	}
+	unit, ok := graphiteTimeUnits[matches[2]]
+	if !ok {
+		return 0, fmt.Errorf("unsupported time unit: %s", str)
+	}
+	n, _ := strconv.Atoi(matches[1])
+	return -time.Duration(n) * unit, nil
+}
+
+// baseline methods
+const (
+	// Holt-Winters additive triple exponential smoothing, like graphite's
+	// holtWintersForecast
+	BaselineHoltWinters = "holt-winters"
+	// median of values at the same time of the last seasons
+	BaselineMedian = "median"
+)
+
+// BaselineConfig configures the baseline mode of GraphiteCheck. Query is fetched for
+// Seasons seasons plus an hour, the expected value and sigma of the last value are
+// computed from the history, and the deviation is (value - expected) / sigma.
+type BaselineConfig struct {
+	// "holt-winters" or "median", defaults to "median"
+	Method string `json:"method"`
+	// length of a season, e.g. "24h" or "168h", defaults to a week
+	Season Duration `json:"season"`
+	// number of seasons of history, at least 2, defaults to 4
+	Seasons int `json:"seasons"`
+
+	// smoothing factors of holt-winters, default to 0.1, 0.0035 and 0.1
+	Alpha float64 `json:"alpha"`
+	Beta  float64 `json:"beta"`
+	Gamma float64 `json:"gamma"`
+
+	// deviation, in sigmas, for warning and critical status, critical defaults to 3
+	WarningSigma  float64 `json:"warning_sigma"`
+	CriticalSigma float64 `json:"critical_sigma"`
+	// which deviations count, "both" (default), "up" or "down"
+	Direction string `json:"direction"`
+	// lower bound of sigma, so that tiny changes of flat series are not anomalies
+	MinSigma float64 `json:"min_sigma"`
+}
+
+// Validate checks the config, and sets defaults.
+func (c *BaselineConfig) Validate() error {
+	if c.Method == "" {
+		c.Method = BaselineMedian
+	}
+	if c.Method != BaselineMedian && c.Method != BaselineHoltWinters {
+		return fmt.Errorf("unsupported baseline method: %s", c.Method)
+	}
+	if c.Season.Duration == 0 {
+		c.Season = FromDuration(7 * 24 * time.Hour)
+	}
+	if c.Season.Duration < time.Minute {
+		return fmt.Errorf("baseline `season` must be at least 1m")
+	}
+	if c.Seasons == 0 {
+		c.Seasons = 4
+	}
+	if c.Seasons < 2 {
+		return fmt.Errorf("baseline `seasons` must be at least 2")
+	}
+	if c.Alpha == 0 && c.Beta == 0 && c.Gamma == 0 {
+		c.Alpha, c.Beta, c.Gamma = 0.1, 0.0035, 0.1
+	}
+	for _, f := range []float64{c.Alpha, c.Beta, c.Gamma} {
+		if f < 0 || f > 1 {
+			return fmt.Errorf("baseline `alpha`, `beta` and `gamma` must be between 0 and 1")
+		}
+	}
+	if c.CriticalSigma == 0 {
+		c.CriticalSigma = 3
+	}
+	if c.CriticalSigma < 0 || c.WarningSigma < 0 || c.MinSigma < 0 {
+		return fmt.Errorf("baseline sigmas can not be negative")
+	}
+	if c.WarningSigma > c.CriticalSigma {
+		return fmt.Errorf("baseline `warning_sigma` must be less than `critical_sigma`")
+	}
+	switch c.Direction {
+	case "":
+		c.Direction = "both"
+	case "both", "up", "down":
+	default:
+		return fmt.Errorf("unsupported baseline direction: %s", c.Direction)
+	}
+	return nil
 }
 
 // Validate the definition, return error description if any. Some values will be
@@ -54,7 +298,11 @@ type GraphiteCheck struct {
 func (c *GraphiteCheck) Validate() error {
 	var err error
 
-	if c.Query == "" {
+	if len(c.Queries) > 0 {
+		if err = c.validateQueries(); err != nil {
+			return err
+		}
+	} else if c.Query == "" {
 		return fmt.Errorf("must provide `query` for graphite check")
 	}
 
@@ -68,6 +316,87 @@ func (c *GraphiteCheck) Validate() error {
 		return fmt.Errorf("`allowed_null_points` must be great equal than 0")
 	}
 
+	if c.Baseline != nil {
+		if err = c.Baseline.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Absent != nil {
+		if err = c.Absent.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.SeriesCount != nil {
+		if !c.SeriesCount.CriticalExpression.IsNumberComparer() || !c.SeriesCount.WarningExpression.IsNumberComparer() {
+			return fmt.Errorf("must provide numeric `critical_expression` and `warning_expression` for `series_count`")
+		}
+	}
+
+	if c.Compare != nil {
+		if c.Baseline != nil {
+			return fmt.Errorf("`baseline` and `compare` can not be used together")
+		}
+		if err = c.Compare.Validate(); err != nil {
+			return err
+		}
+		// shifted queries are made with absolute times
+		for _, str := range []string{c.From, c.Until} {
+			if _, err = ParseGraphiteRelativeTime(str); err != nil {
+				return fmt.Errorf("`from` and `until` must be relative for compare: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateQueries validates the multi-query part of the check, and sets defaults of the
+// queries.
+func (c *GraphiteCheck) validateQueries() error {
+	if c.Query != "" {
+		return fmt.Errorf("`query` and `queries` can not be used together")
+	}
+	if c.Baseline != nil || c.Compare != nil {
+		return fmt.Errorf("`queries` can not be used with `baseline` or `compare`")
+	}
+	if c.Expression == nil {
+		return fmt.Errorf("must provide `expression` for `queries`")
+	}
+
+	names := make(map[string]bool)
+	for _, q := range c.Queries {
+		if q == nil || q.Name == "" || q.Query == "" {
+			return fmt.Errorf("each of `queries` must provide `name` and `query`")
+		}
+		if names[q.Name] {
+			return fmt.Errorf("duplicated query name: %s", q.Name)
+		}
+		names[q.Name] = true
+
+		if q.GraphiteURL == "" {
+			q.GraphiteURL = c.GraphiteURL
+		}
+		if q.From == "" {
+			q.From = c.From
+		}
+		if q.Until == "" {
+			q.Until = c.Until
+		}
+		if q.MetadataExtractPattern == "" {
+			q.MetadataExtractPattern = c.MetadataExtractPattern
+		}
+		if _, err := RegexpCompile(q.MetadataExtractPattern); err != nil {
+			return fmt.Errorf("failed to compile `metadata_extract_pattern` of query %s with error: %s", q.Name, err)
+		}
+	}
+
+	for _, name := range c.Expression.Vars() {
+		if !names[name] {
+			return fmt.Errorf("unknown query in expression: %s", name)
+		}
+	}
 	return nil
 }
 
@@ -174,3 +503,153 @@ func (e *ThresholdExpression) UnmarshalJSON(data []byte) error {
 		return nil
 	}
 }
+
+// pattern of valid heartbeat tokens
+const HeartbeatTokenPattern = `^[a-zA-Z0-9_-]{16,}$`
+
+// HeartbeatCheck expects external jobs, e.g. cron jobs, to prove they ran by pinging
+// "POST /v1/heartbeat/{Token}" of scheduler at least once per Period. Rules are
+// scheduled as usual, and a task is critical if the last ping is older than Period plus
+// Grace.
+type HeartbeatCheck struct {
+	// secret of the ping url, at least 16 characters of letters, digits, "_" and "-"
+	Token  string   `json:"token"`
+	Period Duration `json:"period"`
+	// extra time allowed for jobs to run late
+	Grace Duration `json:"grace"`
+
+	// time of the last ping, set by scheduler on tasks, ignored in rules. If the rule was
+	// never pinged, it's the time the rule started running.
+	LastSeen *Time `json:"last_seen,omitempty"`
+}
+
+func (c *HeartbeatCheck) Validate() error {
+	if !RegexpMustCompile(HeartbeatTokenPattern).MatchString(c.Token) {
+		return fmt.Errorf("heartbeat `token` must be at least 16 characters of letters, digits, '_' and '-'")
+	}
+	if c.Period.Duration <= 0 {
+		return fmt.Errorf("heartbeat `period` must be positive")
+	}
+	if c.Grace.Duration < 0 {
+		return fmt.Errorf("heartbeat `grace` can not be negative")
+	}
+	c.LastSeen = nil
+	return nil
+}
+
+// composite aggregations, value of each is:
+const (
+	// 1 if any child is failing, 0 otherwise
+	CompositeAny = "any"
+	// 1 if all children are failing, 0 otherwise
+	CompositeAll = "all"
+	// number of failing children
+	CompositeCount = "count"
+	// percentage of failing children, between 0 and 100
+	CompositePercentage = "percentage"
+)
+
+// CompositeCheck aggregates current states of other rules' events into a single event,
+// e.g. "critical if at least 2 of the 5 backend checks are critical". Children are the
+// states of rules in RuleIDs, and states matching any of Selectors, states of the
+// composite rule itself are never children. States are read from processor by executors.
+type CompositeCheck struct {
+	RuleIDs []int `json:"rule_ids"`
+	// each selector is a list of matchers which must all match
+	Selectors [][]EventMatcher `json:"selectors"`
+	// states not updated for longer are ignored, 0 to use all states
+	MaxAge Duration `json:"max_age"`
+
+	// which children are failing, "critical" (default) counts critical ones, "warning"
+	// counts warning and critical ones, "problem" counts all which are not OK
+	FailingStatus string `json:"failing_status"`
+	// "any" (default), "all", "count" or "percentage" of failing children
+	Aggregation string `json:"aggregation"`
+
+	// evaluated on the aggregated value, value is absent if there are no children. For
+	// "any" and "all", critical expression defaults to "== 1". Warning expression is
+	// optional.
+	CriticalExpression ThresholdExpression  `json:"critical_expression"`
+	WarningExpression  *ThresholdExpression `json:"warning_expression,omitempty"`
+}
+
+// Failing tells whether a child with status counts as failing.
+func (c *CompositeCheck) Failing(status int) bool {
+	switch c.FailingStatus {
+	case "warning":
+		return status == Warning || status == Critical
+	case "problem":
+		return status != OK
+	default:
+		return status == Critical
+	}
+}
+
+// Selects tells whether state is a child of the composite rule ruleID.
+func (c *CompositeCheck) Selects(ruleID int, state *State) bool {
+	if state.RuleID == ruleID && ruleID != 0 {
+		return false
+	}
+	for _, id := range c.RuleIDs {
+		if state.RuleID == id {
+			return true
+		}
+	}
+	event := &Event{
+		Namespace:  state.Namespace,
+		Identifier: state.Identifier,
+		Metadata:   state.Metadata,
+		RuleID:     state.RuleID,
+	}
+	for _, selector := range c.Selectors {
+		if MatchAll(selector, event) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CompositeCheck) Validate() error {
+	if len(c.RuleIDs) == 0 && len(c.Selectors) == 0 {
+		return fmt.Errorf("must provide `rule_ids` or `selectors` for composite check")
+	}
+	for _, selector := range c.Selectors {
+		if len(selector) == 0 {
+			return fmt.Errorf("composite selectors can not be empty")
+		}
+		for i := range selector {
+			if err := selector[i].Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if c.MaxAge.Duration < 0 {
+		return fmt.Errorf("composite `max_age` can not be negative")
+	}
+
+	switch c.FailingStatus {
+	case "":
+		c.FailingStatus = "critical"
+	case "critical", "warning", "problem":
+	default:
+		return fmt.Errorf("unsupported composite failing status: %s", c.FailingStatus)
+	}
+
+	switch c.Aggregation {
+	case "":
+		c.Aggregation = CompositeAny
+		fallthrough
+	case CompositeAny, CompositeAll:
+		if !c.CriticalExpression.IsNumberComparer() && !c.CriticalExpression.IsNulllComparer() {
+			e, _ := NewThresholdExpression("== 1")
+			c.CriticalExpression = *e
+		}
+	case CompositeCount, CompositePercentage:
+		if !c.CriticalExpression.IsNumberComparer() {
+			return fmt.Errorf("must provide numeric `critical_expression` for composite %s", c.Aggregation)
+		}
+	default:
+		return fmt.Errorf("unsupported composite aggregation: %s", c.Aggregation)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ const (
 )
 
 type Event struct {
+	Namespace   string `json:"namespace"`
 	Type        string `json:"type"`
 	Source      string `json:"source"`
 	Timestamp   Time
@@ -20,4 +21,10 @@ type Event struct {
 
 	RuleID int    `json:"rule_id,omitempty"`
 	Result Result `json:"result"`
+
+	// id of the silence muting this event, set by executors in "tag" silence mode
+	SilencedBy int `json:"silenced_by,omitempty"`
+	// identifier of the source event inhibiting this event, set by executors in "tag"
+	// inhibit mode
+	InhibitedBy string `json:"inhibited_by,omitempty"`
 }
@@ -0,0 +1,226 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+// ArithExpression is an arithmetic expression over named values, e.g.
+// "errors / requests * 100". Supported are numbers, names, + - * /, unary minus and
+// parentheses.
+type ArithExpression struct {
+	str  string
+	root arithNode
+	vars []string
+}
+
+type arithNode interface {
+	// returns false if a value is absent, or on division by zero
+	eval(vars map[string]float64) (float64, bool)
+}
+
+type arithNumber float64
+
+func (n arithNumber) eval(vars map[string]float64) (float64, bool) {
+	return float64(n), true
+}
+
+type arithVar string
+
+func (v arithVar) eval(vars map[string]float64) (float64, bool) {
+	value, ok := vars[string(v)]
+	return value, ok
+}
+
+type arithNeg struct {
+	operand arithNode
+}
+
+func (n *arithNeg) eval(vars map[string]float64) (float64, bool) {
+	v, ok := n.operand.eval(vars)
+	return -v, ok
+}
+
+type arithBinary struct {
+	op          byte
+	left, right arithNode
+}
+
+func (n *arithBinary) eval(vars map[string]float64) (float64, bool) {
+	l, ok := n.left.eval(vars)
+	if !ok {
+		return 0, false
+	}
+	r, ok := n.right.eval(vars)
+	if !ok {
+		return 0, false
+	}
+	switch n.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	default:
+		if r == 0 {
+			return 0, false
+		}
+		return l / r, true
+	}
+}
+
+// arithParser is a recursive descent parser of:
+//
+//	expr    := term (("+" | "-") term)*
+//	term    := unary (("*" | "/") unary)*
+//	unary   := "-" unary | primary
+//	primary := number | name | "(" expr ")"
+type arithParser struct {
+	str  string
+	pos  int
+	vars []string
+	seen map[string]bool
+}
+
+func (p *arithParser) skipSpaces() {
+	for p.pos < len(p.str) && p.str[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte, 0 at the end.
+func (p *arithParser) peek() byte {
+	p.skipSpaces()
+	if p.pos < len(p.str) {
+		return p.str[p.pos]
+	}
+	return 0
+}
+
+func (p *arithParser) expr() (arithNode, error) {
+	left, err := p.term()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.str[p.pos]
+		p.pos++
+		var right arithNode
+		if right, err = p.term(); err == nil {
+			left = &arithBinary{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *arithParser) term() (arithNode, error) {
+	left, err := p.unary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.str[p.pos]
+		p.pos++
+		var right arithNode
+		if right, err = p.unary(); err == nil {
+			left = &arithBinary{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *arithParser) unary() (arithNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		operand, err := p.unary()
+		return &arithNeg{operand: operand}, err
+	}
+	return p.primary()
+}
+
+func (p *arithParser) primary() (arithNode, error) {
+	c := p.peek()
+	start := p.pos
+	switch {
+	case c == '(':
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at %d", p.pos)
+		}
+		p.pos++
+		return node, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		for p.pos < len(p.str) && (p.str[p.pos] == '.' || (p.str[p.pos] >= '0' && p.str[p.pos] <= '9')) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.str[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number at %d: %s", start, p.str[start:p.pos])
+		}
+		return arithNumber(n), nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.str) && (p.str[p.pos] == '_' || unicode.IsLetter(rune(p.str[p.pos])) || unicode.IsDigit(rune(p.str[p.pos]))) {
+			p.pos++
+		}
+		name := p.str[start:p.pos]
+		if !p.seen[name] {
+			p.seen[name] = true
+			p.vars = append(p.vars, name)
+		}
+		return arithVar(name), nil
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %q at %d", c, p.pos)
+	}
+}
+
+func NewArithExpression(str string) (*ArithExpression, error) {
+	p := &arithParser{str: str, seen: make(map[string]bool)}
+	root, err := p.expr()
+	if err == nil && p.peek() != 0 {
+		err = fmt.Errorf("unexpected %q at %d", p.peek(), p.pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression %q: %s", str, err)
+	}
+
+	return &ArithExpression{str: str, root: root, vars: p.vars}, nil
+}
+
+// Vars returns names used in the expression, in the order of appearance.
+func (e *ArithExpression) Vars() []string {
+	return e.vars
+}
+
+// Evaluate computes the expression, absent is true if any value used is absent, or on
+// division by zero.
+func (e *ArithExpression) Evaluate(vars map[string]float64) (value float64, absent bool) {
+	if e.root == nil {
+		return 0, true
+	}
+	value, ok := e.root.eval(vars)
+	return value, !ok
+}
+
+func (e *ArithExpression) String() string {
+	return e.str
+}
+
+func (e *ArithExpression) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.str)
+}
+
+func (e *ArithExpression) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	tmp, err := NewArithExpression(str)
+	if err != nil {
+		return err
+	}
+	*e = *tmp
+	return nil
+}
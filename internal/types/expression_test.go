@@ -0,0 +1,95 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestArithExpressionEvaluate(t *testing.T) {
+	vars := map[string]float64{"errors": 5, "requests": 200, "zero": 0, "a_1": 2}
+	cases := []struct {
+		expr   string
+		value  float64
+		absent bool
+	}{
+		{"1 + 2 * 3", 7, false},
+		{"(1 + 2) * 3", 9, false},
+		{"10 - 4 - 3", 3, false},
+		{"24 / 4 / 2", 3, false},
+		{"2 * 3 + 4 * 5", 26, false},
+		{"errors / requests * 100", 2.5, false},
+		{"-3 + 5", 2, false},
+		{"-(3 + 5)", -8, false},
+		{"2 * -3", -6, false},
+		{"- - 4", 4, false},
+		{"-errors", -5, false},
+		{"a_1 * .5", 1, false},
+		{"  errors+requests  ", 205, false},
+		{"errors / zero", 0, true},
+		{"1 / 0", 0, true},
+		{"(1 / 0) + 1", 0, true},
+		{"errors / missing", 0, true},
+		{"-missing", 0, true},
+	}
+
+	for _, c := range cases {
+		e, err := NewArithExpression(c.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", c.expr, err)
+			continue
+		}
+		value, absent := e.Evaluate(vars)
+		if absent != c.absent {
+			t.Errorf("%q: absent is %v, want %v", c.expr, absent, c.absent)
+		} else if !absent && value != c.value {
+			t.Errorf("%q: value is %v, want %v", c.expr, value, c.value)
+		}
+	}
+}
+
+func TestArithExpressionParseErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"   ",
+		"1 +",
+		"* 2",
+		"(1 + 2",
+		"1 + 2)",
+		"1 2",
+		"errors requests",
+		"1..2",
+		"errors % 2",
+		"()",
+		"-",
+	}
+
+	for _, expr := range cases {
+		if _, err := NewArithExpression(expr); err == nil {
+			t.Errorf("%q: expected parse error", expr)
+		}
+	}
+}
+
+func TestArithExpressionVars(t *testing.T) {
+	e, err := NewArithExpression("(b + a) / b * c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars := e.Vars(); !reflect.DeepEqual(vars, []string{"b", "a", "c"}) {
+		t.Fatalf("vars are %v, want [b a c]", vars)
+	}
+}
+
+func TestArithExpressionJSON(t *testing.T) {
+	e := &ArithExpression{}
+	if err := json.Unmarshal([]byte(`"errors / requests"`), e); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := json.Marshal(e); err != nil || string(data) != `"errors / requests"` {
+		t.Fatalf("marshaled to %s (err: %v)", data, err)
+	}
+	if err := json.Unmarshal([]byte(`"errors /"`), e); err == nil {
+		t.Fatal("expected error unmarshaling invalid expression")
+	}
+}
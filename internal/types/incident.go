@@ -0,0 +1,78 @@
+package types
+
+// State is the latest known state of an event identifier.
+type State struct {
+	Identifier  string   `json:"identifier"`
+	Namespace   string   `json:"namespace"`
+	RuleID      int      `json:"rule_id,omitempty"`
+	Status      int      `json:"status"`
+	Description string   `json:"description"`
+	Metadata    Metadata `json:"metadata"`
+	// when the identifier changed into the current status
+	Since Time `json:"since"`
+	// timestamp of the latest event
+	LastSeen Time `json:"last_seen"`
+	// id of the open incident of the identifier, 0 if there is none
+	IncidentID int `json:"incident_id,omitempty"`
+}
+
+const (
+	IncidentOpen     = "open"
+	IncidentResolved = "resolved"
+)
+
+// Incident is a period during which an identifier is not OK. It's opened by the first
+// non-OK event, and resolved by the next OK event.
+type Incident struct {
+	ID         int    `json:"id"`
+	Identifier string `json:"identifier"`
+	Namespace  string `json:"namespace"`
+	RuleID     int    `json:"rule_id,omitempty"`
+	// "open" or "resolved"
+	State string `json:"state"`
+	// current status, and the worst status seen during the incident
+	Status      int      `json:"status"`
+	WorstStatus int      `json:"worst_status"`
+	Description string   `json:"description"`
+	Metadata    Metadata `json:"metadata"`
+	OpenedAt    Time     `json:"opened_at"`
+	UpdatedAt   Time     `json:"updated_at"`
+	ResolvedAt  Time     `json:"resolved_at"`
+	// number of non-OK events received during the incident
+	Events int `json:"events"`
+	// who resolved the incident via api, empty if it's resolved by an OK event
+	ResolvedBy string `json:"resolved_by,omitempty"`
+
+	// acknowledged incidents are not escalated any further
+	Acknowledged bool   `json:"acknowledged"`
+	AckedBy      string `json:"acked_by,omitempty"`
+	AckedAt      Time   `json:"acked_at"`
+	AckComment   string `json:"ack_comment,omitempty"`
+
+	// name of the escalation policy, empty if no policy matches the incident
+	Policy string `json:"policy,omitempty"`
+	// number of policy steps notified since EscalatedAt
+	Step int `json:"step"`
+	// when the current round of escalation started, the policy restarts from its first
+	// step on each repeat and on unack
+	EscalatedAt    Time `json:"escalated_at"`
+	LastNotifiedAt Time `json:"last_notified_at"`
+	// how many times the policy has been repeated
+	Repeats int `json:"repeats"`
+	// targets notified during the incident, resolution is sent to them
+	NotifiedTargets []string `json:"notified_targets,omitempty"`
+}
+
+// worse tells whether status a is worse than b, Critical > Unknown > Warning > OK.
+func worse(a, b int) bool {
+	rank := map[int]int{OK: 0, Warning: 1, Unknown: 2, Critical: 3}
+	return rank[a] > rank[b]
+}
+
+// WorseStatus returns the worse one of two statuses.
+func WorseStatus(a, b int) int {
+	if worse(a, b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,135 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Labels are key/value pairs attached to rules, used to select rules.
+type Labels map[string]string
+
+// Validate checks that label keys can be used in label selectors.
+func (l Labels) Validate() error {
+	for k := range l {
+		if k == "" || strings.ContainsAny(k, ",=! ") {
+			return fmt.Errorf("invalid label key: %q", k)
+		}
+	}
+	return nil
+}
+
+// LabelRequirement is a single requirement on labels.
+type LabelRequirement struct {
+	Key string
+	// one of "=", "!=", "exists", "!exists"
+	Op    string
+	Value string
+}
+
+// Matches tells whether labels satisfy this requirement.
+func (r LabelRequirement) Matches(labels Labels) bool {
+	v, ok := labels[r.Key]
+	switch r.Op {
+	case "=":
+		return ok && v == r.Value
+	case "!=":
+		return !ok || v != r.Value
+	case "exists":
+		return ok
+	case "!exists":
+		return !ok
+	}
+	return false
+}
+
+func (r LabelRequirement) String() string {
+	switch r.Op {
+	case "exists":
+		return r.Key
+	case "!exists":
+		return "!" + r.Key
+	default:
+		return r.Key + r.Op + r.Value
+	}
+}
+
+// LabelSelector selects labels matching all of its requirements. It's written as
+// comma separated requirements, in the following forms:
+//
+//	"team=infra"  label team equals infra
+//	"env!=prod"   label env does not equal prod (or does not exist)
+//	"tier"        label tier exists
+//	"!tier"       label tier does not exist
+//
+// An empty selector matches everything.
+type LabelSelector []LabelRequirement
+
+func ParseLabelSelector(str string) (LabelSelector, error) {
+	var selector LabelSelector
+
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var r LabelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = LabelRequirement{Key: strings.TrimSpace(kv[0]), Op: "!=", Value: strings.TrimSpace(kv[1])}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			r = LabelRequirement{Key: strings.TrimSpace(kv[0]), Op: "=", Value: strings.TrimSpace(kv[1])}
+		case strings.HasPrefix(part, "!"):
+			r = LabelRequirement{Key: strings.TrimSpace(part[1:]), Op: "!exists"}
+		default:
+			r = LabelRequirement{Key: part, Op: "exists"}
+		}
+
+		if err := (Labels{r.Key: ""}).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %s", str, err)
+		}
+		selector = append(selector, r)
+	}
+
+	return selector, nil
+}
+
+// Matches tells whether labels satisfy all requirements of the selector.
+func (s LabelSelector) Matches(labels Labels) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s LabelSelector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, r := range s {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// MarshalJSON implements the json.Marshaler interface, selector is marshaled as string.
+func (s LabelSelector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (s *LabelSelector) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	if tmp, err := ParseLabelSelector(str); err != nil {
+		return err
+	} else {
+		*s = tmp
+		return nil
+	}
+}
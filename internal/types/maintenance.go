@@ -0,0 +1,43 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaintenanceWindow pauses rules matching Namespace and Selector between Start and End.
+// Rules are not modified, they are simply not run while the window is active.
+type MaintenanceWindow struct {
+	ID int `json:"id"`
+	// empty matches rules in all namespaces
+	Namespace string `json:"namespace"`
+	// empty matches all rules
+	Selector LabelSelector `json:"selector"`
+	Start    Time          `json:"start"`
+	End      Time          `json:"end"`
+	Comment  string        `json:"comment"`
+	Author   string        `json:"author"`
+}
+
+func (w *MaintenanceWindow) Validate() error {
+	if w.Start.IsZero() || w.End.IsZero() {
+		return fmt.Errorf("Both start and end are required")
+	}
+	if !w.End.After(w.Start.Time) {
+		return fmt.Errorf("End must be after start")
+	}
+	if w.Namespace != "" && !RegexpMustCompile(NamespacePattern).MatchString(w.Namespace) {
+		return fmt.Errorf("Invalid namespace: %s", w.Namespace)
+	}
+	return nil
+}
+
+// Active tells whether the window is active at t.
+func (w *MaintenanceWindow) Active(t time.Time) bool {
+	return !t.Before(w.Start.Time) && t.Before(w.End.Time)
+}
+
+// Matches tells whether rule is covered by the window.
+func (w *MaintenanceWindow) Matches(rule *Rule) bool {
+	return (w.Namespace == "" || w.Namespace == rule.Namespace) && w.Selector.Matches(rule.Labels)
+}
@@ -0,0 +1,62 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EventMatcher matches a field of events, Name is one of "identifier", "rule_id",
+// "namespace" or "metadata.<key>". Used by silences and inhibit rules.
+type EventMatcher struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Value is a regular expression, which must match the whole field
+	Regex bool `json:"regex"`
+}
+
+func (m *EventMatcher) Validate() error {
+	switch {
+	case m.Name == "identifier", m.Name == "rule_id", m.Name == "namespace":
+	case strings.HasPrefix(m.Name, "metadata.") && len(m.Name) > len("metadata."):
+	default:
+		return fmt.Errorf("Invalid matcher name: %s", m.Name)
+	}
+	if m.Regex {
+		if _, err := RegexpCompile("^(?:" + m.Value + ")$"); err != nil {
+			return fmt.Errorf("Invalid matcher regex: %s", err)
+		}
+	}
+	return nil
+}
+
+// Matches tells whether the matched field of event equals to (or matches) Value.
+func (m *EventMatcher) Matches(event *Event) bool {
+	var field string
+	switch m.Name {
+	case "identifier":
+		field = event.Identifier
+	case "rule_id":
+		field = strconv.Itoa(event.RuleID)
+	case "namespace":
+		field = event.Namespace
+	default:
+		field, _ = event.Metadata.GetString(strings.TrimPrefix(m.Name, "metadata."))
+	}
+
+	if !m.Regex {
+		return field == m.Value
+	}
+	re, err := RegexpCompile("^(?:" + m.Value + ")$")
+	return err == nil && re.MatchString(field)
+}
+
+// MatchAll tells whether event satisfies all matchers.
+func MatchAll(matchers []EventMatcher, event *Event) bool {
+	for i := range matchers {
+		if !matchers[i].Matches(event) {
+			return false
+		}
+	}
+	return true
+}
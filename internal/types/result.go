@@ -10,6 +10,30 @@ type GraphiteResult struct {
 	MetricValue       float64  `json:"metric_value"`
 	MetricValueAbsent bool     `json:"metric_value_absent"`
 	Metadata          Metadata `json:"metadata"` // data extracted
+
+	// set in baseline mode
+	Baseline *BaselineResult `json:"baseline,omitempty"`
+	// set by comparison checks
+	Compare *CompareResult `json:"compare,omitempty"`
+	// set by multi-query checks, the last value of each query, absent ones omitted,
+	// MetricValue is the combined value
+	QueryValues map[string]float64 `json:"query_values,omitempty"`
+	// set by multi-query checks, the series name of each query
+	QueryMetrics map[string]string `json:"query_metrics,omitempty"`
+}
+
+// BaselineResult is how the metric value compares with its baseline.
+type BaselineResult struct {
+	Method   string  `json:"method"`
+	Expected float64 `json:"expected"`
+	Sigma    float64 `json:"sigma"`
+	// (value - expected) / sigma
+	Deviation float64 `json:"deviation"`
+	// values within the band deviate less than critical sigmas
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	// number of past values the baseline is computed from
+	Samples int `json:"samples"`
 }
 
 func NewGraphiteResult() *GraphiteResult {
@@ -17,3 +41,48 @@ func NewGraphiteResult() *GraphiteResult {
 		Metadata: make(Metadata),
 	}
 }
+
+// CompareResult is how the metric value compares with its values in the past.
+type CompareResult struct {
+	Mode string `json:"mode"`
+	// value of each offset, absent values are not included
+	PreviousValues map[string]float64 `json:"previous_values"`
+	// aggregate of the previous values
+	PreviousValue       float64 `json:"previous_value"`
+	PreviousValueAbsent bool    `json:"previous_value_absent"`
+	// the ratio or difference, threshold expressions are evaluated on it
+	Delta       float64 `json:"delta"`
+	DeltaAbsent bool    `json:"delta_absent"`
+}
+
+// HeartbeatResult is the result of a heartbeat check.
+type HeartbeatResult struct {
+	Status         int  `json:"status"`
+	CheckTimestamp Time `json:"check_timestamp"`
+	// nil if the rule was never pinged
+	LastSeen *Time    `json:"last_seen,omitempty"`
+	Period   Duration `json:"period"`
+	// how long the next ping is overdue, 0 if it's not
+	Overdue Duration `json:"overdue"`
+}
+
+// CompositeChild is the state of a child of a composite check.
+type CompositeChild struct {
+	RuleID     int    `json:"rule_id,omitempty"`
+	Identifier string `json:"identifier"`
+	Status     int    `json:"status"`
+	Failing    bool   `json:"failing"`
+}
+
+// CompositeResult is the result of a composite check.
+type CompositeResult struct {
+	Status         int    `json:"status"`
+	CheckTimestamp Time   `json:"check_timestamp"`
+	Aggregation    string `json:"aggregation"`
+	// aggregated value, absent if there are no children
+	Value       float64          `json:"value"`
+	ValueAbsent bool             `json:"value_absent"`
+	Total       int              `json:"total"`
+	Failing     int              `json:"failing"`
+	Children    []CompositeChild `json:"children"`
+}
@@ -0,0 +1,102 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// RuleRevision is a snapshot of a rule after a change, revisions are append only.
+type RuleRevision struct {
+	RuleID    int    `json:"rule_id"`
+	Revision  int    `json:"revision"`
+	Timestamp Time   `json:"timestamp"`
+	Author    string `json:"author"`
+	// create, update, delete or restore
+	Action string `json:"action"`
+
+	Rule *Rule         `json:"rule"`
+	Diff []FieldChange `json:"diff"`
+}
+
+// FieldChange describes a changed field between two versions of a rule, Path is the
+// dot separated json path of the field, e.g. "check.critical_expression".
+type FieldChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// DiffRules compares two rules field by field, either of them can be nil.
+func DiffRules(old, new *Rule) []FieldChange {
+	oldFields := make(map[string]interface{})
+	newFields := make(map[string]interface{})
+	flattenRule(old, oldFields)
+	flattenRule(new, newFields)
+
+	var paths []string
+	for path := range oldFields {
+		paths = append(paths, path)
+	}
+	for path := range newFields {
+		if _, ok := oldFields[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := make([]FieldChange, 0)
+	for _, path := range paths {
+		o, n := oldFields[path], newFields[path]
+		if !reflect.DeepEqual(o, n) {
+			changes = append(changes, FieldChange{Path: path, Old: o, New: n})
+		}
+	}
+	return changes
+}
+
+func flattenRule(rule *Rule, fields map[string]interface{}) {
+	if rule == nil {
+		return
+	}
+	c := *rule
+	// id and version are not part of the rule definition
+	c.ID = 0
+	c.Version = 0
+
+	var data []byte
+	var doc interface{}
+	var err error
+	if data, err = json.Marshal(&c); err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	flattenValue("", doc, fields)
+	delete(fields, "id")
+	delete(fields, "version")
+}
+
+func flattenValue(prefix string, value interface{}, fields map[string]interface{}) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			flattenValue(join(key), val, fields)
+		}
+	case []interface{}:
+		for i, val := range v {
+			flattenValue(join(strconv.Itoa(i)), val, fields)
+		}
+	default:
+		fields[prefix] = v
+	}
+}
@@ -6,12 +6,25 @@ import (
 	"github.com/fatih/structs"
 )
 
+// DefaultNamespace is used for rules without a namespace.
+const DefaultNamespace = "default"
+
+// pattern of valid namespace names
+const NamespacePattern = `^[a-zA-Z0-9_-]+$`
+
+// RuleSourceFile marks rules which are loaded from rule files. Rules without a source
+// are managed via http api.
+const RuleSourceFile = "file"
+
 // Rule defines a check and how to schedule check tasks.
 type Rule struct {
 	// `json` tag is for http api serialization, `structs` is for tiedot database serialization
+	Namespace              string   `json:"namespace" structs:"namespace"`
+	Name                   string   `json:"name" structs:"name"`
 	Type                   string   `json:"type" structs:"type"`
 	Check                  Check    `json:"check" structs:"check,omitnested"`
 	Metadata               Metadata `json:"metadata" structs:"metadata"`
+	Labels                 Labels   `json:"labels" structs:"labels"`
 	EventIdentifierPattern string   `json:"event_identifier_pattern" structs:"event_identifier_pattern"`
 
 	// schedule information
@@ -19,8 +32,13 @@ type Rule struct {
 	Interval Duration `json:"interval" structs:"interval,string"`
 	Timeout  Duration `json:"timeout" structs:"timeout,string"`
 
+	// where the rule is managed, rules loaded from files are reconciled by name
+	Source string `json:"source" structs:"source"`
+
 	// database id
 	ID int `json:"id" structs:"-"`
+	// increased on every update, used for optimistic concurrency control
+	Version int `json:"version" structs:"version"`
 }
 
 func (r *Rule) UnmarshalJSON(data []byte) error {
@@ -40,6 +58,10 @@ func (r *Rule) UnmarshalJSON(data []byte) error {
 	switch r.Type {
 	case "graphite":
 		r.Check = new(GraphiteCheck)
+	case "heartbeat":
+		r.Check = new(HeartbeatCheck)
+	case "composite":
+		r.Check = new(CompositeCheck)
 	default:
 		return fmt.Errorf("Unsupported type: %s", r.Type)
 	}
@@ -51,6 +73,12 @@ func (r *Rule) UnmarshalJSON(data []byte) error {
 }
 
 func (r *Rule) Validate() error {
+	if r.Namespace == "" {
+		r.Namespace = DefaultNamespace
+	} else if !RegexpMustCompile(NamespacePattern).MatchString(r.Namespace) {
+		return fmt.Errorf("Invalid namespace: %s", r.Namespace)
+	}
+
 	if r.Interval.Duration <= 0 {
 		return fmt.Errorf("Invalid interval: %s", r.Interval)
 	}
@@ -59,6 +87,10 @@ func (r *Rule) Validate() error {
 		return fmt.Errorf("Timeout must be less-equal than Interval")
 	}
 
+	if err := r.Labels.Validate(); err != nil {
+		return err
+	}
+
 	if err := r.Check.Validate(); err != nil {
 		return err
 	}
@@ -0,0 +1,52 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// Silence mutes events matching all of its matchers, from StartsAt until ExpiresAt.
+// Silenced events are still evaluated, executors drop or tag them at emit time.
+type Silence struct {
+	ID       int            `json:"id"`
+	Matchers []EventMatcher `json:"matchers"`
+	// zero means the silence starts when it's created
+	StartsAt  Time   `json:"starts_at"`
+	ExpiresAt Time   `json:"expires_at"`
+	Comment   string `json:"comment"`
+	Author    string `json:"author"`
+	CreatedAt Time   `json:"created_at"`
+}
+
+func (s *Silence) Validate() error {
+	if len(s.Matchers) == 0 {
+		return fmt.Errorf("At least one matcher is required")
+	}
+	for i := range s.Matchers {
+		if err := s.Matchers[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if s.ExpiresAt.IsZero() {
+		return fmt.Errorf("Expiry is required")
+	}
+	if !s.StartsAt.IsZero() && !s.ExpiresAt.After(s.StartsAt.Time) {
+		return fmt.Errorf("Expiry must be after start")
+	}
+	return nil
+}
+
+// Active tells whether the silence is in effect at t.
+func (s *Silence) Active(t time.Time) bool {
+	return (s.StartsAt.IsZero() || !t.Before(s.StartsAt.Time)) && t.Before(s.ExpiresAt.Time)
+}
+
+// Expired tells whether the silence has ended at t.
+func (s *Silence) Expired(t time.Time) bool {
+	return !t.Before(s.ExpiresAt.Time)
+}
+
+// Matches tells whether event satisfies all matchers.
+func (s *Silence) Matches(event *Event) bool {
+	return MatchAll(s.Matchers, event)
+}
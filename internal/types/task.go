@@ -10,6 +10,7 @@ import (
 // Task is a scheduled check task.
 type Task struct {
 	// fields copied from rule as is
+	Namespace              string              `json:"namespace"`
 	Type                   string              `json:"type"`
 	Check                  Check               `json:"check"`
 	Metadata               Metadata            `json:"metadata"`
@@ -28,6 +29,7 @@ func NewTaskFromRule(r *Rule) *Task {
 	task := &Task{
 		RuleID: r.ID,
 
+		Namespace:              r.Namespace,
 		Type:                   r.Type,
 		Check:                  r.Check,
 		Metadata:               r.Metadata,
@@ -58,6 +60,10 @@ func (t *Task) UnmarshalJSON(data []byte) error {
 	switch t.Type {
 	case "graphite":
 		t.Check = new(GraphiteCheck)
+	case "heartbeat":
+		t.Check = new(HeartbeatCheck)
+	case "composite":
+		t.Check = new(CompositeCheck)
 	default:
 		return fmt.Errorf("Unsupported type: %s", t.Type)
 	}
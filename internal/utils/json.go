@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"encoding/json"
+)
+
+// JSONMergePatch applies patch to doc, following JSON Merge Patch (RFC 7396) semantics:
+// objects are merged recursively, null removes a member, anything else replaces it.
+func JSONMergePatch(doc, patch []byte) ([]byte, error) {
+	var d, p interface{}
+
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(d, p))
+}
+
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = mergePatch(d[k], v)
+		}
+	}
+	return d
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"encoding/json"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 )
@@ -19,3 +21,35 @@ func UnmarshalYAMLFile(path string, holder interface{}) error {
 
 	return nil
 }
+
+// YAMLToJSON converts yaml document into json, so that types which only implement
+// json.Unmarshaler (e.g. types.Rule) can be loaded from yaml. Since json is a subset
+// of yaml, json documents are accepted as well.
+func YAMLToJSON(data []byte) ([]byte, error) {
+	var doc interface{}
+
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(convertYAMLValue(doc))
+}
+
+// convertYAMLValue converts map[interface{}]interface{} produced by yaml decoder into
+// map[string]interface{}, which can be marshaled by encoding/json.
+func convertYAMLValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprintf("%v", key)] = convertYAMLValue(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = convertYAMLValue(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,249 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/braintree/manners"
+	"github.com/openmetric/yamf/internal/auth"
+	"github.com/openmetric/yamf/internal/eventdb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+type apiResponseBody struct {
+	Success   bool              `json:"success"`
+	Message   string            `json:"message"`
+	States    []*types.State    `json:"states,omitempty"`
+	Incidents []*types.Incident `json:"incidents,omitempty"`
+	Events    []*types.Event    `json:"events,omitempty"`
+	Buckets   []*eventdb.Bucket `json:"buckets,omitempty"`
+	SLA       []*SLAReport      `json:"sla,omitempty"`
+}
+
+func apiWriteFail(c *gin.Context, code int, messageFmt string, v ...interface{}) {
+	c.JSON(code, apiResponseBody{
+		Success: false,
+		Message: fmt.Sprintf(messageFmt, v...),
+	})
+}
+
+// apiIntQuery parses an optional integer query parameter, writes 400 response if it's
+// invalid.
+func apiIntQuery(c *gin.Context, name string, value *int) bool {
+	if str := c.Query(name); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil {
+			apiWriteFail(c, 400, "Bad %s: %s", name, str)
+			return false
+		}
+		*value = n
+	}
+	return true
+}
+
+// apiListStates lists current states of identifiers, query parameters:
+//
+//	namespace  only states of this namespace
+//	rule_id    only states of this rule
+//	status     only states with this status
+//	problems   "true" to only list states which are not OK
+func (p *Processor) apiListStates(c *gin.Context) {
+	var err error
+
+	ruleID, status := 0, -1
+	if !apiIntQuery(c, "rule_id", &ruleID) || !apiIntQuery(c, "status", &status) {
+		return
+	}
+	problems := false
+	if str := c.Query("problems"); str != "" {
+		if problems, err = strconv.ParseBool(str); err != nil {
+			apiWriteFail(c, 400, "Bad problems: %s", str)
+			return
+		}
+	}
+	namespace := c.Query("namespace")
+
+	states := p.store.listStates(func(state *types.State) bool {
+		return (namespace == "" || state.Namespace == namespace) &&
+			(ruleID == 0 || state.RuleID == ruleID) &&
+			(status < 0 || state.Status == status) &&
+			(!problems || state.Status != types.OK)
+	})
+
+	c.JSON(200, apiResponseBody{
+		Success: true,
+		Message: "",
+		States:  states,
+	})
+}
+
+// apiListIncidents lists incidents newest first, query parameters:
+//
+//	state      "open" (default), "resolved" or "all"
+//	namespace  only incidents of this namespace
+//	rule_id    only incidents of this rule
+//	limit      max number of incidents to return
+func (p *Processor) apiListIncidents(c *gin.Context) {
+	state := c.DefaultQuery("state", types.IncidentOpen)
+	if state != types.IncidentOpen && state != types.IncidentResolved && state != "all" {
+		apiWriteFail(c, 400, "Bad state: %s", state)
+		return
+	}
+	ruleID, limit := 0, 0
+	if !apiIntQuery(c, "rule_id", &ruleID) || !apiIntQuery(c, "limit", &limit) {
+		return
+	}
+	namespace := c.Query("namespace")
+
+	incidents := p.store.listIncidents(func(incident *types.Incident) bool {
+		return (state == "all" || incident.State == state) &&
+			(namespace == "" || incident.Namespace == namespace) &&
+			(ruleID == 0 || incident.RuleID == ruleID)
+	})
+	if limit > 0 && len(incidents) > limit {
+		incidents = incidents[:limit]
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success:   true,
+		Message:   "",
+		Incidents: incidents,
+	})
+}
+
+func (p *Processor) apiGetIncident(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		apiWriteFail(c, 400, "Bad incident id: %s", c.Param("id"))
+		return
+	}
+
+	incident := p.store.getIncident(id)
+	if incident == nil {
+		apiWriteFail(c, 404, "Incident not found")
+		return
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success:   true,
+		Message:   "",
+		Incidents: []*types.Incident{incident},
+	})
+}
+
+// apiIncidentAction is the optional body of ack, unack and resolve requests.
+type apiIncidentAction struct {
+	Author  string `json:"author"`
+	Comment string `json:"comment"`
+}
+
+// apiChangeIncident returns a handler which applies an action to an incident.
+func (p *Processor) apiChangeIncident(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var incident *types.Incident
+		var n *notification
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			apiWriteFail(c, 400, "Bad incident id: %s", c.Param("id"))
+			return
+		}
+
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			apiWriteFail(c, 500, "Error reading request body, err: %s", err)
+			return
+		}
+		req := &apiIncidentAction{}
+		if len(body) > 0 {
+			if err = json.Unmarshal(body, req); err != nil {
+				apiWriteFail(c, 400, "Error parsing body, err: %s", err)
+				return
+			}
+		}
+		// the authenticated user is the author, it's only up to the client without auth
+		if p.config.Auth.Enabled {
+			req.Author = auth.APIUser(c).Name
+		} else if req.Author == "" {
+			req.Author = c.ClientIP()
+		}
+
+		switch action {
+		case "ack":
+			incident, err = p.store.ack(id, req.Author, req.Comment)
+		case "unack":
+			incident, err = p.store.unack(id)
+		case "resolve":
+			incident, n, err = p.store.resolveIncident(id, req.Author)
+		}
+		switch err {
+		case nil:
+		case errIncidentNotFound:
+			apiWriteFail(c, 404, "Incident not found")
+			return
+		case errIncidentResolved:
+			apiWriteFail(c, 409, "Incident is resolved already")
+			return
+		default:
+			apiWriteFail(c, 500, "Error changing incident, err: %s", err)
+			return
+		}
+
+		p.logger.Infow("Incident changed via api.", "Incident ID", id, "Action", action, "Author", req.Author)
+		p.deliver(n)
+
+		c.JSON(200, apiResponseBody{
+			Success:   true,
+			Message:   "",
+			Incidents: []*types.Incident{incident},
+		})
+	}
+}
+
+func (p *Processor) runAPIServer() error {
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.NoRoute(func(c *gin.Context) { apiWriteFail(c, 404, "no such endpoint") })
+
+	v1 := router.Group("v1")
+	v1.GET("/state", p.apiListStates)
+	v1.GET("/incidents", p.apiListIncidents)
+	v1.GET("/incidents/:id", p.apiGetIncident)
+	// reads are open, executors read states for composite rules and absent series
+	authenticate, edit := p.auth.Authenticate, p.auth.RequireRole(auth.RoleEditor)
+	v1.POST("/incidents/:id/ack", authenticate, edit, p.apiChangeIncident("ack"))
+	v1.POST("/incidents/:id/unack", authenticate, edit, p.apiChangeIncident("unack"))
+	v1.POST("/incidents/:id/resolve", authenticate, edit, p.apiChangeIncident("resolve"))
+	v1.GET("/events", p.apiQueryHistory)
+	v1.GET("/events/counts", p.apiCountHistory)
+	v1.GET("/sla", p.apiSLA)
+
+	p.apiServer = manners.NewWithServer(&http.Server{
+		Addr:    p.config.ListenAddress,
+		Handler: router,
+	})
+
+	p.apiServerStop = make(chan struct{})
+	go func() {
+		if err := p.apiServer.ListenAndServe(); err != nil {
+			p.logger.Errorw("API server stopped with error.", "Error", err)
+		}
+		close(p.apiServerStop)
+	}()
+
+	return nil
+}
+
+func (p *Processor) stopAPIServer() {
+	if p.apiServer == nil {
+		return
+	}
+	p.logger.Infof("shutting down api server...")
+	p.apiServer.Close()
+	<-p.apiServerStop
+}
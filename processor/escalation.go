@@ -0,0 +1,230 @@
+package processor
+
+import (
+	"fmt"
+	"github.com/openmetric/yamf/executor"
+	"github.com/openmetric/yamf/internal/types"
+	"strings"
+	"time"
+)
+
+// how often incidents are checked for due escalation steps
+const escalationInterval = 10 * time.Second
+
+// EscalationPolicy notifies targets of an incident step by step, until the incident is
+// acknowledged or resolved. The first policy whose matchers match an incident applies to
+// it, matchers are checked against the identifier, rule id, namespace and metadata of the
+// event opening the incident.
+type EscalationPolicy struct {
+	Name     string               `yaml:"name"`
+	Matchers []types.EventMatcher `yaml:"matchers"`
+	Steps    []*EscalationStep    `yaml:"steps"`
+	// start over from the first step this long after the last step is notified, while
+	// the incident is still unacknowledged, 0 to not repeat
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	// max number of repeats, 0 for unlimited
+	MaxRepeats int `yaml:"max_repeats"`
+	// notify all notified targets when the incident is resolved
+	NotifyResolved bool `yaml:"notify_resolved"`
+}
+
+// EscalationStep notifies targets after Delay since the escalation started, which is when
+// the incident is opened, repeated or unacknowledged.
+type EscalationStep struct {
+	Delay time.Duration `yaml:"delay"`
+	// names of targets in escalation_targets
+	Targets []string `yaml:"targets"`
+}
+
+func (p *EscalationPolicy) Validate(targets map[string]*executor.EmitConfig) error {
+	if p.Name == "" {
+		return fmt.Errorf("policy name is required")
+	}
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("policy %s has no steps", p.Name)
+	}
+	for i := range p.Matchers {
+		if err := p.Matchers[i].Validate(); err != nil {
+			return fmt.Errorf("policy %s: %s", p.Name, err)
+		}
+	}
+	for i, step := range p.Steps {
+		if i > 0 && step.Delay < p.Steps[i-1].Delay {
+			return fmt.Errorf("policy %s: step delays must not decrease", p.Name)
+		}
+		if len(step.Targets) == 0 {
+			return fmt.Errorf("policy %s: step %d has no targets", p.Name, i)
+		}
+		for _, target := range step.Targets {
+			if _, ok := targets[target]; !ok {
+				return fmt.Errorf("policy %s: unknown target %s", p.Name, target)
+			}
+		}
+	}
+	if p.RepeatInterval < 0 || p.MaxRepeats < 0 {
+		return fmt.Errorf("policy %s: repeat_interval and max_repeats can not be negative", p.Name)
+	}
+	return nil
+}
+
+// notification is an escalation step due for an incident.
+type notification struct {
+	incident *types.Incident
+	targets  []string
+	resolved bool
+}
+
+// escalator decides when incidents are escalated, and delivers notifications with
+// emitters, one per target.
+type escalator struct {
+	policies []*EscalationPolicy
+	byName   map[string]*EscalationPolicy
+	emitters map[string]executor.Emitter
+}
+
+func newEscalator(policies []*EscalationPolicy, targets map[string]*executor.EmitConfig) (*escalator, error) {
+	e := &escalator{
+		policies: policies,
+		byName:   make(map[string]*EscalationPolicy),
+		emitters: make(map[string]executor.Emitter),
+	}
+	for _, policy := range policies {
+		if err := policy.Validate(targets); err != nil {
+			return nil, err
+		}
+		if _, ok := e.byName[policy.Name]; ok {
+			return nil, fmt.Errorf("duplicate policy name: %s", policy.Name)
+		}
+		e.byName[policy.Name] = policy
+	}
+	for name, config := range targets {
+		emitter, err := executor.NewEmitter(config)
+		if err != nil {
+			e.close()
+			return nil, fmt.Errorf("failed to initialize target %s: %s", name, err)
+		}
+		e.emitters[name] = emitter
+	}
+	return e, nil
+}
+
+func (e *escalator) close() {
+	for _, emitter := range e.emitters {
+		emitter.Close()
+	}
+}
+
+// assign sets the escalation policy of a newly opened incident.
+func (e *escalator) assign(incident *types.Incident) {
+	event := &types.Event{
+		Identifier: incident.Identifier,
+		RuleID:     incident.RuleID,
+		Namespace:  incident.Namespace,
+		Metadata:   incident.Metadata,
+	}
+	for _, policy := range e.policies {
+		if types.MatchAll(policy.Matchers, event) {
+			incident.Policy = policy.Name
+			incident.EscalatedAt = incident.OpenedAt
+			return
+		}
+	}
+}
+
+// due advances incident to the next step which is due at now, and returns the targets to
+// notify, nil if nothing is due. Must be called with the store lock held.
+func (e *escalator) due(incident *types.Incident, now time.Time) []string {
+	policy, ok := e.byName[incident.Policy]
+	if !ok || incident.State != types.IncidentOpen || incident.Acknowledged {
+		return nil
+	}
+
+	if incident.Step >= len(policy.Steps) {
+		if policy.RepeatInterval <= 0 || (policy.MaxRepeats > 0 && incident.Repeats >= policy.MaxRepeats) {
+			return nil
+		}
+		if now.Before(incident.LastNotifiedAt.Add(policy.RepeatInterval)) {
+			return nil
+		}
+		incident.Repeats++
+		incident.Step = 0
+		incident.EscalatedAt = types.FromTime(now)
+	}
+
+	// steps with the same delay are notified together
+	var targets []string
+	for incident.Step < len(policy.Steps) {
+		step := policy.Steps[incident.Step]
+		if now.Before(incident.EscalatedAt.Add(step.Delay)) {
+			break
+		}
+		targets = append(targets, step.Targets...)
+		incident.Step++
+	}
+	if len(targets) > 0 {
+		incident.LastNotifiedAt = types.FromTime(now)
+		for _, target := range targets {
+			if !containsString(incident.NotifiedTargets, target) {
+				incident.NotifiedTargets = append(incident.NotifiedTargets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// resolved returns the targets to notify about resolution of incident.
+func (e *escalator) resolved(incident *types.Incident) []string {
+	if policy, ok := e.byName[incident.Policy]; ok && policy.NotifyResolved {
+		return incident.NotifiedTargets
+	}
+	return nil
+}
+
+// deliver emits the notification to its targets, as an event of type "incident".
+func (e *escalator) deliver(n *notification) {
+	incident := n.incident
+	metadata := incident.Metadata.Copy()
+	metadata["incident_id"] = incident.ID
+	metadata["escalation_policy"] = incident.Policy
+	metadata["escalation_step"] = incident.Step
+	metadata["escalation_repeats"] = incident.Repeats
+
+	status := incident.Status
+	description := incident.Description
+	if n.resolved {
+		status = types.OK
+		description = "Resolved: " + description
+	}
+
+	for _, target := range n.targets {
+		event := &types.Event{
+			Namespace:   incident.Namespace,
+			Type:        "incident",
+			Source:      "processor",
+			Timestamp:   types.FromTime(time.Now()),
+			Status:      status,
+			Identifier:  incident.Identifier,
+			Description: description,
+			Metadata:    metadata.Copy(),
+			RuleID:      incident.RuleID,
+		}
+		event.Metadata["escalation_target"] = target
+		if emitter, ok := e.emitters[target]; ok {
+			emitter.Emit(event)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// formatTargets is used for logging.
+func formatTargets(targets []string) string {
+	return strings.Join(targets, ",")
+}
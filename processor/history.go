@@ -0,0 +1,160 @@
+package processor
+
+import (
+	"github.com/openmetric/yamf/internal/eventdb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default time range of history queries
+const defaultHistoryRange = 24 * time.Hour
+
+// default max number of events returned by history queries
+const defaultHistoryLimit = 1000
+
+// apiParseTimeRange parses "from" and "to" query parameters, unix timestamps, "to"
+// defaults to now, "from" to def before "to". Writes 400 response if they're invalid.
+func apiParseTimeRange(c *gin.Context, def time.Duration) (from, to time.Time, ok bool) {
+	to = time.Now()
+	if str := c.Query("to"); str != "" {
+		ts, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			apiWriteFail(c, 400, "Bad to: %s", str)
+			return
+		}
+		to = time.Unix(ts, 0)
+	}
+	from = to.Add(-def)
+	if str := c.Query("from"); str != "" {
+		ts, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			apiWriteFail(c, 400, "Bad from: %s", str)
+			return
+		}
+		from = time.Unix(ts, 0)
+	}
+	if !from.Before(to) {
+		apiWriteFail(c, 400, "Bad time range, from must be before to")
+		return
+	}
+	return from, to, true
+}
+
+// apiParseHistoryQuery builds a history query from query parameters:
+//
+//	from, to        unix timestamps, defaults to the last 24 hours
+//	identifier      only events of this identifier
+//	rule_id         only events of this rule
+//	status          comma separated statuses, e.g. "1,2"
+//	metadata.<key>  only events with this metadata value
+//	order           "asc" (default) or "desc"
+//	limit           max number of events, defaults to 1000
+//
+// Writes 400 response and returns nil if they're invalid.
+func apiParseHistoryQuery(c *gin.Context) *eventdb.Query {
+	var ok bool
+	q := &eventdb.Query{Limit: defaultHistoryLimit}
+
+	if q.From, q.To, ok = apiParseTimeRange(c, defaultHistoryRange); !ok {
+		return nil
+	}
+	q.Identifier = c.Query("identifier")
+	if !apiIntQuery(c, "rule_id", &q.RuleID) || !apiIntQuery(c, "limit", &q.Limit) {
+		return nil
+	}
+	if str := c.Query("status"); str != "" {
+		for _, item := range strings.Split(str, ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(item))
+			if err != nil || status < types.OK || status > types.Unknown {
+				apiWriteFail(c, 400, "Bad status: %s", str)
+				return nil
+			}
+			q.Statuses = append(q.Statuses, status)
+		}
+	}
+	for key, values := range c.Request.URL.Query() {
+		if strings.HasPrefix(key, "metadata.") && len(values) > 0 {
+			if q.Metadata == nil {
+				q.Metadata = make(map[string]string)
+			}
+			q.Metadata[strings.TrimPrefix(key, "metadata.")] = values[0]
+		}
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		apiWriteFail(c, 400, "Bad order: %s", c.Query("order"))
+		return nil
+	}
+	return q
+}
+
+// apiCheckHistory writes 404 response if history is disabled.
+func (p *Processor) apiCheckHistory(c *gin.Context) bool {
+	if p.history == nil {
+		apiWriteFail(c, 404, "Event history is disabled")
+		return false
+	}
+	return true
+}
+
+// apiQueryHistory lists events in history, see apiParseHistoryQuery for parameters.
+func (p *Processor) apiQueryHistory(c *gin.Context) {
+	if !p.apiCheckHistory(c) {
+		return
+	}
+	q := apiParseHistoryQuery(c)
+	if q == nil {
+		return
+	}
+
+	events, err := p.history.Query(q)
+	if err != nil {
+		apiWriteFail(c, 500, "Error querying event history, err: %s", err)
+		return
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success: true,
+		Message: "",
+		Events:  events,
+	})
+}
+
+// apiCountHistory counts events in history by status, in buckets of "interval" (default
+// "1h"), other parameters are the same as apiQueryHistory, except order and limit.
+func (p *Processor) apiCountHistory(c *gin.Context) {
+	if !p.apiCheckHistory(c) {
+		return
+	}
+	q := apiParseHistoryQuery(c)
+	if q == nil {
+		return
+	}
+	interval, err := time.ParseDuration(c.DefaultQuery("interval", "1h"))
+	if err != nil || interval <= 0 {
+		apiWriteFail(c, 400, "Bad interval: %s", c.Query("interval"))
+		return
+	}
+	if n := q.To.Sub(q.From) / interval; n >= eventdb.MaxBuckets {
+		apiWriteFail(c, 400, "Interval too small, max %d buckets allowed", eventdb.MaxBuckets)
+		return
+	}
+
+	buckets, err := p.history.Count(q, interval)
+	if err != nil {
+		apiWriteFail(c, 500, "Error counting event history, err: %s", err)
+		return
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success: true,
+		Message: "",
+		Buckets: buckets,
+	})
+}
@@ -0,0 +1,307 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/braintree/manners"
+	"github.com/nsqio/go-nsq"
+	"github.com/openmetric/graphite-client"
+	"github.com/openmetric/yamf/executor"
+	"github.com/openmetric/yamf/internal/auth"
+	"github.com/openmetric/yamf/internal/eventdb"
+	"github.com/openmetric/yamf/internal/stats"
+	"github.com/openmetric/yamf/internal/types"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+type Config struct {
+	// API Server listen address
+	ListenAddress string `yaml:"listen_address"`
+	// authentication of endpoints changing incidents, the same as scheduler's, editors
+	// and admins can change incidents
+	Auth *auth.Config `yaml:"auth"`
+
+	// nsq consumer config, topic is the one executors emit events to
+	NSQLookupdHTTPAddr string `yaml:"nsqlookupd_http_address"`
+	NSQTopic           string `yaml:"nsq_topic"`
+	NSQChannel         string `yaml:"nsq_channel"`
+
+	// states and incidents are saved to this file periodically and on stop, and
+	// loaded on start, empty to keep them in memory only
+	StateFile        string        `yaml:"state_file"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+	// states of identifiers without events for this long are removed, and their open
+	// incidents resolved, e.g. metrics which are gone or rules which are deleted
+	StateTTL time.Duration `yaml:"state_ttl"`
+	// how many resolved incidents to keep, oldest ones are dropped first
+	MaxResolvedIncidents int `yaml:"max_resolved_incidents"`
+
+	// directory of event history, every event received is stored there, empty to
+	// disable history
+	HistoryDir string `yaml:"history_dir"`
+	// how long events are kept in history, 0 to keep them forever
+	HistoryRetention time.Duration `yaml:"history_retention"`
+
+	// how far before the range of an sla report to look for the status at its beginning
+	SLALookback time.Duration `yaml:"sla_lookback"`
+	// scheduler api, maintenance windows are fetched from it to be excluded from sla
+	// reports, with a bearer token if auth is enabled on scheduler
+	SchedulerURL   string `yaml:"scheduler_url"`
+	SchedulerToken string `yaml:"scheduler_token"`
+
+	// where escalation notifications are delivered, by target name
+	EscalationTargets map[string]*executor.EmitConfig `yaml:"escalation_targets"`
+	// the first policy matching an incident applies to it, incidents without a
+	// matching policy are not escalated
+	EscalationPolicies []*EscalationPolicy `yaml:"escalation_policies"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ListenAddress:        ":8081",
+		Auth:                 &auth.Config{},
+		NSQLookupdHTTPAddr:   "127.0.0.1:4161",
+		NSQTopic:             "yamf_events",
+		NSQChannel:           "yamf_processor",
+		StateFile:            "./var/processor-state.json",
+		SnapshotInterval:     30 * time.Second,
+		StateTTL:             24 * time.Hour,
+		MaxResolvedIncidents: 1000,
+		HistoryDir:           "./var/history",
+		HistoryRetention:     30 * 24 * time.Hour,
+		SLALookback:          7 * 24 * time.Hour,
+	}
+}
+
+// Processor implements main.Module, it consumes events emitted by executors, keeps the
+// current state of each identifier, and manages incidents.
+type Processor struct {
+	config *Config
+	logger *zap.SugaredLogger
+	stats  Stats
+
+	store     *stateStore
+	consumer  *nsq.Consumer
+	escalator *escalator
+	// nil if history is disabled
+	history *eventdb.Store
+	// client of scheduler api
+	httpClient *http.Client
+
+	apiServer     *manners.GracefulServer
+	apiServerStop chan struct{}
+	auth          *auth.Authenticator
+
+	maintainStop chan struct{}
+	maintainDone chan struct{}
+}
+
+func NewProcessor(config *Config, logger *zap.SugaredLogger) (*Processor, error) {
+	if config.MaxResolvedIncidents < 0 {
+		return nil, fmt.Errorf("max_resolved_incidents can not be negative")
+	}
+	processor := &Processor{
+		config:     config,
+		logger:     logger,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	processor.store = newStateStore(config.MaxResolvedIncidents, &processor.stats)
+
+	if config.Auth == nil {
+		config.Auth = &auth.Config{}
+	}
+	var err error
+	if processor.auth, err = auth.NewAuthenticator(config.Auth, logger, apiWriteFail); err != nil {
+		return nil, err
+	}
+	return processor, nil
+}
+
+func (p *Processor) Name() string {
+	return "processor"
+}
+
+func (p *Processor) Start() error {
+	var err error
+
+	if len(p.config.EscalationPolicies) > 0 {
+		if p.escalator, err = newEscalator(p.config.EscalationPolicies, p.config.EscalationTargets); err != nil {
+			return fmt.Errorf("failed to initialize escalation: %s", err)
+		}
+		p.store.escalator = p.escalator
+	}
+
+	if p.config.StateFile != "" {
+		if err = p.store.load(p.config.StateFile); err != nil {
+			return fmt.Errorf("failed to load state file: %s", err)
+		}
+		p.logger.Infow("Loaded state file.", "States", len(p.store.states), "Incidents", len(p.store.incidents))
+	}
+
+	if p.config.HistoryDir != "" {
+		if p.history, err = eventdb.Open(p.config.HistoryDir, p.config.HistoryRetention); err != nil {
+			return fmt.Errorf("failed to open event history: %s", err)
+		}
+	}
+
+	p.maintainStop = make(chan struct{})
+	p.maintainDone = make(chan struct{})
+	go p.maintain()
+
+	nsqConfig := nsq.NewConfig()
+	if p.consumer, err = nsq.NewConsumer(p.config.NSQTopic, p.config.NSQChannel, nsqConfig); err != nil {
+		return fmt.Errorf("failed to initialize nsq consumer: %s", err)
+	}
+	p.consumer.AddHandler(nsq.HandlerFunc(p.handleMessage))
+	if err = p.consumer.ConnectToNSQLookupd(p.config.NSQLookupdHTTPAddr); err != nil {
+		return fmt.Errorf("failed to connect to nsqlookupd: %s", err)
+	}
+
+	if err = p.runAPIServer(); err != nil {
+		return fmt.Errorf("failed to start api server: %s", err)
+	}
+
+	return nil
+}
+
+func (p *Processor) Stop() {
+	p.stopAPIServer()
+
+	if p.consumer != nil {
+		p.consumer.Stop()
+		<-p.consumer.StopChan
+	}
+
+	if p.maintainStop != nil {
+		close(p.maintainStop)
+		<-p.maintainDone
+	}
+
+	p.saveSnapshot()
+	if p.history != nil {
+		if err := p.history.Close(); err != nil {
+			p.logger.Errorw("Failed to close event history.", "Error", err)
+		}
+	}
+	if p.escalator != nil {
+		p.escalator.close()
+	}
+	p.logger.Info("processor stopped.")
+}
+
+func (p *Processor) GatherStats() []*graphite.Metric {
+	return stats.ToGraphiteMetric(p.stats, "")
+}
+
+func (p *Processor) handleMessage(message *nsq.Message) error {
+	event := &types.Event{}
+
+	p.stats.EventReceived.Inc()
+
+	if err := json.Unmarshal(message.Body, event); err != nil {
+		p.logger.Errorw("Failed to decode event from message.", "Error", err)
+		return nil
+	}
+	if event.Identifier == "" {
+		p.logger.Warnw("Event without identifier.", "Rule ID", event.RuleID)
+		return nil
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = types.FromTime(time.Now())
+	}
+
+	if p.history != nil {
+		if err := p.history.Add(event); err != nil {
+			p.stats.HistoryWriteFailed.Inc()
+			p.logger.Errorw("Failed to write event history.", "Error", err)
+		}
+	}
+
+	if change := p.store.apply(event); change != nil {
+		switch change.action {
+		case "open":
+			p.logger.Infow("Incident opened.", "Incident ID", change.incident.ID, "Identifier", event.Identifier, "Rule ID", event.RuleID, "Status", event.Status)
+		case "resolve":
+			p.logger.Infow("Incident resolved.", "Incident ID", change.incident.ID, "Identifier", event.Identifier, "Rule ID", event.RuleID)
+		}
+		p.deliver(change.notification)
+	}
+	return nil
+}
+
+// deliver sends an escalation notification, n can be nil.
+func (p *Processor) deliver(n *notification) {
+	if n == nil {
+		return
+	}
+	p.logger.Infow("Notifying incident.", "Incident ID", n.incident.ID, "Policy", n.incident.Policy, "Step", n.incident.Step, "Resolved", n.resolved, "Targets", formatTargets(n.targets))
+	p.escalator.deliver(n)
+	p.stats.NotificationSent.Add(uint64(len(n.targets)))
+}
+
+// maintain expires stale states and history, escalates incidents, writes history and
+// saves snapshots periodically, until maintainStop is closed.
+func (p *Processor) maintain() {
+	defer close(p.maintainDone)
+
+	snapshotTicker := time.NewTicker(p.config.SnapshotInterval)
+	defer snapshotTicker.Stop()
+	expireTicker := time.NewTicker(time.Minute)
+	defer expireTicker.Stop()
+	historyTicker := time.NewTicker(time.Second)
+	defer historyTicker.Stop()
+	var escalationTick <-chan time.Time
+	if p.escalator != nil {
+		escalationTicker := time.NewTicker(escalationInterval)
+		defer escalationTicker.Stop()
+		escalationTick = escalationTicker.C
+	}
+
+	for {
+		select {
+		case <-snapshotTicker.C:
+			p.saveSnapshot()
+		case <-historyTicker.C:
+			if p.history != nil {
+				if err := p.history.Flush(); err != nil {
+					p.stats.HistoryWriteFailed.Inc()
+					p.logger.Errorw("Failed to write event history.", "Error", err)
+				}
+			}
+		case <-expireTicker.C:
+			if p.config.StateTTL > 0 {
+				incidents, notifications := p.store.expire(time.Now().Add(-p.config.StateTTL))
+				for _, incident := range incidents {
+					p.logger.Infow("Incident resolved, state expired.", "Incident ID", incident.ID, "Identifier", incident.Identifier, "Rule ID", incident.RuleID)
+				}
+				for _, n := range notifications {
+					p.deliver(n)
+				}
+			}
+			if p.history != nil {
+				if n, err := p.history.Expire(time.Now()); err != nil {
+					p.logger.Errorw("Failed to expire event history.", "Error", err)
+				} else if n > 0 {
+					p.logger.Infow("Expired event history.", "Partitions", n)
+				}
+			}
+		case now := <-escalationTick:
+			for _, n := range p.store.escalate(now) {
+				p.deliver(n)
+			}
+		case <-p.maintainStop:
+			return
+		}
+	}
+}
+
+func (p *Processor) saveSnapshot() {
+	if p.config.StateFile == "" {
+		return
+	}
+	if err := p.store.save(p.config.StateFile); err != nil {
+		p.logger.Errorw("Failed to save state file.", "Error", err)
+	}
+}
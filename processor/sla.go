@@ -0,0 +1,430 @@
+package processor
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/internal/eventdb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default time range of sla reports
+const defaultSLARange = 30 * 24 * time.Hour
+
+// SLAReport is the availability of an identifier, or a group of identifiers, over a time
+// range. Times are in seconds, time without any known status and time excluded by
+// maintenance windows are not monitored.
+type SLAReport struct {
+	Group       string `json:"group"`
+	Identifiers int    `json:"identifiers"`
+	// percentage of monitored time not in Critical status, 0 if nothing is monitored
+	Uptime       float64 `json:"uptime"`
+	Monitored    float64 `json:"monitored"`
+	Excluded     float64 `json:"excluded"`
+	TimeOK       float64 `json:"time_ok"`
+	TimeWarning  float64 `json:"time_warning"`
+	TimeCritical float64 `json:"time_critical"`
+	TimeUnknown  float64 `json:"time_unknown"`
+	// number of problems (non-OK periods) started in the range
+	Incidents int `json:"incidents"`
+	// mean time to recover of problems started and recovered in the range
+	MTTR float64 `json:"mttr"`
+
+	recovered  int
+	repairTime time.Duration
+}
+
+// interval is a time range excluded from sla reports.
+type interval struct {
+	start, end time.Time
+}
+
+// mergeIntervals sorts intervals and merges overlapping ones.
+func mergeIntervals(intervals []interval) []interval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+	var merged []interval
+	for _, iv := range intervals {
+		if n := len(merged); n > 0 && !iv.start.After(merged[n-1].end) {
+			if iv.end.After(merged[n-1].end) {
+				merged[n-1].end = iv.end
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+	return merged
+}
+
+// overlap returns how much of [start, end) is covered by merged intervals.
+func overlap(start, end time.Time, merged []interval) time.Duration {
+	var d time.Duration
+	for _, iv := range merged {
+		s, e := iv.start, iv.end
+		if s.Before(start) {
+			s = start
+		}
+		if e.After(end) {
+			e = end
+		}
+		if e.After(s) {
+			d += e.Sub(s)
+		}
+	}
+	return d
+}
+
+type statusChange struct {
+	at     time.Time
+	status int
+}
+
+// slaSeries is the status history of an identifier of a rule.
+type slaSeries struct {
+	ruleID     int
+	identifier string
+	namespace  string
+	metadata   types.Metadata
+	// status changes in time order, the first one may be before the report range
+	changes []statusChange
+}
+
+func (s *slaSeries) add(at time.Time, status int, metadata types.Metadata) {
+	s.metadata = metadata
+	if n := len(s.changes); n > 0 && s.changes[n-1].status == status {
+		return
+	}
+	s.changes = append(s.changes, statusChange{at: at, status: status})
+}
+
+// group returns the value of the group_by field of the series.
+func (s *slaSeries) group(groupBy string) string {
+	switch {
+	case groupBy == "identifier":
+		return s.identifier
+	case groupBy == "rule_id":
+		return strconv.Itoa(s.ruleID)
+	case groupBy == "namespace":
+		return s.namespace
+	default:
+		value, _ := s.metadata.GetString(strings.TrimPrefix(groupBy, "metadata."))
+		return value
+	}
+}
+
+// accumulate adds the times of series in [from, to) to report, excluded intervals must
+// be merged.
+func (s *slaSeries) accumulate(report *SLAReport, from, to time.Time, excluded []interval) {
+	var problemStart time.Time
+	for i, change := range s.changes {
+		start, end := change.at, to
+		if start.Before(from) {
+			start = from
+		}
+		if i+1 < len(s.changes) {
+			end = s.changes[i+1].at
+		}
+
+		if end.After(start) {
+			skip := overlap(start, end, excluded)
+			seconds := (end.Sub(start) - skip).Seconds()
+			report.Excluded += skip.Seconds()
+			report.Monitored += seconds
+			switch change.status {
+			case types.OK:
+				report.TimeOK += seconds
+			case types.Warning:
+				report.TimeWarning += seconds
+			case types.Critical:
+				report.TimeCritical += seconds
+			case types.Unknown:
+				report.TimeUnknown += seconds
+			}
+		}
+
+		recovering := change.status == types.OK && i > 0 && s.changes[i-1].status != types.OK
+		starting := change.status != types.OK && (i == 0 || s.changes[i-1].status == types.OK)
+		switch {
+		case starting:
+			problemStart = change.at
+			if !change.at.Before(from) {
+				report.Incidents++
+			}
+		case recovering && !problemStart.Before(from):
+			report.recovered++
+			report.repairTime += change.at.Sub(problemStart)
+		}
+	}
+}
+
+// schedulerGet fetches an api of scheduler into v.
+func (p *Processor) schedulerGet(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(p.config.SchedulerURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if p.config.SchedulerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.SchedulerToken)
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("scheduler responded %s to %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchMaintenance fetches maintenance windows and rules from scheduler.
+func (p *Processor) fetchMaintenance() ([]*types.MaintenanceWindow, map[int]*types.Rule, error) {
+	windows := &struct {
+		Maintenance []*types.MaintenanceWindow `json:"maintenance"`
+	}{}
+	if err := p.schedulerGet("/v1/maintenance", windows); err != nil {
+		return nil, nil, err
+	}
+
+	rules := make(map[int]*types.Rule)
+	cursor := ""
+	for {
+		page := &struct {
+			Rules      []*types.Rule `json:"rules"`
+			NextCursor string        `json:"next_cursor"`
+		}{}
+		path := "/v1/rules?limit=1000"
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		if err := p.schedulerGet(path, page); err != nil {
+			return nil, nil, err
+		}
+		for _, rule := range page.Rules {
+			rules[rule.ID] = rule
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	return windows.Maintenance, rules, nil
+}
+
+// apiParseIntervals parses comma separated "<from>-<to>" unix timestamp ranges.
+func apiParseIntervals(str string) ([]interval, error) {
+	var result []interval
+	for _, item := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad range: %s", item)
+		}
+		start, err1 := strconv.ParseInt(parts[0], 10, 64)
+		end, err2 := strconv.ParseInt(parts[1], 10, 64)
+		if err1 != nil || err2 != nil || end <= start {
+			return nil, fmt.Errorf("bad range: %s", item)
+		}
+		result = append(result, interval{start: time.Unix(start, 0), end: time.Unix(end, 0)})
+	}
+	return result, nil
+}
+
+// apiSLA reports availability computed from event history, query parameters:
+//
+//	from, to             unix timestamps, defaults to the last 30 days
+//	identifier           only this identifier
+//	rule_id              only identifiers of this rule
+//	metadata.<key>       only identifiers with this metadata value
+//	group_by             "identifier" (default), "rule_id", "namespace" or
+//	                     "metadata.<key>"
+//	exclude_maintenance  "true" to exclude maintenance windows, fetched from scheduler
+//	exclude              comma separated "<from>-<to>" ranges to exclude
+//	format               "json" (default) or "csv"
+//
+// The status at the beginning of the range is looked up within sla_lookback before it,
+// or taken from the current state if the identifier has no events since.
+func (p *Processor) apiSLA(c *gin.Context) {
+	var err error
+
+	if !p.apiCheckHistory(c) {
+		return
+	}
+	q := &eventdb.Query{}
+	var ok bool
+	if q.From, q.To, ok = apiParseTimeRange(c, defaultSLARange); !ok {
+		return
+	}
+	if now := time.Now(); q.To.After(now) {
+		q.To = now
+		if !q.From.Before(q.To) {
+			apiWriteFail(c, 400, "Bad time range, from must be before now")
+			return
+		}
+	}
+	q.Identifier = c.Query("identifier")
+	if !apiIntQuery(c, "rule_id", &q.RuleID) {
+		return
+	}
+	for key, values := range c.Request.URL.Query() {
+		if strings.HasPrefix(key, "metadata.") && len(values) > 0 {
+			if q.Metadata == nil {
+				q.Metadata = make(map[string]string)
+			}
+			q.Metadata[strings.TrimPrefix(key, "metadata.")] = values[0]
+		}
+	}
+	groupBy := c.DefaultQuery("group_by", "identifier")
+	switch {
+	case groupBy == "identifier", groupBy == "rule_id", groupBy == "namespace":
+	case strings.HasPrefix(groupBy, "metadata.") && len(groupBy) > len("metadata."):
+	default:
+		apiWriteFail(c, 400, "Bad group_by: %s", groupBy)
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		apiWriteFail(c, 400, "Bad format: %s", format)
+		return
+	}
+
+	var excluded []interval
+	if str := c.Query("exclude"); str != "" {
+		if excluded, err = apiParseIntervals(str); err != nil {
+			apiWriteFail(c, 400, "Bad exclude: %s", err)
+			return
+		}
+	}
+	excludeMaintenance := false
+	if str := c.Query("exclude_maintenance"); str != "" {
+		if excludeMaintenance, err = strconv.ParseBool(str); err != nil {
+			apiWriteFail(c, 400, "Bad exclude_maintenance: %s", str)
+			return
+		}
+	}
+	var windows []*types.MaintenanceWindow
+	var rules map[int]*types.Rule
+	if excludeMaintenance {
+		if p.config.SchedulerURL == "" {
+			apiWriteFail(c, 400, "Can not exclude maintenance windows, scheduler_url is not configured")
+			return
+		}
+		if windows, rules, err = p.fetchMaintenance(); err != nil {
+			apiWriteFail(c, 502, "Error fetching maintenance windows from scheduler, err: %s", err)
+			return
+		}
+	}
+
+	// status of each identifier before the range, then changes in the range
+	series := make(map[string]*slaSeries)
+	var keys []string
+	collect := func(event *types.Event) bool {
+		key := stateKey(event.RuleID, event.Identifier)
+		s, ok := series[key]
+		if !ok {
+			s = &slaSeries{ruleID: event.RuleID, identifier: event.Identifier, namespace: event.Namespace}
+			series[key] = s
+			keys = append(keys, key)
+		}
+		s.add(event.Timestamp.Time, event.Status, event.Metadata)
+		return true
+	}
+	if p.config.SLALookback > 0 {
+		before := *q
+		before.From, before.To = q.From.Add(-p.config.SLALookback), q.From
+		err = p.history.Scan(&before, func(event *types.Event) bool {
+			// only the last status before the range matters
+			if s, ok := series[stateKey(event.RuleID, event.Identifier)]; ok {
+				s.changes = s.changes[:0]
+			}
+			return collect(event)
+		})
+		if err != nil {
+			apiWriteFail(c, 500, "Error querying event history, err: %s", err)
+			return
+		}
+	}
+	if err = p.history.Scan(q, collect); err != nil {
+		apiWriteFail(c, 500, "Error querying event history, err: %s", err)
+		return
+	}
+	for _, state := range p.store.listStates(func(state *types.State) bool {
+		_, ok := series[stateKey(state.RuleID, state.Identifier)]
+		return !ok && state.Since.Before(q.To) && q.Matches(&types.Event{Identifier: state.Identifier, RuleID: state.RuleID, Status: state.Status, Metadata: state.Metadata})
+	}) {
+		collect(&types.Event{Identifier: state.Identifier, RuleID: state.RuleID, Namespace: state.Namespace, Status: state.Status, Metadata: state.Metadata, Timestamp: state.Since})
+	}
+
+	reports := make(map[string]*SLAReport)
+	var groups []string
+	for _, key := range keys {
+		s := series[key]
+		group := s.group(groupBy)
+		report, ok := reports[group]
+		if !ok {
+			report = &SLAReport{Group: group}
+			reports[group] = report
+			groups = append(groups, group)
+		}
+		report.Identifiers++
+
+		seriesExcluded := append([]interval{}, excluded...)
+		if len(windows) > 0 {
+			rule, ok := rules[s.ruleID]
+			if !ok {
+				// deleted rules are only covered by windows without a selector
+				rule = &types.Rule{Namespace: s.namespace}
+			}
+			for _, w := range windows {
+				if w.Matches(rule) {
+					seriesExcluded = append(seriesExcluded, interval{start: w.Start.Time, end: w.End.Time})
+				}
+			}
+		}
+		s.accumulate(report, q.From, q.To, mergeIntervals(seriesExcluded))
+	}
+
+	sort.Strings(groups)
+	result := make([]*SLAReport, 0, len(groups))
+	for _, group := range groups {
+		report := reports[group]
+		if report.Monitored > 0 {
+			report.Uptime = (report.Monitored - report.TimeCritical) / report.Monitored * 100
+		}
+		if report.recovered > 0 {
+			report.MTTR = report.repairTime.Seconds() / float64(report.recovered)
+		}
+		result = append(result, report)
+	}
+
+	if format == "csv" {
+		writeSLACSV(c, result)
+		return
+	}
+	c.JSON(200, apiResponseBody{
+		Success: true,
+		Message: "",
+		SLA:     result,
+	})
+}
+
+func writeSLACSV(c *gin.Context, reports []*SLAReport) {
+	c.Header("Content-Type", "text/csv")
+	c.Status(200)
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"group", "identifiers", "uptime", "monitored", "excluded", "time_ok", "time_warning", "time_critical", "time_unknown", "incidents", "mttr"})
+	for _, r := range reports {
+		w.Write([]string{
+			r.Group, strconv.Itoa(r.Identifiers), f(r.Uptime), f(r.Monitored), f(r.Excluded),
+			f(r.TimeOK), f(r.TimeWarning), f(r.TimeCritical), f(r.TimeUnknown),
+			strconv.Itoa(r.Incidents), f(r.MTTR),
+		})
+	}
+	w.Flush()
+}
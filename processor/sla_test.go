@@ -0,0 +1,160 @@
+package processor
+
+import (
+	"github.com/openmetric/yamf/internal/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeIntervals(t *testing.T) {
+	t0 := time.Unix(1500000000, 0)
+	at := func(seconds int) time.Time { return t0.Add(time.Duration(seconds) * time.Second) }
+
+	merged := mergeIntervals([]interval{
+		{at(50), at(60)},
+		{at(0), at(10)},
+		{at(5), at(20)},
+		{at(20), at(30)},
+		{at(52), at(55)},
+	})
+	want := []interval{{at(0), at(30)}, {at(50), at(60)}}
+	if !reflect.DeepEqual(merged, want) {
+		t.Fatalf("merged to %v, want %v", merged, want)
+	}
+}
+
+func TestSLAAccumulate(t *testing.T) {
+	t0 := time.Unix(1500000000, 0)
+	at := func(seconds int) time.Time { return t0.Add(time.Duration(seconds) * time.Second) }
+	// the report range is [0, 100)
+	from, to := at(0), at(100)
+
+	type change struct {
+		at     int
+		status int
+	}
+	type window struct {
+		start, end int
+	}
+	cases := []struct {
+		name     string
+		changes  []change
+		excluded []window
+
+		ok, warning, critical, unknown, excludedTime float64
+		incidents, recovered                         int
+		repair                                       time.Duration
+	}{
+		{
+			name:    "status before the range",
+			changes: []change{{-50, types.OK}},
+			ok:      100,
+		},
+		{
+			name:      "problem in the range",
+			changes:   []change{{-10, types.OK}, {20, types.Critical}, {50, types.OK}},
+			ok:        70,
+			critical:  30,
+			incidents: 1,
+			recovered: 1,
+			repair:    30 * time.Second,
+		},
+		{
+			name:         "excluded window across status changes",
+			changes:      []change{{-10, types.OK}, {20, types.Critical}, {50, types.OK}},
+			excluded:     []window{{10, 30}},
+			ok:           60,
+			critical:     20,
+			excludedTime: 20,
+			incidents:    1,
+			recovered:    1,
+			repair:       30 * time.Second,
+		},
+		{
+			name:         "overlapping excluded windows",
+			changes:      []change{{-10, types.OK}, {20, types.Critical}, {50, types.OK}},
+			excluded:     []window{{10, 30}, {25, 60}},
+			ok:           50,
+			excludedTime: 50,
+			incidents:    1,
+			recovered:    1,
+			repair:       30 * time.Second,
+		},
+		{
+			name:         "excluded windows across range edges",
+			changes:      []change{{-50, types.OK}},
+			excluded:     []window{{-20, 10}, {90, 120}},
+			ok:           80,
+			excludedTime: 20,
+		},
+		{
+			name:         "whole range excluded",
+			changes:      []change{{-10, types.Warning}},
+			excluded:     []window{{-10, 200}},
+			excludedTime: 100,
+		},
+		{
+			name:     "problem started before the range",
+			changes:  []change{{-30, types.Critical}, {40, types.OK}},
+			ok:       60,
+			critical: 40,
+		},
+		{
+			name:      "change at the start of the range",
+			changes:   []change{{0, types.Warning}, {10, types.OK}},
+			ok:        90,
+			warning:   10,
+			incidents: 1,
+			recovered: 1,
+			repair:    10 * time.Second,
+		},
+		{
+			name:      "problem changing severity",
+			changes:   []change{{-10, types.OK}, {10, types.Warning}, {20, types.Critical}, {30, types.Unknown}, {40, types.OK}},
+			ok:        70,
+			warning:   10,
+			critical:  10,
+			unknown:   10,
+			incidents: 1,
+			recovered: 1,
+			repair:    30 * time.Second,
+		},
+		{
+			name:      "problem not recovered",
+			changes:   []change{{-10, types.OK}, {60, types.Critical}},
+			ok:        60,
+			critical:  40,
+			incidents: 1,
+		},
+	}
+
+	for _, c := range cases {
+		s := &slaSeries{}
+		for _, change := range c.changes {
+			s.add(at(change.at), change.status, nil)
+		}
+		var excluded []interval
+		for _, w := range c.excluded {
+			excluded = append(excluded, interval{at(w.start), at(w.end)})
+		}
+
+		report := &SLAReport{}
+		s.accumulate(report, from, to, mergeIntervals(excluded))
+
+		want := &SLAReport{
+			Monitored:    c.ok + c.warning + c.critical + c.unknown,
+			Excluded:     c.excludedTime,
+			TimeOK:       c.ok,
+			TimeWarning:  c.warning,
+			TimeCritical: c.critical,
+			TimeUnknown:  c.unknown,
+			Incidents:    c.incidents,
+			recovered:    c.recovered,
+			repairTime:   c.repair,
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, report, want)
+		}
+	}
+}
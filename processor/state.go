@@ -0,0 +1,436 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/openmetric/yamf/internal/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errIncidentNotFound = errors.New("incident not found")
+	errIncidentResolved = errors.New("incident is resolved")
+)
+
+// stateChange is an incident change caused by an event.
+type stateChange struct {
+	// "open", "update" or "resolve"
+	action   string
+	incident *types.Incident
+	// resolution to deliver to notified targets, if any
+	notification *notification
+}
+
+// stateStore keeps the current state of identifiers and their incidents. Identifiers are
+// tracked per rule, the same metric checked by two rules has two states.
+type stateStore struct {
+	states    map[string]*types.State
+	incidents map[int]*types.Incident
+	// ids of resolved incidents, in the order they were resolved
+	resolved []int
+	nextID   int
+	// whether anything changed since the last save
+	dirty bool
+
+	maxResolved int
+	stats       *Stats
+	// nil if escalation is not configured
+	escalator *escalator
+	sync.RWMutex
+}
+
+// snapshot is the content of the state file.
+type snapshot struct {
+	States    []*types.State    `json:"states"`
+	Incidents []*types.Incident `json:"incidents"`
+	NextID    int               `json:"next_id"`
+}
+
+func newStateStore(maxResolved int, stats *Stats) *stateStore {
+	return &stateStore{
+		states:      make(map[string]*types.State),
+		incidents:   make(map[int]*types.Incident),
+		nextID:      1,
+		maxResolved: maxResolved,
+		stats:       stats,
+	}
+}
+
+func stateKey(ruleID int, identifier string) string {
+	return strconv.Itoa(ruleID) + "/" + identifier
+}
+
+// apply updates the state of the event's identifier, and opens, updates or resolves its
+// incident. Silenced or inhibited events update existing incidents, but never open new
+// ones. Returns nil if no incident is changed.
+func (s *stateStore) apply(event *types.Event) *stateChange {
+	s.Lock()
+	defer s.Unlock()
+
+	ts := event.Timestamp
+	key := stateKey(event.RuleID, event.Identifier)
+	state, ok := s.states[key]
+	if ok && ts.Before(state.LastSeen.Time) {
+		s.stats.EventOutOfOrder.Inc()
+		return nil
+	}
+	if !ok {
+		state = &types.State{
+			Identifier: event.Identifier,
+			Namespace:  event.Namespace,
+			RuleID:     event.RuleID,
+			Status:     event.Status,
+			Since:      ts,
+		}
+		s.states[key] = state
+		s.stats.States.Inc()
+	}
+	if state.Status != event.Status {
+		state.Since = ts
+	}
+	state.Status = event.Status
+	state.Description = event.Description
+	state.Metadata = event.Metadata
+	state.LastSeen = ts
+	s.dirty = true
+
+	var incident *types.Incident
+	if state.IncidentID != 0 {
+		incident = s.incidents[state.IncidentID]
+	}
+
+	switch {
+	case event.Status == types.OK && incident != nil:
+		state.IncidentID = 0
+		s.resolve(incident, ts)
+		return &stateChange{action: "resolve", incident: incident, notification: s.resolvedNotification(incident)}
+	case event.Status == types.OK:
+		return nil
+	case incident != nil:
+		incident.Status = event.Status
+		incident.WorstStatus = types.WorseStatus(incident.WorstStatus, event.Status)
+		incident.Description = event.Description
+		incident.Metadata = event.Metadata
+		incident.UpdatedAt = ts
+		incident.Events++
+		return &stateChange{action: "update", incident: incident}
+	case event.SilencedBy != 0 || event.InhibitedBy != "":
+		return nil
+	}
+
+	incident = &types.Incident{
+		ID:          s.nextID,
+		Identifier:  event.Identifier,
+		Namespace:   event.Namespace,
+		RuleID:      event.RuleID,
+		State:       types.IncidentOpen,
+		Status:      event.Status,
+		WorstStatus: event.Status,
+		Description: event.Description,
+		Metadata:    event.Metadata,
+		OpenedAt:    ts,
+		UpdatedAt:   ts,
+		Events:      1,
+	}
+	s.nextID++
+	if s.escalator != nil {
+		s.escalator.assign(incident)
+	}
+	s.incidents[incident.ID] = incident
+	state.IncidentID = incident.ID
+	s.stats.IncidentOpened.Inc()
+	s.stats.OpenIncidents.Inc()
+	return &stateChange{action: "open", incident: incident}
+}
+
+// resolve marks incident as resolved, and drops the oldest resolved incidents beyond
+// maxResolved. Must be called with lock held.
+func (s *stateStore) resolve(incident *types.Incident, ts types.Time) {
+	incident.State = types.IncidentResolved
+	incident.UpdatedAt = ts
+	incident.ResolvedAt = ts
+	s.resolved = append(s.resolved, incident.ID)
+	s.stats.IncidentResolved.Inc()
+	s.stats.OpenIncidents.Dec()
+
+	for len(s.resolved) > s.maxResolved {
+		delete(s.incidents, s.resolved[0])
+		s.resolved = s.resolved[1:]
+	}
+}
+
+// resolvedNotification returns the notification of incident's resolution to deliver, nil
+// if there is none. Must be called with lock held.
+func (s *stateStore) resolvedNotification(incident *types.Incident) *notification {
+	if s.escalator == nil {
+		return nil
+	}
+	if targets := s.escalator.resolved(incident); len(targets) > 0 {
+		copied := *incident
+		return &notification{incident: &copied, targets: targets, resolved: true}
+	}
+	return nil
+}
+
+// expire removes states last seen before deadline, and resolves their open incidents,
+// which are returned with their resolution notifications.
+func (s *stateStore) expire(deadline time.Time) ([]*types.Incident, []*notification) {
+	s.Lock()
+	defer s.Unlock()
+
+	var resolved []*types.Incident
+	var notifications []*notification
+	now := types.FromTime(time.Now())
+	for key, state := range s.states {
+		if !state.LastSeen.Before(deadline) {
+			continue
+		}
+		if incident, ok := s.incidents[state.IncidentID]; ok && state.IncidentID != 0 {
+			s.resolve(incident, now)
+			resolved = append(resolved, incident)
+			if n := s.resolvedNotification(incident); n != nil {
+				notifications = append(notifications, n)
+			}
+		}
+		delete(s.states, key)
+		s.stats.States.Dec()
+		s.stats.StateExpired.Inc()
+		s.dirty = true
+	}
+	return resolved, notifications
+}
+
+// escalate advances open incidents whose next escalation step is due, and returns the
+// notifications to deliver.
+func (s *stateStore) escalate(now time.Time) []*notification {
+	s.Lock()
+	defer s.Unlock()
+
+	var notifications []*notification
+	for _, incident := range s.incidents {
+		if targets := s.escalator.due(incident, now); len(targets) > 0 {
+			copied := *incident
+			notifications = append(notifications, &notification{incident: &copied, targets: targets})
+			s.dirty = true
+		}
+	}
+	return notifications
+}
+
+// ack acknowledges an open incident, which stops its escalation.
+func (s *stateStore) ack(id int, by, comment string) (*types.Incident, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	incident, ok := s.incidents[id]
+	if !ok {
+		return nil, errIncidentNotFound
+	}
+	if incident.State != types.IncidentOpen {
+		return nil, errIncidentResolved
+	}
+	if !incident.Acknowledged {
+		incident.Acknowledged = true
+		incident.AckedBy = by
+		incident.AckedAt = types.FromTime(time.Now())
+		incident.AckComment = comment
+		s.stats.IncidentAcked.Inc()
+		s.dirty = true
+	}
+	copied := *incident
+	return &copied, nil
+}
+
+// unack removes the acknowledgement of an open incident, its escalation starts over from
+// the first step.
+func (s *stateStore) unack(id int) (*types.Incident, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	incident, ok := s.incidents[id]
+	if !ok {
+		return nil, errIncidentNotFound
+	}
+	if incident.State != types.IncidentOpen {
+		return nil, errIncidentResolved
+	}
+	if incident.Acknowledged {
+		incident.Acknowledged = false
+		incident.AckedBy = ""
+		incident.AckedAt = types.Time{}
+		incident.AckComment = ""
+		incident.Step = 0
+		incident.Repeats = 0
+		incident.EscalatedAt = types.FromTime(time.Now())
+		s.dirty = true
+	}
+	copied := *incident
+	return &copied, nil
+}
+
+// resolveIncident resolves an open incident manually, the next non-OK event of its
+// identifier opens a new incident. Returns the resolution notification to deliver too.
+func (s *stateStore) resolveIncident(id int, by string) (*types.Incident, *notification, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	incident, ok := s.incidents[id]
+	if !ok {
+		return nil, nil, errIncidentNotFound
+	}
+	if incident.State != types.IncidentOpen {
+		return nil, nil, errIncidentResolved
+	}
+	if state, ok := s.states[stateKey(incident.RuleID, incident.Identifier)]; ok && state.IncidentID == id {
+		state.IncidentID = 0
+	}
+	incident.ResolvedBy = by
+	s.resolve(incident, types.FromTime(time.Now()))
+	s.dirty = true
+	copied := *incident
+	return &copied, s.resolvedNotification(incident), nil
+}
+
+// listStates returns copies of states accepted by filter, ordered by identifier.
+func (s *stateStore) listStates(filter func(*types.State) bool) []*types.State {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := make([]*types.State, 0)
+	for _, state := range s.states {
+		if filter(state) {
+			copied := *state
+			result = append(result, &copied)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Identifier != result[j].Identifier {
+			return result[i].Identifier < result[j].Identifier
+		}
+		return result[i].RuleID < result[j].RuleID
+	})
+	return result
+}
+
+// listIncidents returns copies of incidents accepted by filter, newest first.
+func (s *stateStore) listIncidents(filter func(*types.Incident) bool) []*types.Incident {
+	s.RLock()
+	defer s.RUnlock()
+
+	result := make([]*types.Incident, 0)
+	for _, incident := range s.incidents {
+		if filter(incident) {
+			copied := *incident
+			result = append(result, &copied)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID > result[j].ID })
+	return result
+}
+
+// getIncident returns a copy of the incident, nil if it does not exist.
+func (s *stateStore) getIncident(id int) *types.Incident {
+	s.RLock()
+	defer s.RUnlock()
+
+	if incident, ok := s.incidents[id]; ok {
+		copied := *incident
+		return &copied
+	}
+	return nil
+}
+
+// save writes a snapshot to file if anything changed since the last save. The snapshot
+// is written to a temporary file first, so that a crash never leaves a partial file.
+func (s *stateStore) save(file string) error {
+	s.Lock()
+	if !s.dirty {
+		s.Unlock()
+		return nil
+	}
+	snap := &snapshot{NextID: s.nextID}
+	for _, state := range s.states {
+		snap.States = append(snap.States, state)
+	}
+	for _, incident := range s.incidents {
+		snap.Incidents = append(snap.Incidents, incident)
+	}
+	data, err := json.Marshal(snap)
+	s.dirty = false
+	s.Unlock()
+
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.Lock()
+		s.dirty = true
+		s.Unlock()
+	}
+	return err
+}
+
+// load replaces states and incidents with the ones in file, a missing file is not an
+// error.
+func (s *stateStore) load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	snap := &snapshot{}
+	if err = json.Unmarshal(data, snap); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.states = make(map[string]*types.State)
+	s.incidents = make(map[int]*types.Incident)
+	s.resolved = nil
+	s.nextID = snap.NextID
+	for _, state := range snap.States {
+		s.states[stateKey(state.RuleID, state.Identifier)] = state
+	}
+	open := 0
+	var resolved []*types.Incident
+	for _, incident := range snap.Incidents {
+		s.incidents[incident.ID] = incident
+		if incident.ID >= s.nextID {
+			s.nextID = incident.ID + 1
+		}
+		if incident.State == types.IncidentResolved {
+			resolved = append(resolved, incident)
+		} else {
+			open++
+		}
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].ResolvedAt.Before(resolved[j].ResolvedAt.Time) })
+	for _, incident := range resolved {
+		s.resolved = append(s.resolved, incident.ID)
+	}
+	s.stats.States.Set(int64(len(s.states)))
+	s.stats.OpenIncidents.Set(int64(open))
+	return nil
+}
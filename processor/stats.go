@@ -0,0 +1,21 @@
+package processor
+
+import (
+	"github.com/openmetric/yamf/internal/stats"
+)
+
+type Stats struct {
+	EventReceived stats.Counter `stats:"EventReceived"`
+	// events older than the current state of their identifier
+	EventOutOfOrder  stats.Counter `stats:"EventOutOfOrder"`
+	IncidentOpened   stats.Counter `stats:"IncidentOpened"`
+	IncidentResolved stats.Counter `stats:"IncidentResolved"`
+	IncidentAcked    stats.Counter `stats:"IncidentAcked"`
+	OpenIncidents    stats.Gauge   `stats:"OpenIncidents"`
+	// escalation notifications delivered, one per target
+	NotificationSent   stats.Counter `stats:"NotificationSent"`
+	States             stats.Gauge   `stats:"States"`
+	HistoryWriteFailed stats.Counter `stats:"HistoryWriteFailed"`
+	// states removed because no event was received for state_ttl
+	StateExpired stats.Counter `stats:"StateExpired"`
+}
@@ -3,18 +3,35 @@ package scheduler
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/braintree/manners"
+	"github.com/openmetric/yamf/executor"
+	"github.com/openmetric/yamf/internal/auth"
+	"github.com/openmetric/yamf/internal/ruledb"
 	"github.com/openmetric/yamf/internal/types"
+	"github.com/openmetric/yamf/internal/utils"
 	"gopkg.in/gin-gonic/gin.v1"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 )
 
 type apiResponseBody struct {
-	Success bool          `json:"success"`
-	Message string        `json:"message"`
-	Rules   []*types.Rule `json:"rules"`
+	Success bool           `json:"success"`
+	Message string         `json:"message"`
+	Rules   []*types.Rule  `json:"rules"`
+	Events  []*types.Event `json:"events,omitempty"`
+
+	Revisions []*types.RuleRevision `json:"revisions,omitempty"`
+	Audit     []*types.AuditRecord  `json:"audit,omitempty"`
+	Import    []*ImportResult       `json:"import,omitempty"`
+
+	Maintenance []*apiMaintenanceWindow `json:"maintenance,omitempty"`
+	Silences    []*types.Silence        `json:"silences,omitempty"`
+
+	// cursor for fetching the next page, empty if there are no more items
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 func apiWriteSuccess(c *gin.Context, rules []*types.Rule) {
@@ -25,10 +42,31 @@ func apiWriteSuccess(c *gin.Context, rules []*types.Rule) {
 	})
 }
 
+func apiWriteEvents(c *gin.Context, rules []*types.Rule, events []*types.Event) {
+	c.JSON(200, apiResponseBody{
+		Success: true,
+		Message: "",
+		Rules:   rules,
+		Events:  events,
+	})
+}
+
+func apiWriteRevisions(c *gin.Context, revisions []*types.RuleRevision) {
+	c.JSON(200, apiResponseBody{
+		Success:   true,
+		Message:   "",
+		Rules:     make([]*types.Rule, 0),
+		Revisions: revisions,
+	})
+}
+
 func apiWriteFail(c *gin.Context, code int, messageFmt string, v ...interface{}) {
+	message := fmt.Sprintf(messageFmt, v...)
+	// for audit log
+	c.Set("apiMessage", message)
 	c.JSON(code, apiResponseBody{
 		Success: false,
-		Message: fmt.Sprintf(messageFmt, v...),
+		Message: message,
 		Rules:   make([]*types.Rule, 0),
 	})
 }
@@ -43,31 +81,86 @@ func (s *Scheduler) apiGetRule(c *gin.Context) {
 		return
 	}
 
-	if rule, err = s.rdb.Get(id); dberr.Type(err) == dberr.ErrorNoDoc {
+	if rule, err = s.rdb.Get(id); err == ruledb.ErrNotFound {
 		apiWriteFail(c, 404, "Rule not found")
 	} else if err != nil {
 		apiWriteFail(c, 500, "Error loading rule from db, err: %s", err)
-	} else {
+	} else if apiCheckNamespace(c, rule) {
+		apiSetETag(c, rule)
 		apiWriteSuccess(c, []*types.Rule{rule})
 	}
 }
 
+// apiParseRuleQuery parses rule filters from query parameters:
+//
+//	selector  label selector, e.g. "team=infra,env!=prod"
+//	type      rule type
+//	paused    "true" or "false"
+//	q         free text search over name, query and identifier pattern
+//	sort      "id", "name" or "type", prefix with "-" for descending order
+//	limit     max number of rules to return
+//	cursor    next_cursor returned by the previous page
+//
+// Writes 400 response and returns nil if any of them is bad.
+func apiParseRuleQuery(c *gin.Context) *ruledb.Query {
+	var err error
+
+	q := &ruledb.Query{
+		Namespace: c.Param("ns"),
+		Type:      c.Query("type"),
+		Search:    c.Query("q"),
+		Sort:      c.Query("sort"),
+		Cursor:    c.Query("cursor"),
+	}
+
+	if q.Selector, err = types.ParseLabelSelector(c.Query("selector")); err != nil {
+		apiWriteFail(c, 400, "Bad selector: %s", err)
+		return nil
+	}
+	if str := c.Query("paused"); str != "" {
+		var paused bool
+		if paused, err = strconv.ParseBool(str); err != nil {
+			apiWriteFail(c, 400, "Bad paused: %s", str)
+			return nil
+		}
+		q.Paused = &paused
+	}
+	if str := c.Query("limit"); str != "" {
+		if q.Limit, err = strconv.Atoi(str); err != nil || q.Limit < 0 {
+			apiWriteFail(c, 400, "Bad limit: %s", str)
+			return nil
+		}
+	}
+
+	if err = q.Validate(); err != nil {
+		apiWriteFail(c, 400, "Bad query: %s", err)
+		return nil
+	}
+	return q
+}
+
+// apiListRules lists rules, see apiParseRuleQuery for supported query parameters.
 func (s *Scheduler) apiListRules(c *gin.Context) {
 	var rules []*types.Rule
-	var errors []error
+	var next string
 	var err error
 
-	if rules, errors, err = s.rdb.GetAll(); err != nil {
+	q := apiParseRuleQuery(c)
+	if q == nil {
+		return
+	}
+
+	if rules, next, err = s.rdb.Query(q); err != nil {
 		apiWriteFail(c, 500, "Error loading rules from db, err: %s", err)
-	} else {
-		var result []*types.Rule
-		for i, rule := range rules {
-			if errors[i] == nil {
-				result = append(result, rule)
-			}
-		}
-		apiWriteSuccess(c, result)
+		return
 	}
+
+	c.JSON(200, apiResponseBody{
+		Success:    true,
+		Message:    "",
+		Rules:      rules,
+		NextCursor: next,
+	})
 }
 
 func (s *Scheduler) apiCreateRule(c *gin.Context) {
@@ -86,38 +179,82 @@ func (s *Scheduler) apiCreateRule(c *gin.Context) {
 	}
 	// force reset rule.ID to 0, user should not provide an ID
 	rule.ID = 0
+	// rules created via api are always managed via api
+	rule.Source = ""
+	if ns := c.Param("ns"); ns != "" {
+		rule.Namespace = ns
+	}
+	apiSetAuditRules(c, nil, rule)
 	if err = rule.Validate(); err != nil {
 		apiWriteFail(c, 400, "Invalid rule: %s", err)
 		return
 	}
 
-	if _, err = s.rdb.Insert(rule); err != nil {
+	if !s.apiCheckScope(c, rule) {
+		return
+	}
+
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	if err = s.checkQuota(rule, true); err != nil {
+		apiWriteFail(c, 403, "Quota exceeded: %s", err)
+		return
+	}
+	if err = s.checkHeartbeatToken(rule, 0); err != nil {
+		apiWriteFail(c, 400, "Invalid rule: %s", err)
+		return
+	}
+
+	if _, err = s.rdb.Insert(rule); err == ruledb.ErrQuotaExceeded {
+		apiWriteFail(c, 403, "Quota exceeded: namespace %s already has the max allowed rules", rule.Namespace)
+		return
+	} else if err != nil {
 		apiWriteFail(c, 500, "Error saving rule to db, err: %s", err)
 		return
 	}
 
+	s.recordRevision("create", apiAuthor(c), nil, rule)
 	s.schedule(rule)
 
+	apiSetETag(c, rule)
 	apiWriteSuccess(c, []*types.Rule{rule})
 }
 
+// apiUpdateRule handles both PUT and PATCH. PUT replaces the whole rule, while PATCH
+// applies the body to the current rule as a JSON Merge Patch (RFC 7396).
 func (s *Scheduler) apiUpdateRule(c *gin.Context) {
 	var body []byte
-	var rule *types.Rule
+	var old, rule *types.Rule
 	var err error
-	var id int
+	var id, version int
 
 	if id, err = strconv.Atoi(c.Param("id")); err != nil {
 		apiWriteFail(c, 400, "Bad rule id: %s", c.Param("id"))
 		return
 	}
 
-	if rule, err = s.rdb.Get(id); err != nil {
-		apiWriteFail(c, 500, "Error loading old rule from db, err: %s", err)
+	if version, err = apiIfMatch(c); err != nil {
+		apiWriteFail(c, 400, "%s", err)
 		return
-	} else if rule == nil {
+	}
+
+	if old, err = s.rdb.Get(id); err == ruledb.ErrNotFound {
 		apiWriteFail(c, 404, "Rule id does not exist, not updating anything")
 		return
+	} else if err != nil {
+		apiWriteFail(c, 500, "Error loading old rule from db, err: %s", err)
+		return
+	}
+
+	if !apiCheckNamespace(c, old) {
+		return
+	}
+
+	apiSetAuditRules(c, old, nil)
+
+	if s.isReadOnlyRule(old) {
+		apiWriteFail(c, 403, "Rule is managed by rule files, it can not be modified via api")
+		return
 	}
 
 	if body, err = ioutil.ReadAll(c.Request.Body); err != nil {
@@ -125,77 +262,498 @@ func (s *Scheduler) apiUpdateRule(c *gin.Context) {
 		return
 	}
 
+	if c.Request.Method == "PATCH" {
+		var doc []byte
+		if doc, err = json.Marshal(old); err != nil {
+			apiWriteFail(c, 500, "Error encoding old rule, err: %s", err)
+			return
+		}
+		if body, err = utils.JSONMergePatch(doc, body); err != nil {
+			apiWriteFail(c, 400, "Error applying patch, err: %s", err)
+			return
+		}
+	}
+
 	rule = &types.Rule{}
 	if err = json.Unmarshal(body, rule); err != nil {
 		apiWriteFail(c, 400, "Error parsing body, err: %s", err)
+		return
 	}
 	// force reset rule.ID to 0, user should not provide an ID
 	rule.ID = 0
+	// source is not changeable via api
+	rule.Source = old.Source
+	if ns := c.Param("ns"); ns != "" {
+		rule.Namespace = ns
+	} else if rule.Namespace == "" {
+		rule.Namespace = old.Namespace
+	}
+	apiSetAuditRules(c, nil, rule)
 	if err = rule.Validate(); err != nil {
 		apiWriteFail(c, 400, "Invalid rule: %s", err)
+		return
 	}
 
-	if err = s.rdb.Update(id, rule); err != nil {
+	if !s.apiCheckScope(c, old, rule) {
+		return
+	}
+
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	if err = s.checkQuota(rule, rule.Namespace != old.Namespace); err != nil {
+		apiWriteFail(c, 403, "Quota exceeded: %s", err)
+		return
+	}
+	if err = s.checkHeartbeatToken(rule, id); err != nil {
+		apiWriteFail(c, 400, "Invalid rule: %s", err)
+		return
+	}
+
+	if err = s.rdb.UpdateIfMatch(id, version, rule); err == ruledb.ErrVersionConflict {
+		apiWriteFail(c, 412, "Rule has been modified by others, reload and try again")
+		return
+	} else if err == ruledb.ErrQuotaExceeded {
+		apiWriteFail(c, 403, "Quota exceeded: namespace %s already has the max allowed rules", rule.Namespace)
+		return
+	} else if err != nil {
 		apiWriteFail(c, 500, "Error saving rule to db, err: %s", err)
 		return
 	}
 
+	s.recordRevision("update", apiAuthor(c), old, rule)
 	s.schedule(rule)
 
+	apiSetETag(c, rule)
 	apiWriteSuccess(c, []*types.Rule{rule})
 }
 
 func (s *Scheduler) apiDeleteRule(c *gin.Context) {
 	var err error
 	var rule *types.Rule
-	var id int
+	var id, version int
 
 	if id, err = strconv.Atoi(c.Param("id")); err != nil {
 		apiWriteFail(c, 400, "Bad rule id: %s", c.Param("id"))
 		return
 	}
 
-	if rule, err = s.rdb.Get(id); err != nil {
+	if version, err = apiIfMatch(c); err != nil {
+		apiWriteFail(c, 400, "%s", err)
+		return
+	}
+
+	if rule, err = s.rdb.Get(id); err == ruledb.ErrNotFound {
+		apiWriteFail(c, 404, "Rule id does not exist, not deleting anything")
+		return
+	} else if err != nil {
 		apiWriteFail(c, 500, "Error loading rule from db, err: %s", err)
 		return
-	} else if rule == nil {
-		apiWriteFail(c, 404, "Rule id does not exist, not updating anything")
+	}
+
+	if !apiCheckNamespace(c, rule) {
 		return
 	}
 
-	if err = s.rdb.Delete(id); err != nil {
+	apiSetAuditRules(c, rule, nil)
+
+	if s.isReadOnlyRule(rule) {
+		apiWriteFail(c, 403, "Rule is managed by rule files, it can not be deleted via api")
+		return
+	}
+
+	if !s.apiCheckScope(c, rule) {
+		return
+	}
+
+	if err = s.rdb.DeleteIfMatch(id, version); err == ruledb.ErrVersionConflict {
+		apiWriteFail(c, 412, "Rule has been modified by others, reload and try again")
+		return
+	} else if err != nil {
 		apiWriteFail(c, 500, "Error deleting rule from db, err: %s", err)
+		return
 	}
 
+	s.recordRevision("delete", apiAuthor(c), rule, nil)
 	s.stop(id)
 
 	apiWriteSuccess(c, []*types.Rule{rule})
 }
 
-func (s *Scheduler) runAPIServer() {
+func (s *Scheduler) apiListRevisions(c *gin.Context) {
+	var revisions []*types.RuleRevision
+	var id int
+	var err error
+
+	if id, err = strconv.Atoi(c.Param("id")); err != nil {
+		apiWriteFail(c, 400, "Bad rule id: %s", c.Param("id"))
+		return
+	}
+
+	if revisions, err = s.rdb.GetRevisions(id); err != nil {
+		apiWriteFail(c, 500, "Error loading revisions from db, err: %s", err)
+		return
+	} else if len(revisions) == 0 {
+		apiWriteFail(c, 404, "No revisions found for rule")
+		return
+	}
+
+	if latest := revisions[len(revisions)-1]; latest.Rule != nil && !apiCheckNamespace(c, latest.Rule) {
+		return
+	}
+
+	apiWriteRevisions(c, revisions)
+}
+
+// apiRestoreRevision restores a rule to the definition in one of its revisions, the
+// restore itself is recorded as a new revision.
+func (s *Scheduler) apiRestoreRevision(c *gin.Context) {
+	var old *types.Rule
+	var revision *types.RuleRevision
+	var id, rev, version int
+	var err error
+
+	if id, err = strconv.Atoi(c.Param("id")); err != nil {
+		apiWriteFail(c, 400, "Bad rule id: %s", c.Param("id"))
+		return
+	}
+	if rev, err = strconv.Atoi(c.Param("rev")); err != nil {
+		apiWriteFail(c, 400, "Bad revision: %s", c.Param("rev"))
+		return
+	}
+	if version, err = apiIfMatch(c); err != nil {
+		apiWriteFail(c, 400, "%s", err)
+		return
+	}
+
+	if old, err = s.rdb.Get(id); err == ruledb.ErrNotFound {
+		apiWriteFail(c, 404, "Rule id does not exist, deleted rules can not be restored")
+		return
+	} else if err != nil {
+		apiWriteFail(c, 500, "Error loading rule from db, err: %s", err)
+		return
+	}
+
+	if !apiCheckNamespace(c, old) {
+		return
+	}
+
+	apiSetAuditRules(c, old, nil)
+
+	if s.isReadOnlyRule(old) {
+		apiWriteFail(c, 403, "Rule is managed by rule files, it can not be modified via api")
+		return
+	}
+
+	if revision, err = s.rdb.GetRevision(id, rev); err != nil {
+		apiWriteFail(c, 500, "Error loading revision from db, err: %s", err)
+		return
+	} else if revision == nil || revision.Rule == nil || revision.Action == "delete" {
+		apiWriteFail(c, 404, "Revision not found")
+		return
+	}
+
+	rule := revision.Rule
+	rule.ID = 0
+	rule.Source = old.Source
+	if ns := c.Param("ns"); ns != "" {
+		rule.Namespace = ns
+	}
+	apiSetAuditRules(c, nil, rule)
+	if err = rule.Validate(); err != nil {
+		apiWriteFail(c, 400, "Invalid rule: %s", err)
+		return
+	}
+
+	if !s.apiCheckScope(c, old, rule) {
+		return
+	}
+
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	if err = s.checkQuota(rule, rule.Namespace != old.Namespace); err != nil {
+		apiWriteFail(c, 403, "Quota exceeded: %s", err)
+		return
+	}
+	if err = s.checkHeartbeatToken(rule, id); err != nil {
+		apiWriteFail(c, 400, "Invalid rule: %s", err)
+		return
+	}
+
+	if err = s.rdb.UpdateIfMatch(id, version, rule); err == ruledb.ErrVersionConflict {
+		apiWriteFail(c, 412, "Rule has been modified by others, reload and try again")
+		return
+	} else if err == ruledb.ErrQuotaExceeded {
+		apiWriteFail(c, 403, "Quota exceeded: namespace %s already has the max allowed rules", rule.Namespace)
+		return
+	} else if err != nil {
+		apiWriteFail(c, 500, "Error saving rule to db, err: %s", err)
+		return
+	}
+
+	s.recordRevision("restore", apiAuthor(c), old, rule)
+	s.schedule(rule)
+
+	apiSetETag(c, rule)
+	apiWriteSuccess(c, []*types.Rule{rule})
+}
+
+// apiSetETag sets ETag header to the rule's version.
+func apiSetETag(c *gin.Context, rule *types.Rule) {
+	c.Header("ETag", fmt.Sprintf(`"%d"`, rule.Version))
+}
+
+// apiIfMatch parses If-Match header, returns the rule version expected by the client.
+// 0 is returned if there's no If-Match header, or it's "*". Lists of entity tags are
+// not supported.
+func apiIfMatch(c *gin.Context) (int, error) {
+	str := strings.TrimSpace(c.Request.Header.Get("If-Match"))
+	if str == "" || str == "*" {
+		return 0, nil
+	}
+	if strings.Contains(str, ",") {
+		return 0, fmt.Errorf("Multiple entity tags in If-Match header are not supported: %s", str)
+	}
+
+	etag := strings.Trim(strings.TrimPrefix(str, "W/"), `"`)
+	if version, err := strconv.Atoi(etag); err != nil || version <= 0 {
+		return 0, fmt.Errorf("Bad If-Match header: %s", str)
+	} else {
+		return version, nil
+	}
+}
+
+// apiCheckScope checks if the user is allowed to modify all of the rules (nil rules are
+// skipped), writes 403 response if not.
+func (s *Scheduler) apiCheckScope(c *gin.Context, rules ...*types.Rule) bool {
+	user := auth.APIUser(c)
+	for _, rule := range rules {
+		if rule != nil && !user.CanModify(rule) {
+			s.auth.LogDenied(c, user, fmt.Sprintf("rule labels out of scope %q", user.Scope))
+			apiWriteFail(c, 403, "Permission denied, rule labels out of scope: %s", user.Scope)
+			return false
+		}
+	}
+	return true
+}
+
+// apiAuthor returns who made the request.
+func apiAuthor(c *gin.Context) string {
+	return auth.APIUser(c).Name
+}
+
+// isReadOnlyRule tells whether the rule can not be modified via api. Rule files are the
+// source of truth of file managed rules, modifications via api would be reverted by
+// the next scan of rule files.
+func (s *Scheduler) isReadOnlyRule(rule *types.Rule) bool {
+	return rule.Source == types.RuleSourceFile
+}
+
+func (s *Scheduler) apiRunRule(c *gin.Context) {
+	var rule *types.Rule
+	var id int
+	var err error
+
+	if id, err = strconv.Atoi(c.Param("id")); err != nil {
+		apiWriteFail(c, 400, "Bad rule id: %s", c.Param("id"))
+		return
+	}
+
+	if rule, err = s.rdb.Get(id); err == ruledb.ErrNotFound {
+		apiWriteFail(c, 404, "Rule not found")
+		return
+	} else if err != nil {
+		apiWriteFail(c, 500, "Error loading rule from db, err: %s", err)
+		return
+	}
+
+	if !apiCheckNamespace(c, rule) || !s.apiCheckScope(c, rule) {
+		return
+	}
+
+	s.emitTask(rule)
+
+	apiWriteSuccess(c, []*types.Rule{rule})
+}
+
+// apiTestRule executes the check of an unsaved rule synchronously, and returns
+// events that would be emitted. Nothing is saved or scheduled.
+func (s *Scheduler) apiTestRule(c *gin.Context) {
+	var body []byte
+	var events []*types.Event
+	var err error
+
+	if body, err = ioutil.ReadAll(c.Request.Body); err != nil {
+		apiWriteFail(c, 500, "Error reading request body, err: %s", err)
+		return
+	}
+
+	rule := &types.Rule{}
+	if err = json.Unmarshal(body, rule); err != nil {
+		apiWriteFail(c, 400, "Error parsing body, err: %s", err)
+		return
+	}
+	rule.ID = 0
+	if ns := c.Param("ns"); ns != "" {
+		rule.Namespace = ns
+	}
+	if err = rule.Validate(); err != nil {
+		apiWriteFail(c, 400, "Invalid rule: %s", err)
+		return
+	}
+
+	if !s.apiCheckScope(c, rule) {
+		return
+	}
+	if err = s.checkTestHosts(rule); err != nil {
+		apiWriteFail(c, 403, "Permission denied, %s", err)
+		return
+	}
+
+	if events, err = executor.Execute(s.newTask(rule)); err != nil {
+		apiWriteFail(c, 500, "Error executing check, err: %s", err)
+		return
+	}
+
+	apiWriteEvents(c, []*types.Rule{rule}, events)
+}
+
+// checkTestHosts checks graphite urls of a rule tested via api against
+// TestGraphiteHosts, the scheduler makes the requests itself.
+func (s *Scheduler) checkTestHosts(rule *types.Rule) error {
+	check, ok := rule.Check.(*types.GraphiteCheck)
+	if !ok || len(s.config.TestGraphiteHosts) == 0 {
+		return nil
+	}
+
+	urls := []string{check.GraphiteURL}
+	for _, q := range check.Queries {
+		urls = append(urls, q.GraphiteURL)
+	}
+	for _, graphiteURL := range urls {
+		u, err := url.Parse(graphiteURL)
+		if err != nil {
+			return fmt.Errorf("bad graphite_url %s: %s", graphiteURL, err)
+		}
+		allowed := false
+		for _, host := range s.config.TestGraphiteHosts {
+			if host == u.Host || host == u.Hostname() {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("graphite host %s is not allowed for testing rules", u.Host)
+		}
+	}
+	return nil
+}
+
+// apiGetRuleAction dispatches GET requests on /rules/:id, see apiPostRuleAction.
+func (s *Scheduler) apiGetRuleAction(c *gin.Context) {
+	switch c.Param("id") {
+	case "export":
+		s.apiExportRules(c)
+	default:
+		s.apiGetRule(c)
+	}
+}
+
+// apiPostRuleAction dispatches POST requests on /rules/:id. httprouter does not
+// allow a static path segment next to a wildcard, so collection level actions
+// (e.g. /rules/test) are routed through here.
+func (s *Scheduler) apiPostRuleAction(c *gin.Context) {
+	switch c.Param("id") {
+	case "test":
+		s.apiTestRule(c)
+	case "import":
+		s.apiImportRules(c)
+	case "pause":
+		s.apiBulkSetPaused(c, true)
+	case "resume":
+		s.apiBulkSetPaused(c, false)
+	default:
+		apiWriteFail(c, 404, "no such endpoint")
+	}
+}
+
+// registerRuleRoutes registers rule endpoints under group, which is either the api root
+// or a namespace ("/namespaces/:ns").
+func (s *Scheduler) registerRuleRoutes(group *gin.RouterGroup) {
+	read := s.auth.RequireRole(auth.RoleReadOnly)
+	edit := s.auth.RequireRole(auth.RoleEditor)
+
+	group.GET("/rules", read, s.apiListRules)
+	group.POST("/rules", s.apiAudit("create"), edit, s.apiCreateRule)
+	group.GET("/rules/:id", read, s.apiGetRuleAction)
+	group.PUT("/rules/:id", s.apiAudit("update"), edit, s.apiUpdateRule)
+	group.PATCH("/rules/:id", s.apiAudit("update"), edit, s.apiUpdateRule)
+	group.DELETE("/rules/:id", s.apiAudit("delete"), edit, s.apiDeleteRule)
+	group.POST("/rules/:id", edit, s.apiPostRuleAction)
+	group.POST("/rules/:id/run", edit, s.apiRunRule)
+	group.POST("/rules/:id/pause", s.apiAudit("pause"), edit, s.apiSetPaused(true))
+	group.POST("/rules/:id/resume", s.apiAudit("resume"), edit, s.apiSetPaused(false))
+	group.GET("/rules/:id/revisions", read, s.apiListRevisions)
+	group.POST("/rules/:id/revisions/:rev/restore", s.apiAudit("restore"), edit, s.apiRestoreRevision)
+
+	group.GET("/maintenance", read, s.apiListMaintenance)
+	group.POST("/maintenance", edit, s.apiCreateMaintenance)
+	group.DELETE("/maintenance/:id", edit, s.apiDeleteMaintenance)
+}
+
+func (s *Scheduler) runAPIServer() error {
 	gin.SetMode(gin.ReleaseMode)
 
 	router := gin.New()
 	router.Use(gin.Recovery())
 	router.NoRoute(func(c *gin.Context) { apiWriteFail(c, 404, "no such endpoint") })
 
+	// authenticated by token of heartbeat rules
+	router.POST("/v1/heartbeat/:token", s.apiHeartbeat)
+
 	v1 := router.Group("v1")
-	v1.GET("/rules", s.apiListRules)
-	v1.POST("/rules", s.apiCreateRule)
-	v1.GET("/rules/:id", s.apiGetRule)
-	v1.PUT("/rules/:id", s.apiUpdateRule)
-	v1.PATCH("/rules/:id", s.apiUpdateRule)
-	v1.DELETE("/rules/:id", s.apiDeleteRule)
+	v1.Use(s.auth.Authenticate)
+	s.registerRuleRoutes(v1)
+	s.registerRuleRoutes(v1.Group("/namespaces/:ns"))
+	v1.GET("/audit", s.auth.RequireRole(auth.RoleAdmin), s.apiListAudit)
+	v1.GET("/silences", s.auth.RequireRole(auth.RoleReadOnly), s.apiListSilences)
+	v1.POST("/silences", s.auth.RequireRole(auth.RoleEditor), s.apiCreateSilence)
+	v1.DELETE("/silences/:id", s.auth.RequireRole(auth.RoleEditor), s.apiExpireSilence)
+
+	s.apiServer = manners.NewWithServer(&http.Server{
+		Addr:    s.config.ListenAddress,
+		Handler: router,
+	})
+
+	var reloader *certReloader
+	var err error
+	if s.config.TLS != nil {
+		if reloader, err = newCertReloader(s.config.TLS); err != nil {
+			return err
+		}
+	}
 
+	s.apiServerStop = make(chan struct{})
 	go func() {
-		s.apiServerStop = make(chan struct{})
-		manners.ListenAndServe(s.config.ListenAddress, router)
+		var err error
+		if reloader != nil {
+			reloadStop := make(chan struct{})
+			go s.watchReloadSignal(reloader, reloadStop)
+			err = s.apiServer.ListenAndServeTLSWithConfig(reloader.tlsConfig())
+			close(reloadStop)
+		} else {
+			err = s.apiServer.ListenAndServe()
+		}
+		if err != nil {
+			s.logger.Errorw("API server stopped with error.", "Error", err)
+		}
 		close(s.apiServerStop)
 	}()
+
+	return nil
 }
 
 func (s *Scheduler) stopAPIServer() {
 	s.logger.Infof("shutting down api server...")
-	manners.Close()
+	s.apiServer.Close()
 	<-s.apiServerStop
 }
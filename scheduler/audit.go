@@ -0,0 +1,254 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/executor"
+	"github.com/openmetric/yamf/internal/ruledb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AuditConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// where to write audit records besides the database, "file", "emitter" or empty
+	Type string `yaml:"type"`
+	// file sink, records are written as json lines
+	Filename string `yaml:"filename"`
+	// emitter sink, records are published as events of type "audit"
+	Emit *executor.EmitConfig `yaml:"emit"`
+}
+
+// auditSink writes audit records out of yamf
+type auditSink interface {
+	Write(*types.AuditRecord) error
+	Close()
+}
+
+type fileAuditSink struct {
+	file *os.File
+	sync.Mutex
+}
+
+func newFileAuditSink(filename string) (*fileAuditSink, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{file: file}, nil
+}
+
+func (s *fileAuditSink) Write(record *types.AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+func (s *fileAuditSink) Close() {
+	s.file.Close()
+}
+
+type emitterAuditSink struct {
+	emitter executor.Emitter
+}
+
+func (s *emitterAuditSink) Write(record *types.AuditRecord) error {
+	status := types.OK
+	if !record.Success {
+		status = types.Warning
+	}
+
+	s.emitter.Emit(&types.Event{
+		Type:        "audit",
+		Source:      "scheduler",
+		Timestamp:   record.Timestamp,
+		Status:      status,
+		Identifier:  fmt.Sprintf("audit.rule.%d", record.RuleID),
+		Description: fmt.Sprintf("%s %s rule %d: %s", record.Actor, record.Action, record.RuleID, record.Message),
+		Metadata: types.Metadata{
+			"actor":     record.Actor,
+			"source_ip": record.SourceIP,
+			"action":    record.Action,
+			"code":      record.Code,
+		},
+		RuleID: record.RuleID,
+		Result: record,
+	})
+	return nil
+}
+
+func (s *emitterAuditSink) Close() {
+	s.emitter.Close()
+}
+
+func newAuditSink(config *AuditConfig) (auditSink, error) {
+	switch config.Type {
+	case "":
+		return nil, nil
+	case "file":
+		return newFileAuditSink(config.Filename)
+	case "emitter":
+		if config.Emit == nil {
+			return nil, fmt.Errorf("audit emitter is not configured")
+		}
+		emitter, err := executor.NewEmitter(config.Emit)
+		if err != nil {
+			return nil, err
+		}
+		return &emitterAuditSink{emitter: emitter}, nil
+	default:
+		return nil, fmt.Errorf("unsupported audit type: %s", config.Type)
+	}
+}
+
+func (s *Scheduler) writeAudit(record *types.AuditRecord) {
+	if err := s.rdb.AddAuditRecord(record); err != nil {
+		s.logger.Errorw("Failed to save audit record.", "Rule ID", record.RuleID, "Error", err)
+	}
+	if s.auditSink != nil {
+		if err := s.auditSink.Write(record); err != nil {
+			s.logger.Errorw("Failed to write audit record.", "Rule ID", record.RuleID, "Error", err)
+		}
+	}
+}
+
+// apiSetAuditRules tells the audit middleware the rule before and after the request,
+// either of them can be nil.
+func apiSetAuditRules(c *gin.Context, before, after *types.Rule) {
+	if before != nil {
+		c.Set("auditBefore", before)
+	}
+	if after != nil {
+		c.Set("auditAfter", after)
+	}
+}
+
+// apiAudit returns a middleware which records the request in audit log after it's
+// handled, no matter whether it succeeded.
+func (s *Scheduler) apiAudit(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if !s.config.Audit.Enabled {
+			return
+		}
+
+		record := &types.AuditRecord{
+			Timestamp: types.FromTime(time.Now()),
+			Actor:     apiAuthor(c),
+			SourceIP:  c.ClientIP(),
+			Action:    action,
+			Code:      c.Writer.Status(),
+			Success:   c.Writer.Status() < 400,
+		}
+		record.RuleID, _ = strconv.Atoi(c.Param("id"))
+		if v, ok := c.Get("auditBefore"); ok {
+			record.Before = v.(*types.Rule)
+		}
+		if v, ok := c.Get("auditAfter"); ok {
+			record.After = v.(*types.Rule)
+			if record.RuleID == 0 {
+				record.RuleID = record.After.ID
+			}
+		}
+		if v, ok := c.Get("apiMessage"); ok {
+			record.Message = v.(string)
+		}
+		if action == "update" && record.Before != nil && record.After != nil && record.Before.Paused != record.After.Paused {
+			if record.After.Paused {
+				record.Action = "pause"
+			} else {
+				record.Action = "resume"
+			}
+		}
+
+		s.writeAudit(record)
+	}
+}
+
+// auditChange records a change to a single rule, for requests which change multiple
+// rules. The apiAudit middleware records only one record per request.
+func (s *Scheduler) auditChange(c *gin.Context, action string, before, after *types.Rule, message string) {
+	if !s.config.Audit.Enabled {
+		return
+	}
+
+	record := &types.AuditRecord{
+		Timestamp: types.FromTime(time.Now()),
+		Actor:     apiAuthor(c),
+		SourceIP:  c.ClientIP(),
+		Action:    action,
+		Before:    before,
+		After:     after,
+		Success:   true,
+		Code:      200,
+		Message:   message,
+	}
+	if after != nil {
+		record.RuleID = after.ID
+	} else if before != nil {
+		record.RuleID = before.ID
+	}
+	s.writeAudit(record)
+}
+
+// apiListAudit queries audit records, supported query parameters:
+//
+//	actor    who made the change
+//	action   create, update, pause, resume, delete or restore
+//	rule_id  id of the changed rule
+//	from     unix timestamp
+//	until    unix timestamp
+//	limit    max number of records, newest first
+func (s *Scheduler) apiListAudit(c *gin.Context) {
+	var records []*types.AuditRecord
+	var err error
+
+	q := &ruledb.AuditQuery{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+	}
+	ints := map[string]*int{"rule_id": &q.RuleID, "limit": &q.Limit}
+	for name, v := range ints {
+		if str := c.Query(name); str != "" {
+			if *v, err = strconv.Atoi(str); err != nil || *v < 0 {
+				apiWriteFail(c, 400, "Bad %s: %s", name, str)
+				return
+			}
+		}
+	}
+	times := map[string]*time.Time{"from": &q.From, "until": &q.Until}
+	for name, v := range times {
+		if str := c.Query(name); str != "" {
+			ts, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				apiWriteFail(c, 400, "Bad %s: %s", name, str)
+				return
+			}
+			*v = time.Unix(ts, 0)
+		}
+	}
+
+	if records, err = s.rdb.QueryAudit(q); err != nil {
+		apiWriteFail(c, 500, "Error loading audit records from db, err: %s", err)
+		return
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success: true,
+		Message: "",
+		Rules:   make([]*types.Rule, 0),
+		Audit:   records,
+	})
+}
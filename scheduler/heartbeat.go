@@ -0,0 +1,131 @@
+package scheduler
+
+import (
+	"fmt"
+	"github.com/openmetric/yamf/internal/ruledb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"time"
+)
+
+// heartbeatCheck returns a copy of check of rule, with time of the last ping. Rules never
+// pinged count from the time they started running, so that jobs which never ran are
+// reported too.
+func (s *Scheduler) heartbeatCheck(rule *types.Rule, check *types.HeartbeatCheck) *types.HeartbeatCheck {
+	c := *check
+	c.LastSeen = nil
+	if rule.ID == 0 {
+		return &c
+	}
+
+	lastSeen, err := s.rdb.GetHeartbeat(rule.ID)
+	if err != nil {
+		s.logger.Errorw("Failed to read heartbeat from db.", "Rule ID", rule.ID, "Error", err)
+		return &c
+	}
+	if lastSeen.IsZero() {
+		s.RLock()
+		r, ok := s.rules[rule.ID]
+		s.RUnlock()
+		if !ok {
+			return &c
+		}
+		lastSeen = r.started
+	}
+	t := types.FromTime(lastSeen)
+	c.LastSeen = &t
+	return &c
+}
+
+// apiHeartbeat records a ping of heartbeat rules with the token, and runs their checks so
+// that recovery is reported right away. Jobs pinging are not api users, the token is the
+// secret, so this is not authenticated.
+func (s *Scheduler) apiHeartbeat(c *gin.Context) {
+	s.RLock()
+	rule, ok := s.heartbeats[c.Param("token")]
+	if ok {
+		// paused rules are not pinged
+		_, ok = s.rules[rule.ID]
+	}
+	s.RUnlock()
+	if !ok {
+		apiWriteFail(c, 404, "No heartbeat rule with this token")
+		return
+	}
+
+	if err := s.rdb.SetHeartbeat(rule.ID, time.Now()); err != nil {
+		s.logger.Errorw("Failed to save heartbeat.", "Rule ID", rule.ID, "Error", err)
+		apiWriteFail(c, 500, "Failed to save heartbeat, err: %s", err)
+		return
+	}
+	s.stats.HeartbeatReceived.Inc()
+	if s.inMaintenance(rule) == nil {
+		s.emitTask(rule)
+	}
+
+	apiWriteSuccess(c, nil)
+}
+
+// checkHeartbeatToken checks that the heartbeat token of rule is not used by another
+// rule. Callers must hold quotaLock until the rule is saved.
+func (s *Scheduler) checkHeartbeatToken(rule *types.Rule, id int) error {
+	check, ok := rule.Check.(*types.HeartbeatCheck)
+	if !ok {
+		return nil
+	}
+	s.RLock()
+	other, ok := s.heartbeats[check.Token]
+	s.RUnlock()
+	if ok && other.ID != id {
+		return fmt.Errorf("heartbeat token is already used by rule %d", other.ID)
+	}
+	return nil
+}
+
+// checkImportHeartbeatTokens checks that heartbeat tokens of rules created or updated by
+// ops are not used by other rules, after ops are applied. olds[i] is the rule replaced
+// by ops[i]. Returns error of each op, nil if its token is fine.
+func (s *Scheduler) checkImportHeartbeatTokens(ops []*ruledb.RuleOp, olds []*types.Rule) []error {
+	owners := make(map[string]int)
+	s.RLock()
+	for token, rule := range s.heartbeats {
+		owners[token] = rule.ID
+	}
+	s.RUnlock()
+
+	// tokens of updated and deleted rules are released first, so tokens can move
+	// between rules in one import
+	replaced := make(map[int]bool)
+	for i := range ops {
+		if olds[i] != nil {
+			replaced[olds[i].ID] = true
+		}
+	}
+	for token, id := range owners {
+		if replaced[id] {
+			delete(owners, token)
+		}
+	}
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Action == "delete" {
+			continue
+		}
+		check, ok := op.Rule.Check.(*types.HeartbeatCheck)
+		if !ok {
+			continue
+		}
+		if id, ok := owners[check.Token]; ok {
+			if id == 0 {
+				errs[i] = fmt.Errorf("heartbeat token is also used by another imported rule")
+			} else {
+				errs[i] = fmt.Errorf("heartbeat token is already used by rule %d", id)
+			}
+			continue
+		}
+		// rules of the import have no id yet
+		owners[check.Token] = 0
+	}
+	return errs
+}
@@ -0,0 +1,380 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/internal/auth"
+	"github.com/openmetric/yamf/internal/ruledb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strconv"
+)
+
+// import modes
+const (
+	// only create rules whose names do not exist yet, existing ones are skipped
+	ImportCreateOnly = "create-only"
+	// create new rules, update existing ones with the same name
+	ImportUpsertByName = "upsert-by-name"
+	// like upsert-by-name, and delete rules which are not in the import
+	ImportReplaceAll = "replace-all"
+)
+
+// ImportResult is the outcome of importing a single rule.
+type ImportResult struct {
+	// position of the rule in the import, -1 for rules deleted by replace-all
+	Index     int    `json:"index"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	ID        int    `json:"id,omitempty"`
+	// "create", "update", "delete", "unchanged", "skip" or "error"
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// exportDoc converts rule into its portable form, without database id, version and
+// source, so that it can be imported into another scheduler.
+func exportDoc(rule *types.Rule) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	data, err := json.Marshal(rule)
+	if err == nil {
+		err = json.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	delete(doc, "id")
+	delete(doc, "version")
+	delete(doc, "source")
+	return doc, nil
+}
+
+// apiExportRules writes rules as a YAML or JSON list, which can be imported with
+// apiImportRules. Rules are filtered with the same query parameters as apiListRules,
+// except limit and cursor. Format is chosen with "format" query parameter, "yaml"
+// (default) or "json".
+func (s *Scheduler) apiExportRules(c *gin.Context) {
+	var rules []*types.Rule
+	var err error
+
+	format := c.DefaultQuery("format", "yaml")
+	if format != "yaml" && format != "json" {
+		apiWriteFail(c, 400, "Bad format: %s", format)
+		return
+	}
+
+	q := apiParseRuleQuery(c)
+	if q == nil {
+		return
+	}
+	q.Limit, q.Cursor = 0, ""
+
+	if rules, _, err = s.rdb.Query(q); err != nil {
+		apiWriteFail(c, 500, "Error loading rules from db, err: %s", err)
+		return
+	}
+
+	if format == "json" {
+		c.Header("Content-Type", "application/json")
+	} else {
+		c.Header("Content-Type", "application/x-yaml")
+	}
+	c.Status(200)
+
+	// rules are written one by one, a yaml list item or a json array element each
+	if format == "json" {
+		c.Writer.Write([]byte("[\n"))
+	} else if len(rules) == 0 {
+		c.Writer.Write([]byte("[]\n"))
+	}
+	for i, rule := range rules {
+		var data []byte
+		doc, err := exportDoc(rule)
+		if err == nil {
+			if format == "json" {
+				data, err = json.MarshalIndent(doc, "  ", "  ")
+				if i > 0 {
+					data = append([]byte(",\n  "), data...)
+				} else {
+					data = append([]byte("  "), data...)
+				}
+			} else {
+				data, err = yaml.Marshal([]interface{}{doc})
+			}
+		}
+		if err != nil {
+			// headers are sent already, all we can do is to stop
+			s.logger.Errorw("Failed to export rule.", "Rule ID", rule.ID, "Error", err)
+			return
+		}
+		c.Writer.Write(data)
+	}
+	if format == "json" {
+		c.Writer.Write([]byte("\n]\n"))
+	}
+}
+
+// apiImportRules imports rules from a YAML or JSON list (or a single rule), query
+// parameters:
+//
+//	mode     "create-only" (default), "upsert-by-name" or "replace-all"
+//	dry_run  "true" to only validate and report what would be done
+//
+// Rules are matched with existing ones by namespace and name. All rules are validated
+// before anything is changed, if any of them is invalid nothing is imported. Changes are
+// applied in a single transaction if the rule store supports it.
+func (s *Scheduler) apiImportRules(c *gin.Context) {
+	var body []byte
+	var docs []json.RawMessage
+	var existing []*types.Rule
+	var err error
+
+	mode := c.DefaultQuery("mode", ImportCreateOnly)
+	switch mode {
+	case ImportCreateOnly, ImportUpsertByName, ImportReplaceAll:
+	default:
+		apiWriteFail(c, 400, "Bad mode: %s", mode)
+		return
+	}
+	dryRun := false
+	if str := c.Query("dry_run"); str != "" {
+		if dryRun, err = strconv.ParseBool(str); err != nil {
+			apiWriteFail(c, 400, "Bad dry_run: %s", str)
+			return
+		}
+	}
+
+	if body, err = ioutil.ReadAll(c.Request.Body); err != nil {
+		apiWriteFail(c, 500, "Error reading request body, err: %s", err)
+		return
+	}
+	if docs, err = splitRuleDocs(body); err != nil {
+		apiWriteFail(c, 400, "Error parsing body, err: %s", err)
+		return
+	}
+
+	ns := c.Param("ns")
+	if existing, _, err = s.rdb.Query(&ruledb.Query{Namespace: ns}); err != nil {
+		apiWriteFail(c, 500, "Error loading rules from db, err: %s", err)
+		return
+	}
+	byName := make(map[string][]*types.Rule)
+	for _, rule := range existing {
+		key := ruleFileKey(rule)
+		byName[key] = append(byName[key], rule)
+	}
+
+	user := auth.APIUser(c)
+	results := make([]*ImportResult, 0, len(docs))
+	var ops []*ruledb.RuleOp
+	// ops[i] is the result of results[opResults[i]], and replaces olds[i]
+	var opResults []int
+	var olds []*types.Rule
+	imported := make(map[string]int)
+	failed := 0
+
+	fail := func(result *ImportResult, format string, v ...interface{}) {
+		result.Action = "error"
+		result.Error = fmt.Sprintf(format, v...)
+		failed++
+	}
+	addOp := func(result *ImportResult, op *ruledb.RuleOp, old *types.Rule) {
+		result.Action = op.Action
+		ops = append(ops, op)
+		opResults = append(opResults, len(results)-1)
+		olds = append(olds, old)
+	}
+
+	for i, doc := range docs {
+		result := &ImportResult{Index: i}
+		results = append(results, result)
+
+		rule := &types.Rule{}
+		if err = json.Unmarshal(doc, rule); err != nil {
+			fail(result, "Error parsing rule: %s", err)
+			continue
+		}
+		rule.ID = 0
+		rule.Source = ""
+		if ns != "" {
+			rule.Namespace = ns
+		}
+		if err = rule.Validate(); err != nil {
+			fail(result, "Invalid rule: %s", err)
+			continue
+		}
+		result.Namespace, result.Name = rule.Namespace, rule.Name
+
+		if rule.Name == "" && mode != ImportCreateOnly {
+			fail(result, "Rule without a name can not be matched in mode %s", mode)
+			continue
+		}
+		key := ruleFileKey(rule)
+		if rule.Name != "" {
+			if other, ok := imported[key]; ok {
+				fail(result, "Duplicate rule name %s, also at index %d", key, other)
+				continue
+			}
+			imported[key] = i
+		}
+		if !user.CanModify(rule) {
+			fail(result, "Permission denied, rule labels out of scope: %s", user.Scope)
+			continue
+		}
+		if err = s.checkQuota(rule, false); err != nil {
+			fail(result, "Quota exceeded: %s", err)
+			continue
+		}
+
+		var matches []*types.Rule
+		if rule.Name != "" {
+			matches = byName[key]
+		}
+		switch {
+		case len(matches) == 0:
+			addOp(result, &ruledb.RuleOp{Action: "create", Rule: rule}, nil)
+		case mode == ImportCreateOnly:
+			result.Action = "skip"
+			result.Error = "Rule already exists"
+		case len(matches) > 1:
+			fail(result, "Rule name %s is ambiguous, %d rules have it", key, len(matches))
+		default:
+			old := matches[0]
+			result.ID = old.ID
+			rule.Source = old.Source
+			if s.isReadOnlyRule(old) {
+				fail(result, "Rule is managed by rule files, it can not be modified via api")
+			} else if !user.CanModify(old) {
+				fail(result, "Permission denied, rule labels out of scope: %s", user.Scope)
+			} else if sameRule(old, rule) {
+				result.Action = "unchanged"
+			} else {
+				addOp(result, &ruledb.RuleOp{Action: "update", ID: old.ID, Version: old.Version, Rule: rule}, old)
+			}
+		}
+	}
+
+	if mode == ImportReplaceAll {
+		for _, old := range existing {
+			// rule files are the source of truth of file managed rules
+			if _, ok := imported[ruleFileKey(old)]; ok || old.Source == types.RuleSourceFile {
+				continue
+			}
+			result := &ImportResult{Index: -1, Namespace: old.Namespace, Name: old.Name, ID: old.ID}
+			results = append(results, result)
+			if !user.CanModify(old) {
+				fail(result, "Permission denied, rule labels out of scope: %s", user.Scope)
+				continue
+			}
+			addOp(result, &ruledb.RuleOp{Action: "delete", ID: old.ID, Version: old.Version}, old)
+		}
+	}
+
+	// max rules quota is checked against the result of the whole import
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	delta := make(map[string]int)
+	for i, op := range ops {
+		switch op.Action {
+		case "create":
+			delta[op.Rule.Namespace]++
+		case "delete":
+			delta[olds[i].Namespace]--
+		}
+	}
+	for namespace, n := range delta {
+		config, ok := s.config.Namespaces[namespace]
+		if !ok || config.MaxRules <= 0 || n <= 0 {
+			continue
+		}
+		count, err := s.rdb.Count(&ruledb.Query{Namespace: namespace})
+		if err != nil {
+			apiWriteFail(c, 500, "Error counting rules in db, err: %s", err)
+			return
+		}
+		if count+n > config.MaxRules {
+			for i, op := range ops {
+				if op.Action == "create" && op.Rule.Namespace == namespace {
+					fail(results[opResults[i]], "Quota exceeded: namespace %s would have %d rules, max allowed is %d", namespace, count+n, config.MaxRules)
+				}
+			}
+		}
+	}
+
+	for i, err := range s.checkImportHeartbeatTokens(ops, olds) {
+		if err != nil {
+			fail(results[opResults[i]], "Invalid rule: %s", err)
+		}
+	}
+
+	if failed > 0 {
+		c.JSON(422, apiResponseBody{
+			Success: false,
+			Message: fmt.Sprintf("%d rules failed validation, nothing imported", failed),
+			Rules:   make([]*types.Rule, 0),
+			Import:  results,
+		})
+		return
+	}
+	if dryRun {
+		c.JSON(200, apiResponseBody{
+			Success: true,
+			Message: fmt.Sprintf("Dry run, %d changes would be made", len(ops)),
+			Rules:   make([]*types.Rule, 0),
+			Import:  results,
+		})
+		return
+	}
+
+	applied, err := ruledb.ApplyBatch(s.rdb, ops)
+
+	author := apiAuthor(c)
+	rules := make([]*types.Rule, 0, applied)
+	for i, op := range ops[:applied] {
+		result := results[opResults[i]]
+		result.ID = op.ID
+		if op.Action == "delete" {
+			s.recordRevision("delete", author, olds[i], nil)
+			s.stop(op.ID)
+		} else {
+			s.recordRevision(op.Action, author, olds[i], op.Rule)
+			s.schedule(op.Rule)
+			rules = append(rules, op.Rule)
+		}
+		s.auditChange(c, op.Action, olds[i], op.Rule, "import")
+	}
+	for i := applied; err != nil && i < len(ops); i++ {
+		results[opResults[i]].Action = "error"
+		results[opResults[i]].Error = "Not applied"
+	}
+
+	if err == ruledb.ErrQuotaExceeded {
+		// another scheduler sharing the database added rules since the check above,
+		// the batch was rolled back as a whole
+		c.JSON(403, apiResponseBody{
+			Success: false,
+			Message: "Quota exceeded: namespaces would have more than the max allowed rules, nothing imported",
+			Rules:   rules,
+			Import:  results,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(500, apiResponseBody{
+			Success: false,
+			Message: fmt.Sprintf("Error saving rules to db, %d of %d changes applied, err: %s", applied, len(ops), err),
+			Rules:   rules,
+			Import:  results,
+		})
+		return
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success: true,
+		Message: fmt.Sprintf("%d changes applied", applied),
+		Rules:   rules,
+		Import:  results,
+	})
+}
@@ -0,0 +1,366 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/internal/auth"
+	"github.com/openmetric/yamf/internal/ruledb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// how often maintenance windows are reloaded from database, so that windows added by
+// other schedulers sharing the database take effect
+const maintenanceReloadInterval = 30 * time.Second
+
+// apiMaintenanceWindow is a maintenance window and its current status.
+type apiMaintenanceWindow struct {
+	*types.MaintenanceWindow
+	Active bool `json:"active"`
+	// ids of rules paused by the window, only for active windows
+	RuleIDs []int `json:"rule_ids,omitempty"`
+}
+
+// loadMaintenanceWindows reloads maintenance windows from database, and logs windows
+// which started or ended since the last load.
+func (s *Scheduler) loadMaintenanceWindows() error {
+	windows, err := s.rdb.GetMaintenanceWindows()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+
+	active := make(map[int]bool)
+	for _, w := range windows {
+		if w.Active(now) {
+			active[w.ID] = true
+			if !s.maintenanceActive[w.ID] {
+				s.logger.Infow("Maintenance window started.", "Window ID", w.ID, "Namespace", w.Namespace, "Selector", w.Selector.String(), "End", w.End.Time)
+			}
+		}
+	}
+	for id := range s.maintenanceActive {
+		if !active[id] {
+			s.logger.Infow("Maintenance window ended.", "Window ID", id)
+		}
+	}
+
+	s.maintenance = windows
+	s.maintenanceActive = active
+	return nil
+}
+
+// watchMaintenanceWindows reloads maintenance windows periodically, until
+// maintenanceStop is closed.
+func (s *Scheduler) watchMaintenanceWindows() {
+	ticker := time.NewTicker(maintenanceReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.loadMaintenanceWindows(); err != nil {
+				s.logger.Errorw("Failed to load maintenance windows.", "Error", err)
+			}
+		case <-s.maintenanceStop:
+			return
+		}
+	}
+}
+
+// inMaintenance returns the active maintenance window covering rule, nil if there is none.
+func (s *Scheduler) inMaintenance(rule *types.Rule) *types.MaintenanceWindow {
+	now := time.Now()
+	s.maintenanceLock.RLock()
+	defer s.maintenanceLock.RUnlock()
+
+	for _, w := range s.maintenance {
+		if w.Active(now) && w.Matches(rule) {
+			return w
+		}
+	}
+	return nil
+}
+
+// apiListMaintenance lists maintenance windows, with "active=true" only the active ones.
+func (s *Scheduler) apiListMaintenance(c *gin.Context) {
+	var err error
+
+	activeOnly := false
+	if str := c.Query("active"); str != "" {
+		if activeOnly, err = strconv.ParseBool(str); err != nil {
+			apiWriteFail(c, 400, "Bad active: %s", str)
+			return
+		}
+	}
+
+	s.maintenanceLock.RLock()
+	windows := s.maintenance
+	s.maintenanceLock.RUnlock()
+
+	now := time.Now()
+	ns := c.Param("ns")
+	result := make([]*apiMaintenanceWindow, 0, len(windows))
+	for _, w := range windows {
+		if ns != "" && w.Namespace != "" && w.Namespace != ns {
+			continue
+		}
+		item := &apiMaintenanceWindow{MaintenanceWindow: w, Active: w.Active(now)}
+		if activeOnly && !item.Active {
+			continue
+		}
+		if item.Active {
+			namespace := w.Namespace
+			if ns != "" {
+				namespace = ns
+			}
+			rules, _, err := s.rdb.Query(&ruledb.Query{Namespace: namespace, Selector: w.Selector})
+			if err != nil {
+				apiWriteFail(c, 500, "Error loading rules from db, err: %s", err)
+				return
+			}
+			for _, rule := range rules {
+				item.RuleIDs = append(item.RuleIDs, rule.ID)
+			}
+		}
+		result = append(result, item)
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success:     true,
+		Message:     "",
+		Rules:       make([]*types.Rule, 0),
+		Maintenance: result,
+	})
+}
+
+// apiCreateMaintenance adds a maintenance window. Windows created by users with a scope
+// only cover rules in their scope.
+func (s *Scheduler) apiCreateMaintenance(c *gin.Context) {
+	var body []byte
+	var err error
+
+	if body, err = ioutil.ReadAll(c.Request.Body); err != nil {
+		apiWriteFail(c, 500, "Error reading request body, err: %s", err)
+		return
+	}
+
+	w := &types.MaintenanceWindow{}
+	if err = json.Unmarshal(body, w); err != nil {
+		apiWriteFail(c, 400, "Error parsing body, err: %s", err)
+		return
+	}
+	w.ID = 0
+	w.Author = apiAuthor(c)
+	if ns := c.Param("ns"); ns != "" {
+		w.Namespace = ns
+	}
+	if user := auth.APIUser(c); user.Scoped() {
+		w.Selector = append(w.Selector, user.ScopeSelector()...)
+	}
+	if err = w.Validate(); err != nil {
+		apiWriteFail(c, 400, "Invalid maintenance window: %s", err)
+		return
+	}
+
+	if err = s.rdb.AddMaintenanceWindow(w); err != nil {
+		apiWriteFail(c, 500, "Error saving maintenance window to db, err: %s", err)
+		return
+	}
+	if err = s.loadMaintenanceWindows(); err != nil {
+		s.logger.Errorw("Failed to load maintenance windows.", "Error", err)
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success:     true,
+		Message:     "",
+		Rules:       make([]*types.Rule, 0),
+		Maintenance: []*apiMaintenanceWindow{{MaintenanceWindow: w, Active: w.Active(time.Now())}},
+	})
+}
+
+// apiDeleteMaintenance deletes a maintenance window, which ends it if it's active. Users
+// with a scope can only delete their own windows.
+func (s *Scheduler) apiDeleteMaintenance(c *gin.Context) {
+	var id int
+	var err error
+
+	if id, err = strconv.Atoi(c.Param("id")); err != nil {
+		apiWriteFail(c, 400, "Bad maintenance window id: %s", c.Param("id"))
+		return
+	}
+
+	var window *types.MaintenanceWindow
+	s.maintenanceLock.RLock()
+	for _, w := range s.maintenance {
+		if w.ID == id {
+			window = w
+		}
+	}
+	s.maintenanceLock.RUnlock()
+
+	if window == nil || (c.Param("ns") != "" && window.Namespace != c.Param("ns")) {
+		apiWriteFail(c, 404, "Maintenance window not found")
+		return
+	}
+	if user := auth.APIUser(c); user.Scoped() && window.Author != user.Name {
+		s.auth.LogDenied(c, user, "maintenance window of another user")
+		apiWriteFail(c, 403, "Permission denied, maintenance window was created by %s", window.Author)
+		return
+	}
+
+	if err = s.rdb.DeleteMaintenanceWindow(id); err == ruledb.ErrNotFound {
+		apiWriteFail(c, 404, "Maintenance window not found")
+		return
+	} else if err != nil {
+		apiWriteFail(c, 500, "Error deleting maintenance window from db, err: %s", err)
+		return
+	}
+	if err = s.loadMaintenanceWindows(); err != nil {
+		s.logger.Errorw("Failed to load maintenance windows.", "Error", err)
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success:     true,
+		Message:     "",
+		Rules:       make([]*types.Rule, 0),
+		Maintenance: []*apiMaintenanceWindow{{MaintenanceWindow: window}},
+	})
+}
+
+// apiSetPaused returns a handler which pauses or resumes a single rule.
+func (s *Scheduler) apiSetPaused(paused bool) gin.HandlerFunc {
+	action := "resume"
+	if paused {
+		action = "pause"
+	}
+
+	return func(c *gin.Context) {
+		var old *types.Rule
+		var id, version int
+		var err error
+
+		if id, err = strconv.Atoi(c.Param("id")); err != nil {
+			apiWriteFail(c, 400, "Bad rule id: %s", c.Param("id"))
+			return
+		}
+		if version, err = apiIfMatch(c); err != nil {
+			apiWriteFail(c, 400, "%s", err)
+			return
+		}
+
+		if old, err = s.rdb.Get(id); err == ruledb.ErrNotFound {
+			apiWriteFail(c, 404, "Rule not found")
+			return
+		} else if err != nil {
+			apiWriteFail(c, 500, "Error loading rule from db, err: %s", err)
+			return
+		}
+
+		if !apiCheckNamespace(c, old) {
+			return
+		}
+
+		apiSetAuditRules(c, old, nil)
+
+		if s.isReadOnlyRule(old) {
+			apiWriteFail(c, 403, "Rule is managed by rule files, it can not be modified via api")
+			return
+		}
+		if !s.apiCheckScope(c, old) {
+			return
+		}
+
+		if old.Paused == paused {
+			apiSetETag(c, old)
+			apiWriteSuccess(c, []*types.Rule{old})
+			return
+		}
+
+		rule := *old
+		rule.Paused = paused
+		if err = s.rdb.UpdateIfMatch(id, version, &rule); err == ruledb.ErrVersionConflict {
+			apiWriteFail(c, 412, "Rule has been modified by others, reload and try again")
+			return
+		} else if err != nil {
+			apiWriteFail(c, 500, "Error saving rule to db, err: %s", err)
+			return
+		}
+		apiSetAuditRules(c, nil, &rule)
+
+		s.recordRevision(action, apiAuthor(c), old, &rule)
+		s.schedule(&rule)
+
+		apiSetETag(c, &rule)
+		apiWriteSuccess(c, []*types.Rule{&rule})
+	}
+}
+
+// apiBulkSetPaused pauses or resumes all rules matching the query parameters (see
+// apiParseRuleQuery), a selector is required. Rules the user is not allowed to modify
+// are skipped.
+func (s *Scheduler) apiBulkSetPaused(c *gin.Context, paused bool) {
+	var rules []*types.Rule
+	var err error
+
+	action := "resume"
+	if paused {
+		action = "pause"
+	}
+
+	q := apiParseRuleQuery(c)
+	if q == nil {
+		return
+	}
+	if len(q.Selector) == 0 {
+		apiWriteFail(c, 400, "A selector is required to %s rules in bulk", action)
+		return
+	}
+	q.Limit, q.Cursor = 0, ""
+
+	if rules, _, err = s.rdb.Query(q); err != nil {
+		apiWriteFail(c, 500, "Error loading rules from db, err: %s", err)
+		return
+	}
+
+	user := auth.APIUser(c)
+	author := apiAuthor(c)
+	changed := make([]*types.Rule, 0, len(rules))
+	skipped := 0
+	for _, old := range rules {
+		if old.Paused == paused {
+			continue
+		}
+		if s.isReadOnlyRule(old) || !user.CanModify(old) {
+			skipped++
+			continue
+		}
+
+		rule := *old
+		rule.Paused = paused
+		if err = s.rdb.UpdateIfMatch(old.ID, old.Version, &rule); err == ruledb.ErrVersionConflict {
+			skipped++
+			continue
+		} else if err != nil {
+			apiWriteFail(c, 500, "Error saving rule to db after %d rules changed, err: %s", len(changed), err)
+			return
+		}
+
+		s.recordRevision(action, author, old, &rule)
+		s.auditChange(c, action, old, &rule, "bulk "+action)
+		s.schedule(&rule)
+		changed = append(changed, &rule)
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success: true,
+		Message: fmt.Sprintf("%d rules changed, %d skipped", len(changed), skipped),
+		Rules:   changed,
+	})
+}
@@ -0,0 +1,73 @@
+package scheduler
+
+import (
+	"fmt"
+	"github.com/openmetric/yamf/internal/ruledb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"time"
+)
+
+// NamespaceConfig holds defaults and quotas of a namespace.
+type NamespaceConfig struct {
+	// merged into metadata of tasks of all rules in the namespace, rule's own metadata wins
+	Metadata map[string]string `yaml:"metadata"`
+	// max number of rules in the namespace, 0 for unlimited
+	MaxRules int `yaml:"max_rules"`
+	// rules in the namespace can not have a shorter interval
+	MinInterval time.Duration `yaml:"min_interval"`
+}
+
+// newTask creates task from rule, with namespace defaults applied, and time of the last
+// ping of heartbeat rules.
+func (s *Scheduler) newTask(rule *types.Rule) *types.Task {
+	task := types.NewTaskFromRule(rule)
+	if ns, ok := s.config.Namespaces[rule.Namespace]; ok && len(ns.Metadata) > 0 {
+		metadata := make(types.Metadata)
+		for k, v := range ns.Metadata {
+			metadata[k] = v
+		}
+		metadata.Merge(rule.Metadata)
+		task.Metadata = metadata
+	}
+	if check, ok := task.Check.(*types.HeartbeatCheck); ok {
+		task.Check = s.heartbeatCheck(rule, check)
+	}
+	return task
+}
+
+// checkQuota checks rule against quotas of its namespace. adding tells whether the
+// rule is new to the namespace (created, or moved from another namespace), callers
+// adding rules must hold quotaLock until the rules are saved.
+func (s *Scheduler) checkQuota(rule *types.Rule, adding bool) error {
+	ns, ok := s.config.Namespaces[rule.Namespace]
+	if !ok {
+		return nil
+	}
+
+	if ns.MinInterval > 0 && rule.Interval.Duration < ns.MinInterval {
+		return fmt.Errorf("interval of rules in namespace %s must be at least %s", rule.Namespace, ns.MinInterval)
+	}
+
+	if adding && ns.MaxRules > 0 {
+		count, err := s.rdb.Count(&ruledb.Query{Namespace: rule.Namespace})
+		if err != nil {
+			return err
+		}
+		if count >= ns.MaxRules {
+			return fmt.Errorf("namespace %s already has %d rules, which is the max allowed", rule.Namespace, count)
+		}
+	}
+
+	return nil
+}
+
+// apiCheckNamespace checks if the rule belongs to the namespace of the request, writes
+// 404 response if not. Requests not scoped to a namespace can access all rules.
+func apiCheckNamespace(c *gin.Context, rule *types.Rule) bool {
+	if ns := c.Param("ns"); ns != "" && ns != rule.Namespace {
+		apiWriteFail(c, 404, "Rule not found in namespace %s", ns)
+		return false
+	}
+	return true
+}
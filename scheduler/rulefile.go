@@ -0,0 +1,232 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/openmetric/yamf/internal/types"
+	"github.com/openmetric/yamf/internal/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// author of revisions made by rule file reconciliation
+const ruleFilesAuthor = "rule-files"
+
+// ruleFileKey is the stable key of file managed rules, names are unique in a namespace.
+func ruleFileKey(rule *types.Rule) string {
+	return rule.Namespace + "/" + rule.Name
+}
+
+// loadRuleFiles reads all rule files (*.yaml, *.yml, *.json) under dir, returns rules
+// keyed by namespace and name. Files which can not be loaded are reported in errors, rules in other
+// files are still returned.
+func loadRuleFiles(dir string) (map[string]*types.Rule, []error) {
+	rules := make(map[string]*types.Rule)
+	files := make(map[string]string)
+	var errors []error
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		fileRules, err := parseRuleFile(path)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("failed to load rule file %s: %s", path, err))
+			return nil
+		}
+		for _, rule := range fileRules {
+			if rule.Name == "" {
+				errors = append(errors, fmt.Errorf("rule without a name in %s", path))
+				continue
+			}
+			if err = rule.Validate(); err != nil {
+				errors = append(errors, fmt.Errorf("invalid rule %s in %s: %s", rule.Name, path, err))
+				continue
+			}
+			key := ruleFileKey(rule)
+			if other, ok := files[key]; ok {
+				errors = append(errors, fmt.Errorf("duplicate rule name %s in %s and %s", key, other, path))
+				continue
+			}
+			rule.ID = 0
+			rule.Source = types.RuleSourceFile
+			rules[key] = rule
+			files[key] = path
+		}
+		return nil
+	})
+	if err != nil {
+		errors = append(errors, err)
+	}
+
+	return rules, errors
+}
+
+// parseRuleFile parses a rule file, which contains either a single rule or a list of rules.
+func parseRuleFile(path string) ([]*types.Rule, error) {
+	var content []byte
+	var docs []json.RawMessage
+	var err error
+
+	if content, err = ioutil.ReadFile(path); err != nil {
+		return nil, err
+	}
+	if docs, err = splitRuleDocs(content); err != nil {
+		return nil, err
+	}
+
+	rules := make([]*types.Rule, 0, len(docs))
+	for _, doc := range docs {
+		rule := &types.Rule{}
+		if err = json.Unmarshal(doc, rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// splitRuleDocs converts YAML or JSON content, which is either a single rule or a list
+// of rules, into JSON documents of the rules. Rules are not decoded, so that errors can
+// be reported per rule.
+func splitRuleDocs(content []byte) ([]json.RawMessage, error) {
+	data, err := utils.YAMLToJSON(content)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		// empty file
+		return nil, nil
+	case bytes.HasPrefix(data, []byte("[")):
+		var docs []json.RawMessage
+		if err = json.Unmarshal(data, &docs); err != nil {
+			return nil, err
+		}
+		return docs, nil
+	default:
+		return []json.RawMessage{data}, nil
+	}
+}
+
+// sameRule tells whether two rules have the same definition, database id and version
+// are ignored.
+func sameRule(a, b *types.Rule) bool {
+	ca, cb := *a, *b
+	ca.ID, cb.ID = 0, 0
+	ca.Version, cb.Version = 0, 0
+
+	da, errA := json.Marshal(&ca)
+	db, errB := json.Marshal(&cb)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return bytes.Equal(da, db)
+}
+
+// reconcileRuleFiles makes file managed rules in database (and so the running ones)
+// match the rule files. Rule files always win, changes made via http api to file
+// managed rules are reverted.
+func (s *Scheduler) reconcileRuleFiles() {
+	fileRules, loadErrors := loadRuleFiles(s.config.RulesDir)
+	for _, err := range loadErrors {
+		s.logger.Errorw("Error loading rule files.", "Error", err)
+	}
+
+	rules, errors, err := s.rdb.GetAll()
+	if err != nil {
+		s.logger.Errorw("Failed to fetch all rules from database.", "Error", err)
+		return
+	}
+
+	existing := make(map[string]*types.Rule)
+	for i, rule := range rules {
+		if errors[i] == nil && rule.Source == types.RuleSourceFile {
+			existing[ruleFileKey(rule)] = rule
+		}
+	}
+
+	s.quotaLock.Lock()
+	for name, rule := range fileRules {
+		if old, ok := existing[name]; !ok {
+			if err = s.checkQuota(rule, true); err != nil {
+				s.logger.Errorw("Rule from rule files exceeds quota.", "Rule Name", name, "Error", err)
+				continue
+			}
+			if err = s.checkHeartbeatToken(rule, 0); err != nil {
+				s.logger.Errorw("Invalid rule in rule files.", "Rule Name", name, "Error", err)
+				continue
+			}
+			if _, err = s.rdb.Insert(rule); err != nil {
+				s.logger.Errorw("Error saving rule to db.", "Rule Name", name, "Error", err)
+				continue
+			}
+			s.logger.Infow("Created rule from rule files.", "Rule Name", name, "Rule ID", rule.ID)
+			s.recordRevision("create", ruleFilesAuthor, nil, rule)
+			s.schedule(rule)
+		} else if !sameRule(old, rule) {
+			if err = s.checkQuota(rule, false); err != nil {
+				s.logger.Errorw("Rule from rule files exceeds quota.", "Rule Name", name, "Rule ID", old.ID, "Error", err)
+				continue
+			}
+			if err = s.checkHeartbeatToken(rule, old.ID); err != nil {
+				s.logger.Errorw("Invalid rule in rule files.", "Rule Name", name, "Rule ID", old.ID, "Error", err)
+				continue
+			}
+			if err = s.rdb.Update(old.ID, rule); err != nil {
+				s.logger.Errorw("Error saving rule to db.", "Rule Name", name, "Rule ID", old.ID, "Error", err)
+				continue
+			}
+			s.logger.Infow("Updated rule from rule files.", "Rule Name", name, "Rule ID", rule.ID)
+			s.recordRevision("update", ruleFilesAuthor, old, rule)
+			s.schedule(rule)
+		}
+	}
+	s.quotaLock.Unlock()
+
+	// a broken rule file would otherwise cause all its rules to be removed
+	if len(loadErrors) > 0 {
+		s.logger.Warnw("Not removing any rule, since some rule files failed to load.")
+		return
+	}
+
+	for name, old := range existing {
+		if _, ok := fileRules[name]; ok {
+			continue
+		}
+		if err = s.rdb.Delete(old.ID); err != nil {
+			s.logger.Errorw("Error deleting rule from db.", "Rule Name", name, "Rule ID", old.ID, "Error", err)
+			continue
+		}
+		s.logger.Infow("Removed rule which no longer exists in rule files.", "Rule Name", name, "Rule ID", old.ID)
+		s.recordRevision("delete", ruleFilesAuthor, old, nil)
+		s.stop(old.ID)
+	}
+}
+
+func (s *Scheduler) watchRuleFiles() {
+	ticker := time.NewTicker(s.config.RulesDirScanInterval)
+	for {
+		select {
+		case <-ticker.C:
+			s.reconcileRuleFiles()
+		case <-s.ruleFilesStop:
+			ticker.Stop()
+			return
+		}
+	}
+}
@@ -2,8 +2,11 @@ package scheduler
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/braintree/manners"
 	"github.com/nsqio/go-nsq"
 	"github.com/openmetric/graphite-client"
+	"github.com/openmetric/yamf/internal/auth"
 	"github.com/openmetric/yamf/internal/ruledb"
 	"github.com/openmetric/yamf/internal/stats"
 	"github.com/openmetric/yamf/internal/types"
@@ -16,23 +19,56 @@ import (
 type Config struct {
 	// API Server listen address
 	ListenAddress string `yaml:"listen_address"`
-
-	// tiedot database
+	// serve api over tls if set
+	TLS *TLSConfig `yaml:"tls"`
+
+	// rule database, type is "tiedot", "bolt", "postgres", "mysql" or "sqlite". For
+	// tiedot, db_path is a directory and db_collection the collection name. For bolt,
+	// db_path is a file and db_collection the bucket name. For sql databases, db_path is
+	// the data source name and db_collection the table name prefix.
+	DBType       string `yaml:"db_type"`
 	DBPath       string `yaml:"db_path"`
 	DBCollection string `yaml:"db_collection"`
 
 	// nsqd and topic to publish task to
 	NSQDTcpAddr string `yaml:"nsqd_tcp_address"`
 	NSQTopic    string `yaml:"nsq_topic"`
+	// topic to publish silences to, every executor receives all of them
+	NSQSilenceTopic string `yaml:"nsq_silence_topic"`
+
+	// directory of rule files, rules defined there are reconciled into database by name,
+	// and can not be modified via http api
+	RulesDir             string        `yaml:"rules_dir"`
+	RulesDirScanInterval time.Duration `yaml:"rules_dir_scan_interval"`
+
+	// API authentication
+	Auth *auth.Config `yaml:"auth"`
+	// hosts which graphite_url of rules tested via api may point to, rules are tested by
+	// scheduler itself. Empty allows any host.
+	TestGraphiteHosts []string `yaml:"test_graphite_hosts"`
+
+	// audit log of rule changes
+	Audit *AuditConfig `yaml:"audit"`
+
+	// default metadata and quotas of namespaces
+	Namespaces map[string]*NamespaceConfig `yaml:"namespaces"`
 }
 
 func NewConfig() *Config {
 	return &Config{
 		ListenAddress: ":8080",
+		DBType:        "tiedot",
 		DBPath:        "./var/db",
 		DBCollection:  "rules",
 		NSQDTcpAddr:   "127.0.0.1:4150",
 		NSQTopic:      "yamf_tasks",
+
+		NSQSilenceTopic: "yamf_silences",
+
+		RulesDirScanInterval: 30 * time.Second,
+
+		Auth:  &auth.Config{},
+		Audit: &AuditConfig{},
 	}
 }
 
@@ -41,22 +77,60 @@ type Scheduler struct {
 	config   *Config
 	logger   *zap.SugaredLogger
 	producer *nsq.Producer
-	rdb      *ruledb.RuleDB
+	rdb      ruledb.RuleStore
 	stats    Stats
 
+	apiServer     *manners.GracefulServer
 	apiServerStop chan struct{}
+	ruleFilesStop chan struct{}
+
+	// authenticates api users loaded from config
+	auth *auth.Authenticator
+
+	auditSink auditSink
+
+	// maintenance windows, and ids of the active ones
+	maintenance       []*types.MaintenanceWindow
+	maintenanceActive map[int]bool
+	maintenanceLock   sync.RWMutex
+	maintenanceStop   chan struct{}
+
+	silencesChanged chan struct{}
+	silenceStop     chan struct{}
+
+	// held from checking max rules quota and heartbeat tokens until the rules are saved,
+	// so concurrent creations can not exceed the quota, or share a token. Stores shared by multiple schedulers check
+	// the quota again when saving, see ruledb.QuotaEnforcer.
+	quotaLock sync.Mutex
 
 	rules map[int]*RunningRule
+	// heartbeat rules by token, paused ones included, tokens are unique
+	heartbeats map[string]*types.Rule
 	sync.RWMutex
 }
 
 func NewScheduler(config *Config, logger *zap.SugaredLogger) (*Scheduler, error) {
 	// TODO check if config is valid
 	scheduler := &Scheduler{
-		config: config,
-		logger: logger,
-		rules:  make(map[int]*RunningRule),
+		config:     config,
+		logger:     logger,
+		rules:      make(map[int]*RunningRule),
+		heartbeats: make(map[string]*types.Rule),
+
+		silencesChanged: make(chan struct{}, 1),
 	}
+
+	if config.Auth == nil {
+		config.Auth = &auth.Config{}
+	}
+	if config.Audit == nil {
+		config.Audit = &AuditConfig{}
+	}
+	var err error
+	if scheduler.auth, err = auth.NewAuthenticator(config.Auth, logger, apiWriteFail); err != nil {
+		return nil, err
+	}
+
 	return scheduler, nil
 }
 
@@ -79,11 +153,31 @@ func (s *Scheduler) Start() error {
 	}
 
 	// open database
-	if rdb, err := ruledb.NewRuleDB(s.config.DBPath, s.config.DBCollection); err != nil {
+	if rdb, err := ruledb.Open(s.config.DBType, s.config.DBPath, s.config.DBCollection); err != nil {
 		s.logger.Fatalw("Failed to open database.", "Error", err)
 	} else {
 		s.rdb = rdb
 	}
+	if enforcer, ok := s.rdb.(ruledb.QuotaEnforcer); ok {
+		maxRules := make(map[string]int)
+		for name, ns := range s.config.Namespaces {
+			if ns.MaxRules > 0 {
+				maxRules[name] = ns.MaxRules
+			}
+		}
+		enforcer.SetMaxRules(maxRules)
+	}
+
+	// load maintenance windows before rules start running
+	if err := s.loadMaintenanceWindows(); err != nil {
+		return fmt.Errorf("failed to load maintenance windows: %s", err)
+	}
+	s.maintenanceStop = make(chan struct{})
+	go s.watchMaintenanceWindows()
+
+	// distribute silences to executors
+	s.silenceStop = make(chan struct{})
+	go s.watchSilences()
 
 	// load all rules from database and run
 	if rules, errors, err := s.rdb.GetAll(); err != nil {
@@ -98,8 +192,31 @@ func (s *Scheduler) Start() error {
 		}
 	}
 
+	// follow changes made by other schedulers sharing the database
+	if notifier, ok := s.rdb.(ruledb.ChangeNotifier); ok {
+		go s.watchRuleChanges(notifier.Changes())
+	}
+
+	// setup audit sink
+	if s.config.Audit.Enabled {
+		if sink, err := newAuditSink(s.config.Audit); err != nil {
+			return fmt.Errorf("failed to initialize audit sink: %s", err)
+		} else {
+			s.auditSink = sink
+		}
+	}
+
+	// load rules from rule files, and keep watching for changes
+	if s.config.RulesDir != "" {
+		s.reconcileRuleFiles()
+		s.ruleFilesStop = make(chan struct{})
+		go s.watchRuleFiles()
+	}
+
 	// start api server
-	s.runAPIServer()
+	if err := s.runAPIServer(); err != nil {
+		return fmt.Errorf("failed to start api server: %s", err)
+	}
 
 	return nil
 }
@@ -108,6 +225,22 @@ func (s *Scheduler) Stop() {
 	// stop api server
 	s.stopAPIServer()
 
+	if s.ruleFilesStop != nil {
+		close(s.ruleFilesStop)
+	}
+
+	if s.maintenanceStop != nil {
+		close(s.maintenanceStop)
+	}
+
+	if s.silenceStop != nil {
+		close(s.silenceStop)
+	}
+
+	if s.auditSink != nil {
+		s.auditSink.Close()
+	}
+
 	// stop all running rules
 	s.logger.Info("Stopping all running rules...")
 
@@ -125,8 +258,60 @@ func (s *Scheduler) GatherStats() []*graphite.Metric {
 	return stats.ToGraphiteMetric(s.stats, "")
 }
 
+// recordRevision appends a revision to the rule's history, old is nil for created rules,
+// and rule is nil for deleted ones.
+func (s *Scheduler) recordRevision(action, author string, old, rule *types.Rule) {
+	rev := &types.RuleRevision{
+		Timestamp: types.FromTime(time.Now()),
+		Author:    author,
+		Action:    action,
+		Rule:      rule,
+		Diff:      types.DiffRules(old, rule),
+	}
+	if rule != nil {
+		rev.RuleID = rule.ID
+	} else {
+		rev.RuleID = old.ID
+		rev.Rule = old
+	}
+
+	if err := s.rdb.AddRevision(rev); err != nil {
+		s.logger.Errorw("Failed to save rule revision.", "Rule ID", rev.RuleID, "Error", err)
+	}
+}
+
+// watchRuleChanges reschedules rules changed in database, rules changed by this scheduler
+// are already running with the latest version, and are left alone.
+func (s *Scheduler) watchRuleChanges(changes <-chan ruledb.RuleChange) {
+	for change := range changes {
+		rule, err := s.rdb.Get(change.RuleID)
+		if err == ruledb.ErrNotFound {
+			s.stop(change.RuleID)
+			continue
+		} else if err != nil {
+			s.logger.Errorw("Error reading changed rule from db.", "Rule ID", change.RuleID, "Error", err)
+			continue
+		}
+
+		s.RLock()
+		running, ok := s.rules[rule.ID]
+		s.RUnlock()
+		if ok && running.Version == rule.Version {
+			continue
+		}
+
+		s.logger.Infow("Rule changed in db, rescheduling.", "Rule ID", rule.ID, "Action", change.Action)
+		s.schedule(rule)
+	}
+}
+
 func (s *Scheduler) schedule(r *types.Rule) {
 	s.stop(r.ID)
+	if check, ok := r.Check.(*types.HeartbeatCheck); ok {
+		s.Lock()
+		s.heartbeats[check.Token] = r
+		s.Unlock()
+	}
 	s.start(r)
 }
 
@@ -141,6 +326,11 @@ func (s *Scheduler) stop(id int) {
 		}
 		delete(s.rules, id)
 	}
+	for token, rule := range s.heartbeats {
+		if rule.ID == id {
+			delete(s.heartbeats, token)
+		}
+	}
 }
 
 func (s *Scheduler) start(rule *types.Rule) {
@@ -153,7 +343,8 @@ func (s *Scheduler) start(rule *types.Rule) {
 	s.logger.Infow("Start scheduling rule", "Rule ID", rule.ID)
 
 	r := &RunningRule{
-		Rule: rule,
+		Rule:    rule,
+		started: time.Now(),
 	}
 	r.stop = make(chan struct{})
 
@@ -169,6 +360,11 @@ func (s *Scheduler) start(rule *types.Rule) {
 		for {
 			select {
 			case <-ticker.C:
+				if w := s.inMaintenance(r.Rule); w != nil {
+					s.logger.Debugw("Rule is in maintenance, not emitting task.", "Rule ID", r.ID, "Window ID", w.ID)
+					s.stats.TaskSkippedMaintenance.Inc()
+					continue
+				}
 				s.emitTask(r.Rule)
 			case <-r.stop:
 				ticker.Stop()
@@ -181,7 +377,7 @@ func (s *Scheduler) start(rule *types.Rule) {
 
 func (s *Scheduler) emitTask(rule *types.Rule) {
 	s.stats.TaskScheduled.Inc()
-	t := types.NewTaskFromRule(rule)
+	t := s.newTask(rule)
 
 	s.logger.Debugw("Emitting task.", "Rule ID", t.RuleID)
 
@@ -195,5 +391,6 @@ func (s *Scheduler) emitTask(rule *types.Rule) {
 type RunningRule struct {
 	*types.Rule
 
-	stop chan struct{}
+	stop    chan struct{}
+	started time.Time
 }
@@ -0,0 +1,212 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"github.com/openmetric/yamf/internal/auth"
+	"github.com/openmetric/yamf/internal/ruledb"
+	"github.com/openmetric/yamf/internal/types"
+	"gopkg.in/gin-gonic/gin.v1"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// how often the full list of silences is published to executors, besides on changes,
+// so that newly started executors get them in time
+const silencePublishInterval = 30 * time.Second
+
+// publishSilences publishes all silences which have not expired to executors. Executors
+// replace their silences with each published list.
+func (s *Scheduler) publishSilences() error {
+	silences, err := s.rdb.GetSilences()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	current := make([]*types.Silence, 0, len(silences))
+	for _, silence := range silences {
+		if !silence.Expired(now) {
+			current = append(current, silence)
+		}
+	}
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	return s.producer.Publish(s.config.NSQSilenceTopic, data)
+}
+
+// watchSilences publishes silences periodically and when they are changed, until
+// silenceStop is closed.
+func (s *Scheduler) watchSilences() {
+	ticker := time.NewTicker(silencePublishInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.publishSilences(); err != nil {
+			s.logger.Errorw("Failed to publish silences.", "Error", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.silencesChanged:
+		case <-s.silenceStop:
+			return
+		}
+	}
+}
+
+// notifySilencesChanged asks watchSilences to publish silences now.
+func (s *Scheduler) notifySilencesChanged() {
+	select {
+	case s.silencesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// apiCheckSilencePermission checks if the user can manage silences, writes 403 response
+// if not. Silences match events instead of rule labels, so users limited to a scope
+// are not allowed.
+func (s *Scheduler) apiCheckSilencePermission(c *gin.Context) bool {
+	if user := auth.APIUser(c); user.Scoped() {
+		s.auth.LogDenied(c, user, "silences with a scope")
+		apiWriteFail(c, 403, "Permission denied, users with a scope can not manage silences")
+		return false
+	}
+	return true
+}
+
+// apiListSilences lists silences which have not expired, with "expired=true" expired
+// ones are included.
+func (s *Scheduler) apiListSilences(c *gin.Context) {
+	var silences []*types.Silence
+	var err error
+
+	includeExpired := false
+	if str := c.Query("expired"); str != "" {
+		if includeExpired, err = strconv.ParseBool(str); err != nil {
+			apiWriteFail(c, 400, "Bad expired: %s", str)
+			return
+		}
+	}
+
+	if silences, err = s.rdb.GetSilences(); err != nil {
+		apiWriteFail(c, 500, "Error loading silences from db, err: %s", err)
+		return
+	}
+
+	now := time.Now()
+	result := make([]*types.Silence, 0, len(silences))
+	for _, silence := range silences {
+		if includeExpired || !silence.Expired(now) {
+			result = append(result, silence)
+		}
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success:  true,
+		Message:  "",
+		Rules:    make([]*types.Rule, 0),
+		Silences: result,
+	})
+}
+
+func (s *Scheduler) apiCreateSilence(c *gin.Context) {
+	var body []byte
+	var err error
+
+	if !s.apiCheckSilencePermission(c) {
+		return
+	}
+
+	if body, err = ioutil.ReadAll(c.Request.Body); err != nil {
+		apiWriteFail(c, 500, "Error reading request body, err: %s", err)
+		return
+	}
+
+	silence := &types.Silence{}
+	if err = json.Unmarshal(body, silence); err != nil {
+		apiWriteFail(c, 400, "Error parsing body, err: %s", err)
+		return
+	}
+	silence.ID = 0
+	silence.Author = apiAuthor(c)
+	silence.CreatedAt = types.FromTime(time.Now())
+	if err = silence.Validate(); err != nil {
+		apiWriteFail(c, 400, "Invalid silence: %s", err)
+		return
+	}
+	if silence.Expired(time.Now()) {
+		apiWriteFail(c, 400, "Invalid silence: already expired")
+		return
+	}
+
+	if err = s.rdb.AddSilence(silence); err != nil {
+		apiWriteFail(c, 500, "Error saving silence to db, err: %s", err)
+		return
+	}
+	s.notifySilencesChanged()
+
+	c.JSON(200, apiResponseBody{
+		Success:  true,
+		Message:  "",
+		Rules:    make([]*types.Rule, 0),
+		Silences: []*types.Silence{silence},
+	})
+}
+
+// apiExpireSilence ends a silence now, the silence is kept for history.
+func (s *Scheduler) apiExpireSilence(c *gin.Context) {
+	var silences []*types.Silence
+	var id int
+	var err error
+
+	if !s.apiCheckSilencePermission(c) {
+		return
+	}
+
+	if id, err = strconv.Atoi(c.Param("id")); err != nil {
+		apiWriteFail(c, 400, "Bad silence id: %s", c.Param("id"))
+		return
+	}
+
+	if silences, err = s.rdb.GetSilences(); err != nil {
+		apiWriteFail(c, 500, "Error loading silences from db, err: %s", err)
+		return
+	}
+	var silence *types.Silence
+	for _, item := range silences {
+		if item.ID == id {
+			silence = item
+		}
+	}
+	if silence == nil {
+		apiWriteFail(c, 404, "Silence not found")
+		return
+	}
+
+	now := time.Now()
+	if !silence.Expired(now) {
+		silence.ExpiresAt = types.FromTime(now)
+		if !silence.StartsAt.IsZero() && silence.StartsAt.After(now) {
+			silence.StartsAt = silence.ExpiresAt
+		}
+		if err = s.rdb.UpdateSilence(silence); err == ruledb.ErrNotFound {
+			apiWriteFail(c, 404, "Silence not found")
+			return
+		} else if err != nil {
+			apiWriteFail(c, 500, "Error saving silence to db, err: %s", err)
+			return
+		}
+		s.notifySilencesChanged()
+	}
+
+	c.JSON(200, apiResponseBody{
+		Success:  true,
+		Message:  "",
+		Rules:    make([]*types.Rule, 0),
+		Silences: []*types.Silence{silence},
+	})
+}
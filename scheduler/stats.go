@@ -7,4 +7,8 @@ import (
 type Stats struct {
 	ActiveRules   stats.Gauge   `stats:"ActiveRules"`
 	TaskScheduled stats.Counter `stats:"TaskScheduled"`
+	// tasks not emitted because the rule is in a maintenance window
+	TaskSkippedMaintenance stats.Counter `stats:"TaskSkippedMaintenance"`
+	// pings of heartbeat rules
+	HeartbeatReceived stats.Counter `stats:"HeartbeatReceived"`
 }
@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// minimum tls version, one of "1.0", "1.1", "1.2", "1.3"
+	MinVersion string `yaml:"min_version"`
+	// if set, clients must present a certificate signed by one of the CAs in this file
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader holds the current certificate and client CAs, which can be reloaded
+// while the server is running. New connections use the reloaded ones, connections
+// already established are not affected.
+type certReloader struct {
+	config     *TLSConfig
+	minVersion uint16
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	sync.RWMutex
+}
+
+func newCertReloader(config *TLSConfig) (*certReloader, error) {
+	r := &certReloader{config: config}
+
+	if config.MinVersion == "" {
+		r.minVersion = tls.VersionTLS12
+	} else if v, ok := tlsVersions[config.MinVersion]; ok {
+		r.minVersion = v
+	} else {
+		return nil, fmt.Errorf("unsupported tls min_version: %s", config.MinVersion)
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads certificate and client CAs from files, the current ones are kept if
+// loading fails.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(r.config.ClientCAFile); err != nil {
+			return fmt.Errorf("failed to load client CA: %s", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in client CA file: %s", r.config.ClientCAFile)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	return nil
+}
+
+func (r *certReloader) serverConfig() *tls.Config {
+	r.RLock()
+	defer r.RUnlock()
+
+	config := &tls.Config{
+		MinVersion:   r.minVersion,
+		Certificates: []tls.Certificate{*r.cert},
+	}
+	if r.clientCAs != nil {
+		config.ClientCAs = r.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// tlsConfig returns a tls config which always uses the latest loaded certificate and
+// client CAs.
+func (r *certReloader) tlsConfig() *tls.Config {
+	config := r.serverConfig()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return r.serverConfig(), nil
+	}
+	return config
+}
+
+// watchReloadSignal reloads certificates on SIGHUP, until stop is closed.
+func (s *Scheduler) watchReloadSignal(r *certReloader, stop chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-c:
+			if err := r.reload(); err != nil {
+				s.logger.Errorw("Failed to reload api server certificates.", "Error", err)
+			} else {
+				s.logger.Info("Reloaded api server certificates.")
+			}
+		case <-stop:
+			return
+		}
+	}
+}